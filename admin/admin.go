@@ -0,0 +1,257 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+)
+
+const (
+	usage = `usage: account-interface admin [-json] <command> <subcommand> [flags] [arguments]
+
+commands:
+  client create|list|show|update|delete|rotate-secret|unlock
+  user   create|list|set-password|set-state|disable|reset-mfa|unlock|delete
+  token  list|revoke
+
+passwords are read from the first line of standard input, client secrets are
+generated and printed once.
+`
+)
+
+var (
+	errUsage = errors.New("invalid usage")
+)
+
+// command runs one subcommand. It gets the arguments after its name and
+// returns what to print.
+type command func(admin *Admin, args []string) (interface{}, error)
+
+var commands = map[string]map[string]command{
+	"client": {
+		"create":        (*Admin).createClient,
+		"list":          (*Admin).listClients,
+		"show":          (*Admin).showClient,
+		"update":        (*Admin).updateClient,
+		"delete":        (*Admin).deleteClient,
+		"rotate-secret": (*Admin).rotateClientSecret,
+		"unlock":        (*Admin).unlockClient,
+	},
+	"user": {
+		"create":       (*Admin).createUser,
+		"list":         (*Admin).listUsers,
+		"set-password": (*Admin).setUserPassword,
+		"set-state":    (*Admin).setUserState,
+		"disable":      (*Admin).disableUser,
+		"reset-mfa":    (*Admin).resetUserMFA,
+		"unlock":       (*Admin).unlockUser,
+		"delete":       (*Admin).deleteUser,
+	},
+	"token": {
+		"list":   (*Admin).listTokens,
+		"revoke": (*Admin).revokeTokens,
+	},
+}
+
+// Admin manages clients, users and tokens directly in the configured store,
+// for operators and scripts.
+type Admin struct {
+	stores *store.Stores
+	stdin  io.Reader
+	stdout io.Writer
+	json   bool
+}
+
+// Main runs the admin command line and returns the exit status.
+func Main(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	jsonOutput := flags.Bool("json", false, "print results as JSON")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) < 2 || commands[args[0]] == nil || commands[args[0]][args[1]] == nil {
+		flags.Usage()
+		return 2
+	}
+	run := commands[args[0]][args[1]]
+
+	if config.Default.Database.Memory != nil {
+		fmt.Fprintln(os.Stderr, "the memory database only lives inside the server, there is nothing to manage")
+		return 1
+	}
+	stores, err := store.Open(&config.Default.Database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer stores.Close()
+
+	self := &Admin{
+		stores: stores,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		json:   *jsonOutput,
+	}
+	result, err := run(self, args[2:])
+	if err == errUsage {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = self.print(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// table is printed as tab aligned columns, or as a JSON array of its rows.
+type table interface {
+	header() []string
+	rows() [][]string
+}
+
+func (self *Admin) print(result interface{}) error {
+	if result == nil {
+		return nil
+	}
+	if self.json {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(self.stdout, string(data))
+		return err
+	}
+	writer := tabwriter.NewWriter(self.stdout, 0, 4, 2, ' ', 0)
+	if result, ok := result.(table); ok {
+		fmt.Fprintln(writer, strings.Join(result.header(), "\t"))
+		for _, row := range result.rows() {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		return writer.Flush()
+	}
+	// single objects go out as name and value lines sorted by name
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := fields[name]
+		if values, ok := value.([]interface{}); ok {
+			parts := make([]string, len(values))
+			for i, element := range values {
+				parts[i] = fmt.Sprint(element)
+			}
+			value = strings.Join(parts, " ")
+		}
+		fmt.Fprintf(writer, "%v:\t%v\n", name, value)
+	}
+	return writer.Flush()
+}
+
+// parseFlags parses the flags of a subcommand and checks it got exactly
+// nargs arguments, any number when nargs is negative.
+func parseFlags(flags *flag.FlagSet, args []string, nargs int, argsUsage string) ([]string, error) {
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: account-interface admin %v [flags] %v\n", flags.Name(), argsUsage)
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return nil, errUsage
+	}
+	if nargs >= 0 && flags.NArg() != nargs {
+		flags.Usage()
+		return nil, errUsage
+	}
+	return flags.Args(), nil
+}
+
+func (self *Admin) readPassword() ([]byte, error) {
+	line, err := bufio.NewReader(self.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return nil, errors.New("empty password on standard input")
+	}
+	return []byte(password), nil
+}
+
+// operator names whoever runs the command in the audit fields.
+func operator() string {
+	current, err := user.Current()
+	if err != nil {
+		return "admin"
+	}
+	return current.Username
+}
+
+func parseScopes(value string) map[string]bool {
+	scopes := make(map[string]bool)
+	for _, scope := range strings.FieldsFunc(value, func(char rune) bool {
+		return char == ',' || char == ' '
+	}) {
+		scopes[scope] = true
+	}
+	return scopes
+}
+
+func (self *Admin) revokeAccessToken(tokenInfo *accesstoken.TokenInfo) error {
+	if tokenInfo.RefreshFamily != "" {
+		err := self.stores.RevokeRefreshTokenFamily(tokenInfo.RefreshFamily)
+		if err != nil {
+			return err
+		}
+	}
+	return self.stores.Tokens.DeleteTokenInfo(tokenInfo.Token, tokenInfo.Client)
+}
+
+// unlockResult reports how many failed attempts an unlock forgot.
+type unlockResult struct {
+	Failures int64 `json:"failures"`
+}
+
+// unlock forgets the failed attempts of a lockout key, whether or not it is
+// locked right now.
+func (self *Admin) unlock(key string) (interface{}, error) {
+	attemptInfo, err := self.stores.Attempts.GetAttemptInfo(key)
+	if err != nil || attemptInfo == nil {
+		return &unlockResult{}, err
+	}
+	err = self.stores.Attempts.DeleteAttemptInfo(key)
+	if err != nil {
+		return nil, err
+	}
+	return &unlockResult{Failures: attemptInfo.Failures}, nil
+}
@@ -0,0 +1,338 @@
+package admin
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/client-secret"
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/token-lifetime"
+)
+
+type clientView struct {
+	ClientID                string     `json:"client_id"`
+	ClientSecret            string     `json:"client_secret,omitempty"`
+	ClientName              string     `json:"client_name,omitempty"`
+	Description             string     `json:"description,omitempty"`
+	Owner                   string     `json:"owner,omitempty"`
+	Public                  bool       `json:"public"`
+	AuthorizationCodeScopes []string   `json:"authorization_code_scopes"`
+	ImplicitScopes          []string   `json:"implicit_scopes"`
+	PasswordScopes          []string   `json:"password_scopes"`
+	ClientCredentialsScopes []string   `json:"client_credentials_scopes"`
+	DefaultScopes           []string   `json:"default_scopes"`
+	RedirectURI             string     `json:"redirect_uri,omitempty"`
+	ImplicitRedirectURI     string     `json:"implicit_redirect_uri,omitempty"`
+	AccessTokenTTL          int64      `json:"access_token_ttl,omitempty"`
+	RefreshTokenTTL         int64      `json:"refresh_token_ttl,omitempty"`
+	SessionLifetime         int64      `json:"session_lifetime,omitempty"`
+	IdleTimeout             int64      `json:"idle_timeout,omitempty"`
+	RefreshTokens           *bool      `json:"refresh_tokens,omitempty"`
+	CreateDate              *time.Time `json:"create_date,omitempty"`
+	CreateUser              string     `json:"create_user,omitempty"`
+	UpdateDate              *time.Time `json:"update_date,omitempty"`
+	UpdateUser              string     `json:"update_user,omitempty"`
+}
+
+func newClientView(clientInfo *client.ClientInfo) *clientView {
+	return &clientView{
+		ClientID:                clientInfo.ClientUsername,
+		ClientName:              clientInfo.ClientName,
+		Description:             clientInfo.Description,
+		Owner:                   clientInfo.OwnerUsername,
+		Public:                  clientInfo.PublicClient,
+		AuthorizationCodeScopes: database.SortedScopes(clientInfo.GrantAuthorizationCode),
+		ImplicitScopes:          database.SortedScopes(clientInfo.GrantImplicit),
+		PasswordScopes:          database.SortedScopes(clientInfo.GrantResourceOwner),
+		ClientCredentialsScopes: database.SortedScopes(clientInfo.GrantClientCredentials),
+		DefaultScopes:           database.SortedScopes(clientInfo.DefaultScopes),
+		RedirectURI:             clientInfo.RedirectURIAuthorCode,
+		ImplicitRedirectURI:     clientInfo.RedirectURIImplicit,
+		AccessTokenTTL:          clientInfo.AccessTokenTTL,
+		RefreshTokenTTL:         clientInfo.RefreshTokenTTL,
+		SessionLifetime:         clientInfo.SessionLifetime,
+		IdleTimeout:             clientInfo.IdleTimeout,
+		RefreshTokens:           clientInfo.IssueRefreshTokens,
+		CreateDate:              clientInfo.CreateDate,
+		CreateUser:              clientInfo.CreateUser,
+		UpdateDate:              clientInfo.UpdateDate,
+		UpdateUser:              clientInfo.UpdateUser,
+	}
+}
+
+type clientTable []*clientView
+
+func (self clientTable) header() []string {
+	return []string{"CLIENT_ID", "NAME", "PUBLIC", "OWNER", "REDIRECT_URI"}
+}
+
+func (self clientTable) rows() [][]string {
+	rows := make([][]string, len(self))
+	for i, view := range self {
+		rows[i] = []string{view.ClientID, view.ClientName, fmt.Sprint(view.Public), view.Owner, view.RedirectURI}
+	}
+	return rows
+}
+
+// clientFlags are shared by create and update, update only applies the ones
+// given on the command line.
+type clientFlags struct {
+	name                    *string
+	description             *string
+	owner                   *string
+	public                  *bool
+	redirectURI             *string
+	implicitRedirectURI     *string
+	authorizationCodeScopes *string
+	implicitScopes          *string
+	passwordScopes          *string
+	clientCredentialsScopes *string
+	defaultScopes           *string
+	accessTokenTTL          *time.Duration
+	refreshTokenTTL         *time.Duration
+	sessionLifetime         *time.Duration
+	idleTimeout             *time.Duration
+	refreshTokens           *string
+}
+
+func newClientFlags(flags *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		name:                    flags.String("name", "", "client name"),
+		description:             flags.String("description", "", "client description"),
+		owner:                   flags.String("owner", "", "username of the owner"),
+		public:                  flags.Bool("public", false, "public client without a secret"),
+		redirectURI:             flags.String("redirect-uri", "", "redirect URI of the authorization code grant"),
+		implicitRedirectURI:     flags.String("implicit-redirect-uri", "", "redirect URI of the implicit grant"),
+		authorizationCodeScopes: flags.String("authorization-code-scopes", "", "scopes of the authorization code grant"),
+		implicitScopes:          flags.String("implicit-scopes", "", "scopes of the implicit grant"),
+		passwordScopes:          flags.String("password-scopes", "", "scopes of the password grant"),
+		clientCredentialsScopes: flags.String("client-credentials-scopes", "", "scopes of the client credentials grant"),
+		defaultScopes:           flags.String("default-scopes", "", "scopes granted when a request names none"),
+		accessTokenTTL:          flags.Duration("access-token-ttl", 0, "access token lifetime, 0 for the server default"),
+		refreshTokenTTL:         flags.Duration("refresh-token-ttl", 0, "refresh token lifetime, 0 for the server default"),
+		sessionLifetime:         flags.Duration("session-lifetime", 0, "lifetime of a refresh token chain, 0 for the server default"),
+		idleTimeout:             flags.Duration("idle-timeout", 0, "how long an unused refresh token lives, 0 for the server default"),
+		refreshTokens:           flags.String("refresh-tokens", "default", "whether to issue refresh tokens, true, false or default"),
+	}
+}
+
+// apply copies the given flags onto clientInfo and checks the token
+// lifetimes against the server policy.
+func (self *clientFlags) apply(flags *flag.FlagSet, clientInfo *client.ClientInfo) error {
+	var err error
+	flags.Visit(func(setFlag *flag.Flag) {
+		switch setFlag.Name {
+		case "name":
+			clientInfo.ClientName = *self.name
+		case "description":
+			clientInfo.Description = *self.description
+		case "owner":
+			clientInfo.OwnerUsername = *self.owner
+		case "public":
+			clientInfo.PublicClient = *self.public
+		case "redirect-uri":
+			clientInfo.RedirectURIAuthorCode = *self.redirectURI
+		case "implicit-redirect-uri":
+			clientInfo.RedirectURIImplicit = *self.implicitRedirectURI
+		case "authorization-code-scopes":
+			clientInfo.GrantAuthorizationCode = parseScopes(*self.authorizationCodeScopes)
+		case "implicit-scopes":
+			clientInfo.GrantImplicit = parseScopes(*self.implicitScopes)
+		case "password-scopes":
+			clientInfo.GrantResourceOwner = parseScopes(*self.passwordScopes)
+		case "client-credentials-scopes":
+			clientInfo.GrantClientCredentials = parseScopes(*self.clientCredentialsScopes)
+		case "default-scopes":
+			clientInfo.DefaultScopes = parseScopes(*self.defaultScopes)
+		case "access-token-ttl":
+			clientInfo.AccessTokenTTL = int64(*self.accessTokenTTL / time.Second)
+		case "refresh-token-ttl":
+			clientInfo.RefreshTokenTTL = int64(*self.refreshTokenTTL / time.Second)
+		case "session-lifetime":
+			clientInfo.SessionLifetime = int64(*self.sessionLifetime / time.Second)
+		case "idle-timeout":
+			clientInfo.IdleTimeout = int64(*self.idleTimeout / time.Second)
+		case "refresh-tokens":
+			switch *self.refreshTokens {
+			case "default":
+				clientInfo.IssueRefreshTokens = nil
+			case "true", "false":
+				issueRefreshTokens := *self.refreshTokens == "true"
+				clientInfo.IssueRefreshTokens = &issueRefreshTokens
+			default:
+				err = fmt.Errorf("bad refresh-tokens %v, want true, false or default", *self.refreshTokens)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return tokenlifetime.Default.CheckClient(clientInfo)
+}
+
+func (self *Admin) getClient(username string) (*client.ClientInfo, error) {
+	clientInfo, err := self.stores.Clients.GetClientInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	if clientInfo == nil {
+		return nil, fmt.Errorf("client %v does not exist", username)
+	}
+	return clientInfo, nil
+}
+
+func (self *Admin) createClient(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("client create", flag.ContinueOnError)
+	options := newClientFlags(flags)
+	args, err := parseFlags(flags, args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	clientInfo := &client.ClientInfo{
+		ClientUsername: args[0],
+		CreateDate:     &now,
+		UpdateDate:     &now,
+		CreateUser:     operator(),
+		UpdateUser:     operator(),
+	}
+	err = options.apply(flags, clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	secret := ""
+	if !clientInfo.PublicClient {
+		secret, err = clientsecret.New(clientInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = self.stores.Clients.PutClientInfo(clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	view := newClientView(clientInfo)
+	view.ClientSecret = secret
+	return view, nil
+}
+
+func (self *Admin) listClients(args []string) (interface{}, error) {
+	_, err := parseFlags(flag.NewFlagSet("client list", flag.ContinueOnError), args, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	clientInfos, err := self.stores.Clients.ListClientInfo()
+	if err != nil {
+		return nil, err
+	}
+	views := clientTable{}
+	for _, clientInfo := range clientInfos {
+		views = append(views, newClientView(clientInfo))
+	}
+	return views, nil
+}
+
+func (self *Admin) showClient(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("client show", flag.ContinueOnError), args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	clientInfo, err := self.getClient(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return newClientView(clientInfo), nil
+}
+
+func (self *Admin) updateClient(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("client update", flag.ContinueOnError)
+	options := newClientFlags(flags)
+	args, err := parseFlags(flags, args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	clientInfo, err := self.getClient(args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = options.apply(flags, clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	clientInfo.UpdateDate = &now
+	clientInfo.UpdateUser = operator()
+	// public clients must not keep a secret they could still authenticate
+	// with, and a client turned confidential needs a new one
+	if clientInfo.PublicClient {
+		clientInfo.EncryptedPassword = nil
+		clientInfo.Salt = nil
+	}
+	secret := ""
+	if !clientInfo.PublicClient && len(clientInfo.EncryptedPassword) == 0 {
+		secret, err = clientsecret.New(clientInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = self.stores.Clients.UpdateClientInfo(clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	view := newClientView(clientInfo)
+	view.ClientSecret = secret
+	return view, nil
+}
+
+func (self *Admin) deleteClient(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("client delete", flag.ContinueOnError), args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := self.stores.DeleteClient(args[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	return &revokeResult{Revoked: revoked}, nil
+}
+
+func (self *Admin) rotateClientSecret(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("client rotate-secret", flag.ContinueOnError), args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	clientInfo, err := self.getClient(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if clientInfo.PublicClient {
+		return nil, errors.New("public clients have no secret")
+	}
+	secret, err := clientsecret.New(clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	clientInfo.UpdateDate = &now
+	clientInfo.UpdateUser = operator()
+	err = self.stores.Clients.UpdateClientInfo(clientInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}{clientInfo.ClientUsername, secret}, nil
+}
+
+func (self *Admin) unlockClient(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("client unlock", flag.ContinueOnError), args, 1, "<client-id>")
+	if err != nil {
+		return nil, err
+	}
+	return self.unlock(lockout.ClientKey(args[0]))
+}
@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type tokenView struct {
+	Token     string     `json:"token"`
+	ClientID  string     `json:"client_id"`
+	Username  string     `json:"username,omitempty"`
+	Scope     string     `json:"scope"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Expired   bool       `json:"expired"`
+}
+
+type tokenTable []*tokenView
+
+func (self tokenTable) header() []string {
+	return []string{"TOKEN", "CLIENT_ID", "USERNAME", "SCOPE", "EXPIRES_AT"}
+}
+
+func (self tokenTable) rows() [][]string {
+	rows := make([][]string, len(self))
+	for i, view := range self {
+		expiresAt := view.ExpiresAt.Format(time.RFC3339)
+		if view.Expired {
+			expiresAt += " (expired)"
+		}
+		rows[i] = []string{view.Token, view.ClientID, view.Username, view.Scope, expiresAt}
+	}
+	return rows
+}
+
+func (self *Admin) listTokens(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("token list", flag.ContinueOnError)
+	clientID := flags.String("client", "", "only tokens of this client")
+	username := flags.String("user", "", "only tokens of this user")
+	_, err := parseFlags(flags, args, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	tokenInfos, err := self.stores.Tokens.ListTokenInfo()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	views := tokenTable{}
+	for _, tokenInfo := range tokenInfos {
+		if *clientID != "" && tokenInfo.Client != *clientID {
+			continue
+		}
+		if *username != "" && tokenInfo.User != *username {
+			continue
+		}
+		views = append(views, &tokenView{
+			Token:     tokenInfo.Token,
+			ClientID:  tokenInfo.Client,
+			Username:  tokenInfo.User,
+			Scope:     tokenInfo.Scopes,
+			IssuedAt:  tokenInfo.IssueTime,
+			ExpiresAt: tokenInfo.ExpireTime,
+			Expired:   tokenInfo.ExpireTime.Before(now),
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ExpiresAt.Before(*views[j].ExpiresAt)
+	})
+	return views, nil
+}
+
+// revokeTokens revokes one access or refresh token given as argument, or
+// every token of a client or user.
+func (self *Admin) revokeTokens(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("token revoke", flag.ContinueOnError)
+	clientID := flags.String("client", "", "revoke every token of this client")
+	username := flags.String("user", "", "revoke every token of this user")
+	args, err := parseFlags(flags, args, -1, "<token> | -client <client-id> | -user <username>")
+	if err != nil {
+		return nil, err
+	}
+	bulk := *clientID != "" || *username != ""
+	if bulk && len(args) != 0 || !bulk && len(args) != 1 {
+		flags.Usage()
+		return nil, errUsage
+	}
+	if bulk {
+		var revoked int
+		switch {
+		case *username == "":
+			revoked, err = self.stores.RevokeClientTokens(*clientID)
+		case *clientID == "":
+			revoked, err = self.stores.RevokeUserTokens(*username)
+		default:
+			revoked, err = self.stores.RevokeTokens(func(client string, user string) bool {
+				return client == *clientID && user == *username
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &revokeResult{Revoked: revoked}, nil
+	}
+
+	token := args[0]
+	tokenInfo, err := self.stores.Tokens.FindTokenInfo(token)
+	if err != nil {
+		return nil, err
+	}
+	if tokenInfo != nil {
+		err = self.revokeAccessToken(tokenInfo)
+		if err != nil {
+			return nil, err
+		}
+		return &revokeResult{Revoked: 1}, nil
+	}
+	refreshTokenInfo, err := self.stores.RefreshTokens.GetTokenInfo(token)
+	if err != nil {
+		return nil, err
+	}
+	if refreshTokenInfo == nil {
+		return nil, fmt.Errorf("token %v does not exist", token)
+	}
+	err = self.stores.RevokeRefreshTokenFamily(refreshTokenInfo.Family)
+	if err != nil {
+		return nil, err
+	}
+	return &revokeResult{Revoked: 1}, nil
+}
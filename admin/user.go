@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+)
+
+const (
+	uidLength = 32
+)
+
+type userView struct {
+	Username    string     `json:"username"`
+	UID         string     `json:"uid"`
+	State       string     `json:"state"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	Email       string     `json:"email,omitempty"`
+	DisplayName string     `json:"display_name,omitempty"`
+	CreateDate  *time.Time `json:"create_date,omitempty"`
+	UpdateDate  *time.Time `json:"update_date,omitempty"`
+}
+
+type userTable []*userView
+
+func (self userTable) header() []string {
+	return []string{"USERNAME", "UID", "STATE", "EMAIL"}
+}
+
+func (self userTable) rows() [][]string {
+	rows := make([][]string, len(self))
+	for i, view := range self {
+		rows[i] = []string{view.Username, view.UID, view.State, view.Email}
+	}
+	return rows
+}
+
+func newUserView(userInfo *user.UserInfo) *userView {
+	return &userView{
+		Username:    userInfo.Username,
+		UID:         userInfo.UID,
+		State:       userInfo.State,
+		MFAEnabled:  userInfo.MFAEnabled(),
+		Email:       userInfo.Email,
+		DisplayName: userInfo.DisplayName,
+		CreateDate:  userInfo.CreateDate,
+		UpdateDate:  userInfo.UpdateDate,
+	}
+}
+
+// revokeResult reports how many tokens a command revoked.
+type revokeResult struct {
+	Revoked int `json:"revoked"`
+}
+
+func (self *Admin) getUser(username string) (*user.UserInfo, error) {
+	userInfo, err := self.stores.Users.GetUserInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	if userInfo == nil {
+		return nil, fmt.Errorf("user %v does not exist", username)
+	}
+	return userInfo, nil
+}
+
+func (self *Admin) revokeUserTokens(username string) (int, error) {
+	return self.stores.RevokeUserTokens(username)
+}
+
+func (self *Admin) createUser(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	uid := flags.String("uid", "", "user id, generated when empty")
+	email := flags.String("email", "", "email address")
+	displayName := flags.String("name", "", "display name")
+	state := flags.String("state", user.ActiveState, "account state")
+	args, err := parseFlags(flags, args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	if !user.ValidState(*state) {
+		return nil, fmt.Errorf("invalid state %v", *state)
+	}
+	password, err := self.readPassword()
+	if err != nil {
+		return nil, err
+	}
+	encryptedPassword, err := encrypt.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userInfo := &user.UserInfo{
+		UID:               *uid,
+		Username:          args[0],
+		EncryptedPassword: encryptedPassword,
+		State:             *state,
+		Email:             *email,
+		DisplayName:       *displayName,
+		CreateDate:        &now,
+		UpdateDate:        &now,
+	}
+	if userInfo.UID == "" {
+		userInfo.UID = stringgenerator.RandomString(uidLength)
+	}
+	err = self.stores.Users.PutUserInfo(userInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newUserView(userInfo), nil
+}
+
+func (self *Admin) listUsers(args []string) (interface{}, error) {
+	_, err := parseFlags(flag.NewFlagSet("user list", flag.ContinueOnError), args, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	userInfos, err := self.stores.Users.ListUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	views := userTable{}
+	for _, userInfo := range userInfos {
+		views = append(views, newUserView(userInfo))
+	}
+	return views, nil
+}
+
+func (self *Admin) setUserPassword(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user set-password", flag.ContinueOnError), args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	userInfo, err := self.getUser(args[0])
+	if err != nil {
+		return nil, err
+	}
+	password, err := self.readPassword()
+	if err != nil {
+		return nil, err
+	}
+	encryptedPassword, err := encrypt.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	err = self.stores.Users.UpdatePassword(userInfo.Username, encryptedPassword, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newUserView(userInfo), nil
+}
+
+func (self *Admin) setUserState(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user set-state", flag.ContinueOnError), args, 2, "<username> pending|active|locked|disabled|deleted")
+	if err != nil {
+		return nil, err
+	}
+	return self.changeUserState(args[0], args[1])
+}
+
+// disableUser blocks new logins and revokes the tokens the user already has.
+func (self *Admin) disableUser(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user disable", flag.ContinueOnError), args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	return self.changeUserState(args[0], user.DisabledState)
+}
+
+// resetUserMFA removes the TOTP secret and recovery codes of a user who lost
+// both, the user signs in with the password alone until enrolling again.
+func (self *Admin) resetUserMFA(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user reset-mfa", flag.ContinueOnError), args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	userInfo, err := self.getUser(args[0])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userInfo.TOTPSecret = nil
+	userInfo.TOTPEnabled = false
+	userInfo.TOTPLastStep = 0
+	userInfo.RecoveryCodes = nil
+	userInfo.UpdateDate = &now
+	err = self.stores.Users.UpdateUserInfo(userInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newUserView(userInfo), nil
+}
+
+func (self *Admin) unlockUser(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user unlock", flag.ContinueOnError), args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	return self.unlock(lockout.UserKey(args[0]))
+}
+
+// changeUserState moves the user to state. Leaving the active state revokes
+// the tokens the user already has.
+func (self *Admin) changeUserState(username string, state string) (interface{}, error) {
+	if !user.ValidState(state) {
+		return nil, fmt.Errorf("invalid state %v", state)
+	}
+	userInfo, err := self.getUser(username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userInfo.State = state
+	userInfo.UpdateDate = &now
+	err = self.stores.Users.UpdateUserInfo(userInfo)
+	if err != nil {
+		return nil, err
+	}
+	revoked := 0
+	if !userInfo.Active() {
+		revoked, err = self.revokeUserTokens(userInfo.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &revokeResult{Revoked: revoked}, nil
+}
+
+func (self *Admin) deleteUser(args []string) (interface{}, error) {
+	args, err := parseFlags(flag.NewFlagSet("user delete", flag.ContinueOnError), args, 1, "<username>")
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := self.stores.DeleteUser(args[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	return &revokeResult{Revoked: revoked}, nil
+}
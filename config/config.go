@@ -2,7 +2,6 @@ package config
 
 import (
 	"encoding/xml"
-	"log"
 )
 
 const (
@@ -10,28 +9,44 @@ const (
 )
 
 var (
-	Default *Root
+	// Default is the config of the running server, the built-in defaults
+	// until LoadDefault reads DefaultFile
+	Default = &Root{}
 )
 
-func init() {
-	var err error
-
-	// load default configurations
-	Default, err = Load(DefaultFile)
+// LoadDefault reads DefaultFile into Default. Packages that configure
+// themselves from it are handed their part by main afterwards.
+func LoadDefault() error {
+	root, err := Load(DefaultFile)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
+	Default = root
+	return nil
 }
 
 type Root struct {
-	XMLName  xml.Name `xml:"itemcode-db"`
-	Server   *Server  `xml:"server"`
-	Database Database `xml:"database"`
+	XMLName         xml.Name        `xml:"itemcode-db"`
+	Server          *Server         `xml:"server"`
+	Database        Database        `xml:"database"`
+	AccessToken     AccessToken     `xml:"access-token"`
+	PasswordHash    PasswordHash    `xml:"password-hash"`
+	TokenGeneration TokenGeneration `xml:"token-generation"`
+	Janitor         *Janitor        `xml:"janitor"`
+	Registration    *Registration   `xml:"registration"`
+	Accounts        *Accounts       `xml:"accounts"`
+	Lockout         *Lockout        `xml:"lockout"`
+	TokenLifetime   *TokenLifetime  `xml:"token-lifetime"`
+	Metadata        *Metadata       `xml:"metadata"`
 }
 
+// Server is where the server listens. TrustedProxies are the space separated
+// addresses or CIDR ranges of reverse proxies in front of it, requests they
+// forward are taken to come from the address they add to X-Forwarded-For.
 type Server struct {
-	Address string `xml:"address"`
-	Tls     *Tls   `xml:"tls"`
+	Address        string `xml:"address"`
+	Tls            *Tls   `xml:"tls"`
+	TrustedProxies string `xml:"trusted-proxies"`
 }
 
 type Tls struct {
@@ -41,12 +56,159 @@ type Tls struct {
 }
 
 type Database struct {
-	BoltDB BoltDB `xml:"bolt-db"`
+	Memory *Memory `xml:"memory"`
+	SQL    *SQL    `xml:"sql"`
+	BoltDB BoltDB  `xml:"bolt-db"`
+	Redis  *Redis  `xml:"redis"`
+}
+
+// Memory selects the in-memory stores instead of bolt-db. It has no settings,
+// the element only has to be present.
+type Memory struct {
+}
+
+// SQL selects a database/sql backend, driver is sqlite or postgres. Unlike
+// bolt-db a postgres database can be shared by several instances.
+type SQL struct {
+	Driver             string `xml:"driver,attr"`
+	DataSource         string `xml:"data-source"`
+	MaxOpenConnections int    `xml:"max-open-connections"`
+}
+
+// Redis moves access tokens to a redis server, everything else stays in the
+// store selected by the other elements.
+type Redis struct {
+	Address   string `xml:"address"`
+	Password  string `xml:"password"`
+	DB        int    `xml:"db"`
+	KeyPrefix string `xml:"key-prefix"`
+	PoolSize  int    `xml:"pool-size"`
 }
 
 type BoltDB struct {
-	ClientDB       string `xml:"client-db"`
-	UserDB         string `xml:"user-db"`
-	AccessTokenDB  string `xml:"access-token-db"`
-	RefreshTokenDB string `xml:"refresh-token-db"`
+	ClientDB            string `xml:"client-db"`
+	UserDB              string `xml:"user-db"`
+	AccessTokenDB       string `xml:"access-token-db"`
+	RefreshTokenDB      string `xml:"refresh-token-db"`
+	AuthorizationCodeDB string `xml:"authorization-code-db"`
+	LoginAttemptDB      string `xml:"login-attempt-db"`
+}
+
+type AccessToken struct {
+	Format      string       `xml:"format,attr"`
+	Issuer      string       `xml:"issuer"`
+	Audience    string       `xml:"audience"`
+	SigningKeys []SigningKey `xml:"signing-key"`
+}
+
+type SigningKey struct {
+	Kid       string `xml:"kid,attr"`
+	Algorithm string `xml:"algorithm,attr"`
+	State     string `xml:"state,attr"`
+	File      string `xml:",chardata"`
+}
+
+type PasswordHash struct {
+	Algorithm string    `xml:"algorithm,attr"`
+	Argon2id  *Argon2id `xml:"argon2id"`
+	Bcrypt    *Bcrypt   `xml:"bcrypt"`
+	Scrypt    *Scrypt   `xml:"scrypt"`
+}
+
+type Argon2id struct {
+	Memory      uint32 `xml:"memory,attr"`
+	Iterations  uint32 `xml:"iterations,attr"`
+	Parallelism uint8  `xml:"parallelism,attr"`
+}
+
+type Bcrypt struct {
+	Cost int `xml:"cost,attr"`
+}
+
+type Scrypt struct {
+	Cost        int `xml:"cost,attr"`
+	BlockSize   int `xml:"block-size,attr"`
+	Parallelism int `xml:"parallelism,attr"`
+}
+
+type TokenGeneration struct {
+	AccessToken       TokenFormat `xml:"access-token"`
+	RefreshToken      TokenFormat `xml:"refresh-token"`
+	AuthorizationCode TokenFormat `xml:"authorization-code"`
+	DeviceCode        TokenFormat `xml:"device-code"`
+	RegistrationToken TokenFormat `xml:"registration-token"`
+}
+
+type TokenFormat struct {
+	Length   int    `xml:"length,attr"`
+	Alphabet string `xml:"alphabet,attr"`
+	Prefix   string `xml:"prefix,attr"`
+}
+
+// Janitor removes expired tokens and codes every interval, batch-size at a
+// time. Interval is a time.ParseDuration string.
+type Janitor struct {
+	Interval  string `xml:"interval,attr"`
+	BatchSize int    `xml:"batch-size,attr"`
+	Compact   bool   `xml:"compact,attr"`
+}
+
+// Registration enables dynamic client registration. When an
+// initial-access-token is set, only requests bearing it may register a
+// client. Without one registration is closed unless open is set, and clients
+// registered anonymously never get the authorization code grant. Registered
+// clients may only ask for the space separated scopes and grant-types listed
+// here.
+type Registration struct {
+	Open               bool   `xml:"open,attr"`
+	InitialAccessToken string `xml:"initial-access-token"`
+	Scopes             string `xml:"scopes"`
+	GrantTypes         string `xml:"grant-types"`
+}
+
+// Accounts configures self-registration at /account/register. With approval
+// new accounts stay pending until an administrator activates them.
+// TOTPIssuer names this service in authenticator apps, the request host when
+// empty.
+type Accounts struct {
+	Approval          bool   `xml:"approval,attr"`
+	MinPasswordLength int    `xml:"min-password-length,attr"`
+	TOTPIssuer        string `xml:"totp-issuer,attr"`
+}
+
+// Metadata adds to the authorization server metadata. ScopesSupported
+// overrides scopes_supported with space separated scopes, without it the
+// scopes granted to the registered clients are published.
+type Metadata struct {
+	ScopesSupported string `xml:"scopes-supported"`
+}
+
+// Lockout slows down password guessing. Once a username or client has
+// threshold failed checks, or an address ip-threshold, checks are refused for
+// delay, doubled with every further failure up to max-delay. Failures are
+// forgotten after window without a new one. Durations are time.ParseDuration
+// strings. Behind a reverse proxy the server's trusted-proxies must be set,
+// or every request shares the address of the proxy.
+type Lockout struct {
+	Threshold   int    `xml:"threshold,attr"`
+	IPThreshold int    `xml:"ip-threshold,attr"`
+	Delay       string `xml:"delay,attr"`
+	MaxDelay    string `xml:"max-delay,attr"`
+	Window      string `xml:"window,attr"`
+}
+
+// TokenLifetime sets how long tokens live for clients without settings of
+// their own. Refresh tokens are rotated on use, each lives refresh-token or
+// idle-timeout, whichever is shorter, and none outlives session after the
+// original grant. Empty session and idle-timeout mean no limit. Clients may
+// not set an access token lifetime above max-access-token, which also bounds
+// how long a retired signing key stays published. Durations are
+// time.ParseDuration strings.
+type TokenLifetime struct {
+	AccessToken    string `xml:"access-token,attr"`
+	MaxAccessToken string `xml:"max-access-token,attr"`
+	RefreshToken   string `xml:"refresh-token,attr"`
+	Session        string `xml:"session,attr"`
+	IdleTimeout    string `xml:"idle-timeout,attr"`
+	RefreshTokens  *bool  `xml:"refresh-tokens,attr"`
 }
@@ -0,0 +1,85 @@
+package encrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+)
+
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+func (self *Argon2idHasher) Algorithm() string {
+	return Argon2idAlgorithm
+}
+
+func (self *Argon2idHasher) Hash(password []byte) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	phc := &phcHash{
+		id:      Argon2idAlgorithm,
+		version: strconv.Itoa(argon2.Version),
+		params: map[string]string{
+			"m": strconv.FormatUint(uint64(self.Memory), 10),
+			"t": strconv.FormatUint(uint64(self.Iterations), 10),
+			"p": strconv.FormatUint(uint64(self.Parallelism), 10),
+		},
+		salt: salt,
+		hash: argon2.IDKey(password, salt, self.Iterations, self.Memory, self.Parallelism, keyLength),
+	}
+	return phc.String(), nil
+}
+
+func (self *Argon2idHasher) Verify(password []byte, encoded string) (bool, error) {
+	phc, params, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	hash := argon2.IDKey(password, phc.salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(phc.hash)))
+	return subtle.ConstantTimeCompare(hash, phc.hash) == 1, nil
+}
+
+func (self *Argon2idHasher) NeedsRehash(encoded string) bool {
+	_, params, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return *params != *self
+}
+
+func parseArgon2id(encoded string) (*phcHash, *Argon2idHasher, error) {
+	phc, err := parsePHC(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	if phc.id != Argon2idAlgorithm || phc.version != strconv.Itoa(argon2.Version) {
+		return nil, nil, errors.New("unsupported argon2 hash")
+	}
+	memory, err := phc.intParam("m")
+	if err != nil {
+		return nil, nil, err
+	}
+	iterations, err := phc.intParam("t")
+	if err != nil {
+		return nil, nil, err
+	}
+	parallelism, err := phc.intParam("p")
+	if err != nil {
+		return nil, nil, err
+	}
+	if memory < 1 || iterations < 1 || parallelism < 1 || parallelism > 255 {
+		return nil, nil, errors.New("invalid argon2 parameters")
+	}
+	return phc, &Argon2idHasher{
+		Memory:      uint32(memory),
+		Iterations:  uint32(iterations),
+		Parallelism: uint8(parallelism),
+	}, nil
+}
@@ -0,0 +1,40 @@
+package encrypt
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt refuses passwords longer than its 72 byte key
+const bcryptMaxPasswordLength = 72
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (self *BcryptHasher) Algorithm() string {
+	return BcryptAlgorithm
+}
+
+func (self *BcryptHasher) Hash(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, self.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (self *BcryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (self *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != self.Cost
+}
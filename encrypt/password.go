@@ -0,0 +1,272 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+const (
+	Argon2idAlgorithm = "argon2id"
+	BcryptAlgorithm   = "bcrypt"
+	ScryptAlgorithm   = "scrypt"
+	LegacyAlgorithm   = "md5"
+
+	saltLength = 16
+	keyLength  = 32
+)
+
+var (
+	// DefaultHasher hashes every new password, hashes made by any other
+	// hasher or with other parameters are replaced on the next successful
+	// login.
+	DefaultHasher Hasher
+
+	hashers map[string]Hasher
+
+	// the dummy hash is of DefaultHasher, remade when that is replaced
+	dummyMutex  sync.Mutex
+	dummyHasher Hasher
+	dummyHash   string
+)
+
+func init() {
+	var err error
+	DefaultHasher, err = NewHasher(&config.PasswordHash{})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hashers = map[string]Hasher{
+		Argon2idAlgorithm: &Argon2idHasher{},
+		BcryptAlgorithm:   &BcryptHasher{},
+		ScryptAlgorithm:   &ScryptHasher{},
+	}
+}
+
+// Configure replaces DefaultHasher with the one of hashConfig.
+func Configure(hashConfig *config.PasswordHash) error {
+	hasher, err := NewHasher(hashConfig)
+	if err != nil {
+		return err
+	}
+	DefaultHasher = hasher
+	return nil
+}
+
+// Hasher hashes passwords into self-describing strings: PHC strings for
+// argon2id and scrypt and the modular crypt format for bcrypt, so the stored
+// hash carries everything needed to verify it.
+type Hasher interface {
+	Algorithm() string
+	Hash(password []byte) (string, error)
+	Verify(password []byte, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+func NewHasher(hashConfig *config.PasswordHash) (Hasher, error) {
+	switch hashConfig.Algorithm {
+	case Argon2idAlgorithm, "":
+		hasher := &Argon2idHasher{Memory: 65536, Iterations: 3, Parallelism: 2}
+		if hashConfig.Argon2id != nil {
+			hasher.Memory = hashConfig.Argon2id.Memory
+			hasher.Iterations = hashConfig.Argon2id.Iterations
+			hasher.Parallelism = hashConfig.Argon2id.Parallelism
+		}
+		if hasher.Memory < 8*uint32(hasher.Parallelism) || hasher.Iterations < 1 || hasher.Parallelism < 1 {
+			return nil, errors.New("invalid password-hash config: bad argon2id parameters")
+		}
+		return hasher, nil
+	case BcryptAlgorithm:
+		hasher := &BcryptHasher{Cost: 12}
+		if hashConfig.Bcrypt != nil {
+			hasher.Cost = hashConfig.Bcrypt.Cost
+		}
+		if hasher.Cost < 10 || hasher.Cost > 31 {
+			return nil, errors.New("invalid password-hash config: bcrypt cost must be between 10 and 31")
+		}
+		return hasher, nil
+	case ScryptAlgorithm:
+		hasher := &ScryptHasher{Cost: 32768, BlockSize: 8, Parallelism: 1}
+		if hashConfig.Scrypt != nil {
+			hasher.Cost = hashConfig.Scrypt.Cost
+			hasher.BlockSize = hashConfig.Scrypt.BlockSize
+			hasher.Parallelism = hashConfig.Scrypt.Parallelism
+		}
+		if hasher.Cost < 2 || hasher.Cost&(hasher.Cost-1) != 0 || hasher.BlockSize < 1 || hasher.Parallelism < 1 {
+			return nil, errors.New("invalid password-hash config: bad scrypt parameters")
+		}
+		return hasher, nil
+	}
+	return nil, fmt.Errorf("invalid password-hash config: unknown algorithm %v", hashConfig.Algorithm)
+}
+
+// MaxPasswordLength returns the longest password in bytes HashPassword
+// takes, 0 when there is no limit.
+func MaxPasswordLength() int {
+	if DefaultHasher.Algorithm() == BcryptAlgorithm {
+		return bcryptMaxPasswordLength
+	}
+	return 0
+}
+
+func HashPassword(password []byte) ([]byte, error) {
+	encoded, err := DefaultHasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// VerifyPassword checks password against a stored hash. Hashes without an
+// algorithm prefix are the legacy salted double md5 of EncryptText1Way. When
+// the password matches, rehash tells whether the stored hash should be
+// replaced with one from HashPassword.
+func VerifyPassword(password []byte, encrypted []byte, salt []byte) (ok bool, rehash bool, err error) {
+	encoded := string(encrypted)
+	algorithm := AlgorithmOf(encoded)
+	if algorithm == LegacyAlgorithm {
+		// md5 is fast, a record not migrated yet must cost as much as an
+		// unknown name or it stands out by timing
+		VerifyDummy(password)
+		ok = subtle.ConstantTimeCompare(EncryptText1Way(password, salt), encrypted) == 1
+		return ok, ok, nil
+	}
+	hasher := hashers[algorithm]
+	if algorithm == DefaultHasher.Algorithm() {
+		hasher = DefaultHasher
+	}
+	if hasher == nil {
+		return false, false, fmt.Errorf("unknown password hash algorithm %v", algorithm)
+	}
+	ok, err = hasher.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	rehash = algorithm != DefaultHasher.Algorithm() || DefaultHasher.NeedsRehash(encoded)
+	return true, rehash, nil
+}
+
+// VerifyDummy spends the time VerifyPassword takes on a hash of the default
+// hasher, for a user or client that does not exist, so the response time
+// does not tell whether it does. The hash is of random bytes, nothing
+// matches it.
+func VerifyDummy(password []byte) {
+	hasher := DefaultHasher
+	dummyMutex.Lock()
+	if dummyHasher != hasher {
+		random := make([]byte, keyLength)
+		_, err := rand.Read(random)
+		if err == nil {
+			dummyHash, err = hasher.Hash(random)
+		}
+		if err != nil {
+			log.Printf("failed to make the dummy password hash: %v\n", err)
+		}
+		dummyHasher = hasher
+	}
+	encoded := dummyHash
+	dummyMutex.Unlock()
+	hasher.Verify(password, encoded)
+}
+
+func AlgorithmOf(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2idAlgorithm
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return ScryptAlgorithm
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return BcryptAlgorithm
+	}
+	return LegacyAlgorithm
+}
+
+// phcHash is a parsed $id[$v=version][$param=value,...]$salt$hash string.
+type phcHash struct {
+	id      string
+	version string
+	params  map[string]string
+	salt    []byte
+	hash    []byte
+}
+
+func (self *phcHash) String() string {
+	fields := []string{"", self.id}
+	if self.version != "" {
+		fields = append(fields, "v="+self.version)
+	}
+	var params []string
+	for _, key := range []string{"m", "t", "ln", "r", "p"} {
+		if value, ok := self.params[key]; ok {
+			params = append(params, key+"="+value)
+		}
+	}
+	fields = append(fields, strings.Join(params, ","))
+	fields = append(fields, base64.RawStdEncoding.EncodeToString(self.salt))
+	fields = append(fields, base64.RawStdEncoding.EncodeToString(self.hash))
+	return strings.Join(fields, "$")
+}
+
+func parsePHC(encoded string) (*phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, errors.New("malformed password hash")
+	}
+	phc := &phcHash{
+		id:     fields[1],
+		params: make(map[string]string),
+	}
+	fields = fields[2:]
+	if strings.HasPrefix(fields[0], "v=") {
+		phc.version = strings.TrimPrefix(fields[0], "v=")
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return nil, errors.New("malformed password hash")
+	}
+	for _, param := range strings.Split(fields[0], ",") {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, errors.New("malformed password hash parameters")
+		}
+		phc.params[keyValue[0]] = keyValue[1]
+	}
+	var err error
+	phc.salt, err = base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	phc.hash, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(phc.hash) == 0 {
+		return nil, errors.New("malformed password hash")
+	}
+	return phc, nil
+}
+
+func (self *phcHash) intParam(key string) (int, error) {
+	value, ok := self.params[key]
+	if !ok {
+		return 0, fmt.Errorf("password hash is missing parameter %v", key)
+	}
+	return strconv.Atoi(value)
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
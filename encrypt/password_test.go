@@ -0,0 +1,115 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+// countingHasher is a cheap argon2id hasher that counts its calls.
+type countingHasher struct {
+	Argon2idHasher
+	hashed   int
+	verified int
+}
+
+func (self *countingHasher) Hash(password []byte) (string, error) {
+	self.hashed++
+	return self.Argon2idHasher.Hash(password)
+}
+
+func (self *countingHasher) Verify(password []byte, encoded string) (bool, error) {
+	self.verified++
+	return self.Argon2idHasher.Verify(password, encoded)
+}
+
+// useCountingHasher makes a countingHasher the DefaultHasher for the test.
+func useCountingHasher(t *testing.T) *countingHasher {
+	hasher := &countingHasher{Argon2idHasher: Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}}
+	defaultHasher := DefaultHasher
+	DefaultHasher = hasher
+	t.Cleanup(func() {
+		DefaultHasher = defaultHasher
+	})
+	return hasher
+}
+
+func TestVerifyPasswordCostsOneDefaultVerify(t *testing.T) {
+	hasher := useCountingHasher(t)
+	encoded, err := HashPassword([]byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("salt")
+	legacy := EncryptText1Way([]byte("right"), salt)
+
+	for _, test := range []struct {
+		name       string
+		password   string
+		encrypted  []byte
+		salt       []byte
+		wantOK     bool
+		wantRehash bool
+	}{
+		{"default hash, right password", "right", encoded, nil, true, false},
+		{"default hash, wrong password", "wrong", encoded, nil, false, false},
+		{"legacy hash, right password", "right", legacy, salt, true, true},
+		{"legacy hash, wrong password", "wrong", legacy, salt, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hasher.verified = 0
+			ok, rehash, err := VerifyPassword([]byte(test.password), test.encrypted, test.salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.wantOK || rehash != test.wantRehash {
+				t.Errorf("got ok %v rehash %v, want ok %v rehash %v", ok, rehash, test.wantOK, test.wantRehash)
+			}
+			if hasher.verified != 1 {
+				t.Errorf("default hasher verified %v times, want 1", hasher.verified)
+			}
+		})
+	}
+}
+
+func TestVerifyDummy(t *testing.T) {
+	hasher := useCountingHasher(t)
+	VerifyDummy([]byte("a"))
+	VerifyDummy([]byte("b"))
+	if hasher.verified != 2 {
+		t.Errorf("default hasher verified %v times, want 2", hasher.verified)
+	}
+	// the dummy hash is made once per hasher
+	if hasher.hashed != 1 {
+		t.Errorf("default hasher hashed %v times, want 1", hasher.hashed)
+	}
+}
+
+func TestMaxPasswordLength(t *testing.T) {
+	defaultHasher := DefaultHasher
+	t.Cleanup(func() {
+		DefaultHasher = defaultHasher
+	})
+	for _, algorithm := range []string{Argon2idAlgorithm, BcryptAlgorithm, ScryptAlgorithm} {
+		err := Configure(&config.PasswordHash{Algorithm: algorithm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxLength := MaxPasswordLength()
+		if algorithm != BcryptAlgorithm {
+			if maxLength != 0 {
+				t.Errorf("got a limit of %v bytes for %v, want none", maxLength, algorithm)
+			}
+			continue
+		}
+		_, err = HashPassword(bytes.Repeat([]byte("a"), maxLength))
+		if err != nil {
+			t.Errorf("%v refused a password of %v bytes: %v", algorithm, maxLength, err)
+		}
+		_, err = HashPassword(bytes.Repeat([]byte("a"), maxLength+1))
+		if err == nil {
+			t.Errorf("%v took a password over %v bytes", algorithm, maxLength)
+		}
+	}
+}
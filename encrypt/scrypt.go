@@ -0,0 +1,92 @@
+package encrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+type ScryptHasher struct {
+	Cost        int
+	BlockSize   int
+	Parallelism int
+}
+
+func (self *ScryptHasher) Algorithm() string {
+	return ScryptAlgorithm
+}
+
+func (self *ScryptHasher) Hash(password []byte) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	hash, err := scrypt.Key(password, salt, self.Cost, self.BlockSize, self.Parallelism, keyLength)
+	if err != nil {
+		return "", err
+	}
+	phc := &phcHash{
+		id: ScryptAlgorithm,
+		params: map[string]string{
+			"ln": strconv.Itoa(bits.TrailingZeros(uint(self.Cost))),
+			"r":  strconv.Itoa(self.BlockSize),
+			"p":  strconv.Itoa(self.Parallelism),
+		},
+		salt: salt,
+		hash: hash,
+	}
+	return phc.String(), nil
+}
+
+func (self *ScryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	phc, params, err := parseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	hash, err := scrypt.Key(password, phc.salt, params.Cost, params.BlockSize, params.Parallelism, len(phc.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, phc.hash) == 1, nil
+}
+
+func (self *ScryptHasher) NeedsRehash(encoded string) bool {
+	_, params, err := parseScrypt(encoded)
+	if err != nil {
+		return true
+	}
+	return *params != *self
+}
+
+func parseScrypt(encoded string) (*phcHash, *ScryptHasher, error) {
+	phc, err := parsePHC(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	if phc.id != ScryptAlgorithm {
+		return nil, nil, errors.New("unsupported scrypt hash")
+	}
+	logCost, err := phc.intParam("ln")
+	if err != nil {
+		return nil, nil, err
+	}
+	blockSize, err := phc.intParam("r")
+	if err != nil {
+		return nil, nil, err
+	}
+	parallelism, err := phc.intParam("p")
+	if err != nil {
+		return nil, nil, err
+	}
+	if logCost < 1 || logCost > 30 {
+		return nil, nil, errors.New("invalid scrypt parameters")
+	}
+	return phc, &ScryptHasher{
+		Cost:        1 << uint(logCost),
+		BlockSize:   blockSize,
+		Parallelism: parallelism,
+	}, nil
+}
@@ -0,0 +1,529 @@
+package account
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/json-api"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+	"github.com/MochiKung/account-interface/handler/oauth2/totp"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath        = "/account"
+	RegisterPath      = PrefixPath + "/register"
+	TOTPPath          = PrefixPath + "/totp"
+	TOTPConfirmPath   = TOTPPath + "/confirm"
+	RecoveryCodesPath = PrefixPath + "/recovery-codes"
+
+	uidLength                = 32
+	maxUsernameLength        = 64
+	maxDisplayNameLength     = 128
+	defaultMinPasswordLength = 10
+)
+
+var ()
+
+func init() {
+}
+
+// Handler serves the account lifecycle of users:
+//
+//	POST   /account/register        create an account
+//	GET    /account                 show the account of the bearer token's user
+//	PUT    /account                 replace the profile of that account
+//	DELETE /account                 mark that account deleted
+//	POST   /account/totp            start TOTP enrollment, returns the secret
+//	POST   /account/totp/confirm    enable TOTP with a first code, returns recovery codes
+//	DELETE /account/totp            disable TOTP, needs a code
+//	POST   /account/recovery-codes  replace the recovery codes, needs a code
+//
+// Everything but registration needs a bearer access token of this server for
+// the user, with the account scope.
+type Handler struct {
+	stores            *store.Stores
+	approval          bool
+	minPasswordLength int
+	totpIssuer        string
+}
+
+type registerRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+}
+
+type profileRequest struct {
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+}
+
+type otpRequest struct {
+	OTP string `json:"otp"`
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type totpResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type accountResponse struct {
+	UID         string     `json:"uid"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email,omitempty"`
+	DisplayName string     `json:"display_name,omitempty"`
+	State       string     `json:"state"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	CreateDate  *time.Time `json:"create_date,omitempty"`
+	UpdateDate  *time.Time `json:"update_date,omitempty"`
+}
+
+func New(stores *store.Stores, accountsConfig *config.Accounts) *Handler {
+	self := &Handler{
+		stores:            stores,
+		approval:          accountsConfig.Approval,
+		minPasswordLength: accountsConfig.MinPasswordLength,
+		totpIssuer:        accountsConfig.TOTPIssuer,
+	}
+	if self.minPasswordLength <= 0 {
+		self.minPasswordLength = defaultMinPasswordLength
+	}
+	return self
+}
+
+func (self *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case RegisterPath:
+		if !allowMethod(resp, req, "POST") {
+			return
+		}
+		self.register(resp, req)
+		return
+	case PrefixPath:
+		if !allowMethod(resp, req, "GET", "PUT", "DELETE") {
+			return
+		}
+	case TOTPPath:
+		if !allowMethod(resp, req, "POST", "DELETE") {
+			return
+		}
+	case TOTPConfirmPath, RecoveryCodesPath:
+		if !allowMethod(resp, req, "POST") {
+			return
+		}
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tokenInfo, err := verify.AuthenticateBearer(self.stores.Tokens, req)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if tokenInfo == nil || tokenInfo.User == "" {
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		jsonapi.WriteError(resp, http.StatusUnauthorized, "invalid_token", "a valid bearer access token of a user is required")
+		return
+	}
+	if !verify.HasScope(tokenInfo.Scopes, oauth2.AccountScope) {
+		resp.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%v"`, oauth2.AccountScope))
+		jsonapi.WriteError(resp, http.StatusForbidden, "insufficient_scope", "the access token lacks the account scope")
+		return
+	}
+	userInfo, err := self.stores.Users.GetUserInfo(tokenInfo.User)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	// tokens are revoked when an account leaves the active state, this only
+	// catches the ones still in flight
+	if userInfo == nil || !userInfo.Active() {
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		jsonapi.WriteError(resp, http.StatusUnauthorized, "invalid_token", "the account is not active")
+		return
+	}
+
+	switch req.URL.Path + " " + req.Method {
+	case PrefixPath + " GET":
+		jsonapi.Write(resp, http.StatusOK, newAccountResponse(userInfo))
+	case PrefixPath + " PUT":
+		self.updateProfile(resp, req, userInfo)
+	case PrefixPath + " DELETE":
+		self.deleteAccount(resp, userInfo)
+	case TOTPPath + " POST":
+		self.enrollTOTP(resp, req, userInfo)
+	case TOTPPath + " DELETE":
+		self.disableTOTP(resp, req, userInfo)
+	case TOTPConfirmPath + " POST":
+		self.confirmTOTP(resp, req, userInfo)
+	case RecoveryCodesPath + " POST":
+		self.replaceRecoveryCodes(resp, req, userInfo)
+	}
+}
+
+func (self *Handler) register(resp http.ResponseWriter, req *http.Request) {
+	request := &registerRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return
+	}
+	if !validUsername(request.Username) {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("username must be 1 to %v letters, digits or ._@-", maxUsernameLength))
+		return
+	}
+	if len(request.Password) < self.minPasswordLength {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("password must have at least %v characters", self.minPasswordLength))
+		return
+	}
+	if maxLength := encrypt.MaxPasswordLength(); maxLength > 0 && len(request.Password) > maxLength {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("password must have at most %v bytes", maxLength))
+		return
+	}
+	if !validEmail(request.Email) {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", "email must be a plain email address")
+		return
+	}
+	if !validDisplayName(request.DisplayName) {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("display_name must be at most %v characters", maxDisplayNameLength))
+		return
+	}
+	encryptedPassword, err := encrypt.HashPassword([]byte(request.Password))
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	now := time.Now()
+	userInfo := &user.UserInfo{
+		UID:               stringgenerator.RandomString(uidLength),
+		Username:          request.Username,
+		EncryptedPassword: encryptedPassword,
+		State:             user.ActiveState,
+		Email:             request.Email,
+		DisplayName:       request.DisplayName,
+		CreateDate:        &now,
+		UpdateDate:        &now,
+	}
+	if self.approval {
+		userInfo.State = user.PendingState
+	}
+	err = self.stores.Users.PutUserInfo(userInfo)
+	if err != nil && err.Error() == "duplicate user" {
+		jsonapi.WriteError(resp, http.StatusConflict, "username_taken", "the username is already registered")
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("registered user %v as %v\n", userInfo.Username, userInfo.State)
+	jsonapi.Write(resp, http.StatusCreated, newAccountResponse(userInfo))
+}
+
+func (self *Handler) updateProfile(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) {
+	request := &profileRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return
+	}
+	if !validEmail(request.Email) {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", "email must be a plain email address")
+		return
+	}
+	if !validDisplayName(request.DisplayName) {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("display_name must be at most %v characters", maxDisplayNameLength))
+		return
+	}
+	now := time.Now()
+	userInfo.Email = request.Email
+	userInfo.DisplayName = request.DisplayName
+	userInfo.UpdateDate = &now
+	err := self.stores.Users.UpdateUserInfo(userInfo)
+	if err != nil && err.Error() == "user version conflict" {
+		jsonapi.WriteError(resp, http.StatusConflict, "conflict", "the account was changed concurrently, retry")
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	jsonapi.Write(resp, http.StatusOK, newAccountResponse(userInfo))
+}
+
+// deleteAccount keeps the user as deleted, so the username is not handed to
+// someone else, and revokes every token of the user.
+func (self *Handler) deleteAccount(resp http.ResponseWriter, userInfo *user.UserInfo) {
+	now := time.Now()
+	userInfo.State = user.DeletedState
+	userInfo.UpdateDate = &now
+	err := self.stores.Users.UpdateUserInfo(userInfo)
+	if err != nil && err.Error() == "user version conflict" {
+		jsonapi.WriteError(resp, http.StatusConflict, "conflict", "the account was changed concurrently, retry")
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	revoked, err := self.stores.RevokeUserTokens(userInfo.Username)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("deleted account %v and revoked %v tokens\n", userInfo.Username, revoked)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// enrollTOTP hands out a new secret, enrollment only completes once a code
+// of it is confirmed. It takes the password, so a stolen access token alone
+// cannot bind another authenticator.
+func (self *Handler) enrollTOTP(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) {
+	request := &passwordRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return
+	}
+	if userInfo.MFAEnabled() {
+		jsonapi.WriteError(resp, http.StatusConflict, "mfa_enabled", "TOTP is already enabled, disable it first")
+		return
+	}
+	if !self.verifyPassword(resp, req, userInfo, request.Password) {
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	userInfo.TOTPSecret = secret
+	userInfo.TOTPEnabled = false
+	userInfo.TOTPLastStep = 0
+	userInfo.RecoveryCodes = nil
+	if !self.updateUser(resp, userInfo) {
+		return
+	}
+	issuer := self.totpIssuer
+	if issuer == "" {
+		issuer = req.Host
+	}
+	jsonapi.Write(resp, http.StatusOK, &totpResponse{
+		Secret:          totp.EncodeSecret(secret),
+		ProvisioningURI: totp.ProvisioningURI(issuer, userInfo.Username, secret),
+	})
+}
+
+func (self *Handler) confirmTOTP(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) {
+	request := &otpRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return
+	}
+	if userInfo.MFAEnabled() {
+		jsonapi.WriteError(resp, http.StatusConflict, "mfa_enabled", "TOTP is already enabled")
+		return
+	}
+	if userInfo.TOTPSecret == nil {
+		jsonapi.WriteError(resp, http.StatusConflict, "mfa_not_enrolled", "start the enrollment first")
+		return
+	}
+	step, ok := totp.Verify(userInfo.TOTPSecret, request.OTP, time.Now(), userInfo.TOTPLastStep)
+	if !ok {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_otp", "the one-time password is invalid")
+		return
+	}
+	codes, hashes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodeCount)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	userInfo.TOTPEnabled = true
+	userInfo.TOTPLastStep = step
+	userInfo.RecoveryCodes = hashes
+	if !self.updateUser(resp, userInfo) {
+		return
+	}
+	log.Printf("enabled TOTP of user %v\n", userInfo.Username)
+	jsonapi.Write(resp, http.StatusOK, &recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (self *Handler) disableTOTP(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) {
+	if !self.verifySecondFactor(resp, req, userInfo) {
+		return
+	}
+	userInfo.TOTPSecret = nil
+	userInfo.TOTPEnabled = false
+	userInfo.TOTPLastStep = 0
+	userInfo.RecoveryCodes = nil
+	if !self.updateUser(resp, userInfo) {
+		return
+	}
+	log.Printf("disabled TOTP of user %v\n", userInfo.Username)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (self *Handler) replaceRecoveryCodes(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) {
+	if !self.verifySecondFactor(resp, req, userInfo) {
+		return
+	}
+	codes, hashes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodeCount)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	userInfo.RecoveryCodes = hashes
+	if !self.updateUser(resp, userInfo) {
+		return
+	}
+	jsonapi.Write(resp, http.StatusOK, &recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// verifySecondFactor reads the otp of the body, a stolen access token alone
+// cannot turn MFA off.
+func (self *Handler) verifySecondFactor(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo) bool {
+	request := &otpRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return false
+	}
+	if !userInfo.MFAEnabled() {
+		jsonapi.WriteError(resp, http.StatusConflict, "mfa_not_enrolled", "TOTP is not enabled")
+		return false
+	}
+	attempt, err := lockout.Default.Check(self.stores.Attempts, req, lockout.UserKey(userInfo.Username))
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.Header().Set("Retry-After", strconv.FormatInt(locked.RetryAfterSeconds(), 10))
+		jsonapi.WriteError(resp, http.StatusTooManyRequests, "too_many_attempts", fmt.Sprintf("too many failed attempts, retry after %v seconds", locked.RetryAfterSeconds()))
+		return false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+	if !verify.VerifySecondFactor(self.stores.Users, userInfo, request.OTP) {
+		attempt.Fail()
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_otp", "the one-time password is invalid")
+		return false
+	}
+	attempt.Succeed()
+	return true
+}
+
+// verifyPassword checks the password of the signed in user under the lockout,
+// writing the error response when it fails.
+func (self *Handler) verifyPassword(resp http.ResponseWriter, req *http.Request, userInfo *user.UserInfo, password string) bool {
+	attempt, err := lockout.Default.Check(self.stores.Attempts, req, lockout.UserKey(userInfo.Username))
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.Header().Set("Retry-After", strconv.FormatInt(locked.RetryAfterSeconds(), 10))
+		jsonapi.WriteError(resp, http.StatusTooManyRequests, "too_many_attempts", fmt.Sprintf("too many failed attempts, retry after %v seconds", locked.RetryAfterSeconds()))
+		return false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+	if !verify.VerifyUserPassword(self.stores.Users, userInfo, password) {
+		attempt.Fail()
+		jsonapi.WriteError(resp, http.StatusForbidden, "invalid_password", "the password is invalid")
+		return false
+	}
+	if !userInfo.Active() {
+		attempt.Release()
+		jsonapi.WriteError(resp, http.StatusUnauthorized, "invalid_token", "the account is not active")
+		return false
+	}
+	attempt.Succeed()
+	return true
+}
+
+func (self *Handler) updateUser(resp http.ResponseWriter, userInfo *user.UserInfo) bool {
+	now := time.Now()
+	userInfo.UpdateDate = &now
+	err := self.stores.Users.UpdateUserInfo(userInfo)
+	if err != nil && err.Error() == "user version conflict" {
+		jsonapi.WriteError(resp, http.StatusConflict, "conflict", "the account was changed concurrently, retry")
+		return false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func newAccountResponse(userInfo *user.UserInfo) *accountResponse {
+	return &accountResponse{
+		UID:         userInfo.UID,
+		Username:    userInfo.Username,
+		Email:       userInfo.Email,
+		DisplayName: userInfo.DisplayName,
+		State:       userInfo.State,
+		MFAEnabled:  userInfo.MFAEnabled(),
+		CreateDate:  userInfo.CreateDate,
+		UpdateDate:  userInfo.UpdateDate,
+	}
+}
+
+func allowMethod(resp http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	resp.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+func validUsername(username string) bool {
+	if username == "" || len(username) > maxUsernameLength {
+		return false
+	}
+	for _, char := range username {
+		switch {
+		case 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z', '0' <= char && char <= '9':
+		case strings.ContainsRune("._@-", char):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validEmail accepts a bare address, no display name or angle brackets.
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+func validDisplayName(displayName string) bool {
+	return len([]rune(displayName)) <= maxDisplayNameLength
+}
@@ -0,0 +1,439 @@
+package clients
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/json-api"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/client-secret"
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/token-lifetime"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath = "/admin/clients"
+)
+
+var ()
+
+func init() {
+}
+
+// Handler serves client management for the self-service portal:
+//
+//	GET    /admin/clients       list clients
+//	POST   /admin/clients       create a client
+//	GET    /admin/clients/{id}  show a client
+//	PUT    /admin/clients/{id}  replace the editable fields of a client
+//	DELETE /admin/clients/{id}  delete a client
+//
+// Every request needs a bearer access token of this server with the admin
+// scope. A client carries its version as ETag, PUT and DELETE with If-Match
+// only apply to the version the caller has seen. Deleting a client revokes
+// every token issued to it.
+type Handler struct {
+	stores *store.Stores
+}
+
+// clientRequest holds the fields a caller may set. client_id is only read
+// on create, the secret is always generated. Token lifetimes are in seconds,
+// 0 and a null refresh_tokens keep the server defaults.
+type clientRequest struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name"`
+	Description             string   `json:"description"`
+	Owner                   string   `json:"owner"`
+	Public                  bool     `json:"public"`
+	AuthorizationCodeScopes []string `json:"authorization_code_scopes"`
+	ImplicitScopes          []string `json:"implicit_scopes"`
+	PasswordScopes          []string `json:"password_scopes"`
+	ClientCredentialsScopes []string `json:"client_credentials_scopes"`
+	DefaultScopes           []string `json:"default_scopes"`
+	RedirectURI             string   `json:"redirect_uri"`
+	ImplicitRedirectURI     string   `json:"implicit_redirect_uri"`
+	AccessTokenTTL          int64    `json:"access_token_ttl"`
+	RefreshTokenTTL         int64    `json:"refresh_token_ttl"`
+	SessionLifetime         int64    `json:"session_lifetime"`
+	IdleTimeout             int64    `json:"idle_timeout"`
+	RefreshTokens           *bool    `json:"refresh_tokens"`
+}
+
+type clientResponse struct {
+	ClientID                string     `json:"client_id"`
+	ClientSecret            string     `json:"client_secret,omitempty"`
+	ClientName              string     `json:"client_name,omitempty"`
+	Description             string     `json:"description,omitempty"`
+	Owner                   string     `json:"owner,omitempty"`
+	Public                  bool       `json:"public"`
+	AuthorizationCodeScopes []string   `json:"authorization_code_scopes"`
+	ImplicitScopes          []string   `json:"implicit_scopes"`
+	PasswordScopes          []string   `json:"password_scopes"`
+	ClientCredentialsScopes []string   `json:"client_credentials_scopes"`
+	DefaultScopes           []string   `json:"default_scopes"`
+	RedirectURI             string     `json:"redirect_uri,omitempty"`
+	ImplicitRedirectURI     string     `json:"implicit_redirect_uri,omitempty"`
+	AccessTokenTTL          int64      `json:"access_token_ttl,omitempty"`
+	RefreshTokenTTL         int64      `json:"refresh_token_ttl,omitempty"`
+	SessionLifetime         int64      `json:"session_lifetime,omitempty"`
+	IdleTimeout             int64      `json:"idle_timeout,omitempty"`
+	RefreshTokens           *bool      `json:"refresh_tokens,omitempty"`
+	CreateDate              *time.Time `json:"create_date,omitempty"`
+	CreateUser              string     `json:"create_user,omitempty"`
+	CreateIP                string     `json:"create_ip,omitempty"`
+	UpdateDate              *time.Time `json:"update_date,omitempty"`
+	UpdateUser              string     `json:"update_user,omitempty"`
+	UpdateIP                string     `json:"update_ip,omitempty"`
+	Version                 int64      `json:"version"`
+}
+
+func New(stores *store.Stores) *Handler {
+	self := &Handler{stores: stores}
+	return self
+}
+
+func (self *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	tokenInfo, err := verify.AuthenticateBearer(self.stores.Tokens, req)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if tokenInfo == nil {
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		jsonapi.WriteError(resp, http.StatusUnauthorized, "invalid_token", "a valid bearer access token is required")
+		return
+	}
+	if !verify.HasScope(tokenInfo.Scopes, oauth2.AdminScope) {
+		resp.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%v"`, oauth2.AdminScope))
+		jsonapi.WriteError(resp, http.StatusForbidden, "insufficient_scope", "the access token lacks the admin scope")
+		return
+	}
+
+	clientID := strings.Trim(strings.TrimPrefix(req.URL.Path, PrefixPath), "/")
+	if clientID == "" {
+		switch req.Method {
+		case "GET":
+			self.listClients(resp)
+		case "POST":
+			self.createClient(resp, req, tokenInfo)
+		default:
+			resp.Header().Set("Allow", "GET, POST")
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch req.Method {
+	case "GET":
+		self.showClient(resp, clientID)
+	case "PUT":
+		self.updateClient(resp, req, tokenInfo, clientID)
+	case "DELETE":
+		self.deleteClient(resp, req, clientID)
+	default:
+		resp.Header().Set("Allow", "GET, PUT, DELETE")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (self *Handler) listClients(resp http.ResponseWriter) {
+	clientInfos, err := self.stores.Clients.ListClientInfo()
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	clients := []*clientResponse{}
+	for _, clientInfo := range clientInfos {
+		clients = append(clients, newClientResponse(clientInfo))
+	}
+	jsonapi.Write(resp, http.StatusOK, clients)
+}
+
+func (self *Handler) showClient(resp http.ResponseWriter, clientID string) {
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientID)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		jsonapi.WriteError(resp, http.StatusNotFound, "not_found", "client does not exist")
+		return
+	}
+	resp.Header().Set("ETag", etag(clientInfo.Version))
+	jsonapi.Write(resp, http.StatusOK, newClientResponse(clientInfo))
+}
+
+func (self *Handler) createClient(resp http.ResponseWriter, req *http.Request, tokenInfo *accesstoken.TokenInfo) {
+	request, ok := readClientRequest(resp, req)
+	if !ok {
+		return
+	}
+	if request.ClientID == "" || strings.ContainsAny(request.ClientID, "/ ") {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", "client_id must be set and contain no slash or space")
+		return
+	}
+	now := time.Now()
+	clientInfo := &client.ClientInfo{
+		ClientUsername: request.ClientID,
+		OwnerUsername:  actor(tokenInfo),
+		CreateDate:     &now,
+		CreateUser:     actor(tokenInfo),
+		CreateIP:       oauth2.RemoteIP(req),
+	}
+	request.apply(clientInfo, now, tokenInfo, req)
+	secret, err := clientsecret.Update(clientInfo)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	err = self.stores.Clients.PutClientInfo(clientInfo)
+	if err != nil && err.Error() == "duplicate client username" {
+		jsonapi.WriteError(resp, http.StatusConflict, "conflict", "client already exists")
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("%v created client %v\n", actor(tokenInfo), clientInfo.ClientUsername)
+	clientResp := newClientResponse(clientInfo)
+	clientResp.ClientSecret = secret
+	resp.Header().Set("Location", PrefixPath+"/"+url.PathEscape(clientInfo.ClientUsername))
+	resp.Header().Set("ETag", etag(clientInfo.Version))
+	jsonapi.Write(resp, http.StatusCreated, clientResp)
+}
+
+func (self *Handler) updateClient(resp http.ResponseWriter, req *http.Request, tokenInfo *accesstoken.TokenInfo, clientID string) {
+	request, ok := readClientRequest(resp, req)
+	if !ok {
+		return
+	}
+	if request.ClientID != "" && request.ClientID != clientID {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", "client_id cannot be changed")
+		return
+	}
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientID)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		jsonapi.WriteError(resp, http.StatusNotFound, "not_found", "client does not exist")
+		return
+	}
+	if !ifMatch(req, clientInfo.Version) {
+		writePreconditionFailed(resp)
+		return
+	}
+	request.apply(clientInfo, time.Now(), tokenInfo, req)
+	secret, err := clientsecret.Update(clientInfo)
+	if err == nil {
+		err = self.stores.Clients.UpdateClientInfo(clientInfo)
+	}
+	if err != nil && err.Error() == "client not exist" {
+		jsonapi.WriteError(resp, http.StatusNotFound, "not_found", "client does not exist")
+		return
+	}
+	// a write that slipped in between the read and the update
+	if err != nil && err.Error() == "client version conflict" {
+		writePreconditionFailed(resp)
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("%v updated client %v\n", actor(tokenInfo), clientInfo.ClientUsername)
+	clientResp := newClientResponse(clientInfo)
+	clientResp.ClientSecret = secret
+	resp.Header().Set("ETag", etag(clientInfo.Version))
+	jsonapi.Write(resp, http.StatusOK, clientResp)
+}
+
+func (self *Handler) deleteClient(resp http.ResponseWriter, req *http.Request, clientID string) {
+	var version int64
+	if req.Header.Get("If-Match") != "" {
+		clientInfo, err := self.stores.Clients.GetClientInfo(clientID)
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if clientInfo == nil {
+			jsonapi.WriteError(resp, http.StatusNotFound, "not_found", "client does not exist")
+			return
+		}
+		if !ifMatch(req, clientInfo.Version) {
+			writePreconditionFailed(resp)
+			return
+		}
+		version = clientInfo.Version
+	}
+	revoked, err := self.stores.DeleteClient(clientID, version)
+	if err != nil && err.Error() == "client not exist" {
+		jsonapi.WriteError(resp, http.StatusNotFound, "not_found", "client does not exist")
+		return
+	}
+	if err != nil && err.Error() == "client version conflict" {
+		writePreconditionFailed(resp)
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("deleted client %v and revoked %v tokens\n", clientID, revoked)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func readClientRequest(resp http.ResponseWriter, req *http.Request) (*clientRequest, bool) {
+	request := &clientRequest{}
+	if !jsonapi.Read(resp, req, request) {
+		return nil, false
+	}
+	for _, redirectURI := range []string{request.RedirectURI, request.ImplicitRedirectURI} {
+		if redirectURI == "" {
+			continue
+		}
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_redirect_uri", "redirect URIs must be absolute and without fragment")
+			return nil, false
+		}
+	}
+	for _, scopes := range [][]string{request.AuthorizationCodeScopes, request.ImplicitScopes, request.PasswordScopes, request.ClientCredentialsScopes, request.DefaultScopes} {
+		for _, scope := range scopes {
+			if scope == "" || strings.ContainsAny(scope, ", ") {
+				jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_scope", "scopes must be non-empty and contain no comma or space")
+				return nil, false
+			}
+		}
+	}
+	lifetimes := &client.ClientInfo{}
+	request.applyLifetimes(lifetimes)
+	err := tokenlifetime.Default.CheckClient(lifetimes)
+	if err != nil {
+		jsonapi.WriteError(resp, http.StatusBadRequest, "invalid_request", err.Error())
+		return nil, false
+	}
+	return request, true
+}
+
+// apply copies the editable fields onto clientInfo and stamps the update
+// audit fields.
+func (self *clientRequest) apply(clientInfo *client.ClientInfo, now time.Time, tokenInfo *accesstoken.TokenInfo, req *http.Request) {
+	clientInfo.ClientName = self.ClientName
+	clientInfo.Description = self.Description
+	if self.Owner != "" {
+		clientInfo.OwnerUsername = self.Owner
+	}
+	clientInfo.PublicClient = self.Public
+	clientInfo.GrantAuthorizationCode = scopeSet(self.AuthorizationCodeScopes)
+	clientInfo.GrantImplicit = scopeSet(self.ImplicitScopes)
+	clientInfo.GrantResourceOwner = scopeSet(self.PasswordScopes)
+	clientInfo.GrantClientCredentials = scopeSet(self.ClientCredentialsScopes)
+	clientInfo.DefaultScopes = scopeSet(self.DefaultScopes)
+	clientInfo.RedirectURIAuthorCode = self.RedirectURI
+	clientInfo.RedirectURIImplicit = self.ImplicitRedirectURI
+	self.applyLifetimes(clientInfo)
+	clientInfo.UpdateDate = &now
+	clientInfo.UpdateUser = actor(tokenInfo)
+	clientInfo.UpdateIP = oauth2.RemoteIP(req)
+}
+
+func (self *clientRequest) applyLifetimes(clientInfo *client.ClientInfo) {
+	clientInfo.AccessTokenTTL = self.AccessTokenTTL
+	clientInfo.RefreshTokenTTL = self.RefreshTokenTTL
+	clientInfo.SessionLifetime = self.SessionLifetime
+	clientInfo.IdleTimeout = self.IdleTimeout
+	clientInfo.IssueRefreshTokens = self.RefreshTokens
+}
+
+func newClientResponse(clientInfo *client.ClientInfo) *clientResponse {
+	return &clientResponse{
+		ClientID:                clientInfo.ClientUsername,
+		ClientName:              clientInfo.ClientName,
+		Description:             clientInfo.Description,
+		Owner:                   clientInfo.OwnerUsername,
+		Public:                  clientInfo.PublicClient,
+		AuthorizationCodeScopes: database.SortedScopes(clientInfo.GrantAuthorizationCode),
+		ImplicitScopes:          database.SortedScopes(clientInfo.GrantImplicit),
+		PasswordScopes:          database.SortedScopes(clientInfo.GrantResourceOwner),
+		ClientCredentialsScopes: database.SortedScopes(clientInfo.GrantClientCredentials),
+		DefaultScopes:           database.SortedScopes(clientInfo.DefaultScopes),
+		RedirectURI:             clientInfo.RedirectURIAuthorCode,
+		ImplicitRedirectURI:     clientInfo.RedirectURIImplicit,
+		AccessTokenTTL:          clientInfo.AccessTokenTTL,
+		RefreshTokenTTL:         clientInfo.RefreshTokenTTL,
+		SessionLifetime:         clientInfo.SessionLifetime,
+		IdleTimeout:             clientInfo.IdleTimeout,
+		RefreshTokens:           clientInfo.IssueRefreshTokens,
+		CreateDate:              clientInfo.CreateDate,
+		CreateUser:              clientInfo.CreateUser,
+		CreateIP:                clientInfo.CreateIP,
+		UpdateDate:              clientInfo.UpdateDate,
+		UpdateUser:              clientInfo.UpdateUser,
+		UpdateIP:                clientInfo.UpdateIP,
+		Version:                 clientInfo.Version,
+	}
+}
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatch tells whether the If-Match header of the request, if any, names
+// version. Entity tags compare strongly, so weak tags never match.
+func ifMatch(req *http.Request, version int64) bool {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeSet(scopes []string) map[string]bool {
+	if len(scopes) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, scope := range scopes {
+		set[scope] = true
+	}
+	return set
+}
+
+// actor names the caller for the audit fields, the resource owner of the
+// token or the client itself for client credentials tokens.
+func actor(tokenInfo *accesstoken.TokenInfo) string {
+	if tokenInfo.User != "" {
+		return tokenInfo.User
+	}
+	return "client:" + tokenInfo.Client
+}
+
+func writePreconditionFailed(resp http.ResponseWriter) {
+	jsonapi.WriteError(resp, http.StatusPreconditionFailed, "precondition_failed", "client was changed since it was read")
+}
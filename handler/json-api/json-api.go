@@ -0,0 +1,49 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const (
+	maxBodySize = 64 * 1024
+)
+
+type errorResponse struct {
+	ErrorTag         string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Read decodes the request body into value, refusing unknown fields and
+// bodies over 64 KiB. On failure it answers 400 and returns false.
+func Read(resp http.ResponseWriter, req *http.Request, value interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(resp, req.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		WriteError(resp, http.StatusBadRequest, "invalid_request", fmt.Sprintf("malformed request: %v", err))
+		return false
+	}
+	return true
+}
+
+// Write answers with value as json, never to be cached.
+func Write(resp http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
+
+// WriteError answers with an error object shaped like those of RFC 6749.
+func WriteError(resp http.ResponseWriter, status int, errorTag string, description string) {
+	Write(resp, status, &errorResponse{ErrorTag: errorTag, ErrorDescription: description})
+}
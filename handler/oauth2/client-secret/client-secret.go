@@ -0,0 +1,38 @@
+package clientsecret
+
+import (
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+)
+
+const (
+	secretLength = 43
+)
+
+// New stores the hash of a fresh secret in clientInfo and returns the secret,
+// which is never stored in the clear.
+func New(clientInfo *client.ClientInfo) (string, error) {
+	secret := stringgenerator.RandomString(secretLength)
+	encryptedPassword, err := encrypt.HashPassword([]byte(secret))
+	if err != nil {
+		return "", err
+	}
+	clientInfo.EncryptedPassword = encryptedPassword
+	clientInfo.Salt = nil
+	return secret, nil
+}
+
+// Update drops the secret of a public client and gives a confidential client
+// that has none a new one. It returns the new secret, if any.
+func Update(clientInfo *client.ClientInfo) (string, error) {
+	if clientInfo.PublicClient {
+		clientInfo.EncryptedPassword = nil
+		clientInfo.Salt = nil
+		return "", nil
+	}
+	if len(clientInfo.EncryptedPassword) != 0 {
+		return "", nil
+	}
+	return New(clientInfo)
+}
@@ -2,74 +2,118 @@ package accesstoken
 
 import (
 	"errors"
-	"github.com/MochiKung/account-interface/config"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
 )
 
 const ()
 
-var (
-	db *bolt.DB
-)
+var ()
 
 func init() {
-	var err error
-	db, err = bolt.Open(config.Default.Database.BoltDB.AccessTokenDB, 0600, nil)
+}
+
+type BoltStore struct {
+	db *database.BoltFile
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := database.OpenBoltFile(fileName)
 	if err != nil {
-		panic("fail to open database for access-token")
+		return nil, fmt.Errorf("fail to open database for access-token: %v", err)
 	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
+}
+
+func (self *BoltStore) Compact() (before int64, after int64, err error) {
+	return self.db.Compact()
 }
 
 type TokenInfo struct {
-	Token      string
-	Client     string
-	User       string
-	Scopes     string
-	ExpireTime *time.Time
+	Token         string
+	Client        string
+	User          string
+	Scopes        string
+	RefreshFamily string
+	IssueTime     *time.Time
+	ExpireTime    *time.Time
 }
 
-func GetTokenInfo(token string, client string) (*TokenInfo, error) {
+func (self *BoltStore) GetTokenInfo(token string, client string) (*TokenInfo, error) {
 	var tokenInfo *TokenInfo = nil
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := self.db.View(func(tx *bolt.Tx) error {
 		clientBucket := tx.Bucket([]byte(client))
 		if clientBucket != nil {
-			tokenBucket := clientBucket.Bucket([]byte(token))
-			if tokenBucket != nil {
-				tokenInfo = &TokenInfo{
-					Token:  token,
-					Client: client,
-					User:   queryString(tokenBucket, "user"),
-					Scopes: queryString(tokenBucket, "scopes"),
-				}
+			var err error
+			tokenInfo, err = readTokenInfo(clientBucket, token, client)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
+
+// FindTokenInfo looks the token up in every client, for callers that only
+// have the token itself.
+func (self *BoltStore) FindTokenInfo(token string) (*TokenInfo, error) {
+	var tokenInfo *TokenInfo = nil
+
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(client []byte, clientBucket *bolt.Bucket) error {
+			if tokenInfo != nil {
+				return nil
+			}
+			var err error
+			tokenInfo, err = readTokenInfo(clientBucket, token, string(client))
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
 
-				expireTime := &time.Time{}
-				timeBinary := tokenBucket.Get([]byte("expire-time"))
-				err := expireTime.UnmarshalBinary(timeBinary)
+func (self *BoltStore) ListTokenInfo() ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(client []byte, clientBucket *bolt.Bucket) error {
+			return clientBucket.ForEach(func(token []byte, _ []byte) error {
+				tokenInfo, err := readTokenInfo(clientBucket, string(token), string(client))
 				if err != nil {
 					return err
 				}
-				tokenInfo.ExpireTime = expireTime
-			}
-		}
-		return nil
+				tokenInfos = append(tokenInfos, tokenInfo)
+				return nil
+			})
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
-	return tokenInfo, nil
+	return tokenInfos, nil
 }
 
-func PutTokenInfo(tokenInfo *TokenInfo) error {
-	oldTokenInfo, err := GetTokenInfo(tokenInfo.Token, tokenInfo.Client)
+func (self *BoltStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	oldTokenInfo, err := self.GetTokenInfo(tokenInfo.Token, tokenInfo.Client)
 	if err != nil {
 		return err
 	}
 	if oldTokenInfo != nil {
 		return errors.New("duplicate token")
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = self.db.Update(func(tx *bolt.Tx) error {
 		var clientBucket *bolt.Bucket
 		clientBucket = tx.Bucket([]byte(tokenInfo.Client))
 		if clientBucket == nil {
@@ -86,6 +130,16 @@ func PutTokenInfo(tokenInfo *TokenInfo) error {
 		tokenBucket.Put([]byte("client"), []byte(tokenInfo.Client))
 		tokenBucket.Put([]byte("user"), []byte(tokenInfo.User))
 		tokenBucket.Put([]byte("scopes"), []byte(tokenInfo.Scopes))
+		if tokenInfo.RefreshFamily != "" {
+			tokenBucket.Put([]byte("refresh-family"), []byte(tokenInfo.RefreshFamily))
+		}
+		if tokenInfo.IssueTime != nil {
+			issueBinary, err := tokenInfo.IssueTime.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			tokenBucket.Put([]byte("issue-time"), issueBinary)
+		}
 		expireBinary, err := tokenInfo.ExpireTime.MarshalBinary()
 		if err != nil {
 			return err
@@ -96,6 +150,151 @@ func PutTokenInfo(tokenInfo *TokenInfo) error {
 	return err
 }
 
+func (self *BoltStore) DeleteTokenInfo(token string, client string) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		clientBucket := tx.Bucket([]byte(client))
+		if clientBucket == nil || clientBucket.Bucket([]byte(token)) == nil {
+			return nil
+		}
+		return clientBucket.DeleteBucket([]byte(token))
+	})
+}
+
+// RevokeClient drops the bucket of the client with every token in it.
+func (self *BoltStore) RevokeClient(client string) ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		clientBucket := tx.Bucket([]byte(client))
+		if clientBucket == nil {
+			return nil
+		}
+		err := clientBucket.ForEach(func(token []byte, _ []byte) error {
+			tokenInfo, err := readTokenInfo(clientBucket, string(token), client)
+			if err != nil {
+				return err
+			}
+			tokenInfos = append(tokenInfos, tokenInfo)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(client))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+// RevokeUser has no index to go by and reads every token, in a single
+// transaction with the deletes.
+func (self *BoltStore) RevokeUser(user string) ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(client []byte, clientBucket *bolt.Bucket) error {
+			return clientBucket.ForEach(func(token []byte, _ []byte) error {
+				if queryString(clientBucket.Bucket(token), "user") != user {
+					return nil
+				}
+				tokenInfo, err := readTokenInfo(clientBucket, string(token), string(client))
+				if err != nil {
+					return err
+				}
+				tokenInfos = append(tokenInfos, tokenInfo)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, tokenInfo := range tokenInfos {
+			err = tx.Bucket([]byte(tokenInfo.Client)).DeleteBucket([]byte(tokenInfo.Token))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+// DeleteExpired deletes at most limit tokens that expired before now and
+// returns how many it deleted.
+func (self *BoltStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	deleted := 0
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		expired := make(map[string][]string)
+		count := 0
+		err := tx.ForEach(func(client []byte, clientBucket *bolt.Bucket) error {
+			return clientBucket.ForEach(func(token []byte, _ []byte) error {
+				if count >= limit {
+					return nil
+				}
+				tokenInfo, err := readTokenInfo(clientBucket, string(token), string(client))
+				if err != nil {
+					return err
+				}
+				if tokenInfo != nil && tokenInfo.ExpireTime.Before(now) {
+					expired[string(client)] = append(expired[string(client)], string(token))
+					count++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for client, tokens := range expired {
+			clientBucket := tx.Bucket([]byte(client))
+			for _, token := range tokens {
+				err = clientBucket.DeleteBucket([]byte(token))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		deleted = count
+		return nil
+	})
+	return deleted, err
+}
+
+func readTokenInfo(clientBucket *bolt.Bucket, token string, client string) (*TokenInfo, error) {
+	tokenBucket := clientBucket.Bucket([]byte(token))
+	if tokenBucket == nil {
+		return nil, nil
+	}
+	tokenInfo := &TokenInfo{
+		Token:         token,
+		Client:        client,
+		User:          queryString(tokenBucket, "user"),
+		Scopes:        queryString(tokenBucket, "scopes"),
+		RefreshFamily: queryString(tokenBucket, "refresh-family"),
+	}
+
+	if timeBinary := tokenBucket.Get([]byte("issue-time")); timeBinary != nil {
+		issueTime := &time.Time{}
+		err := issueTime.UnmarshalBinary(timeBinary)
+		if err != nil {
+			return nil, err
+		}
+		tokenInfo.IssueTime = issueTime
+	}
+
+	expireTime := &time.Time{}
+	timeBinary := tokenBucket.Get([]byte("expire-time"))
+	err := expireTime.UnmarshalBinary(timeBinary)
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo.ExpireTime = expireTime
+	return tokenInfo, nil
+}
+
 func queryString(bucket *bolt.Bucket, key string) string {
 	value := bucket.Get([]byte(key))
 	if value == nil {
@@ -0,0 +1,137 @@
+package accesstoken
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps access tokens in process memory, grouped by client like
+// the bolt buckets. Expired tokens stay until they are deleted, callers check
+// ExpireTime exactly as they do with BoltStore.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	clients map[string]map[string]*TokenInfo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{clients: make(map[string]map[string]*TokenInfo)}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetTokenInfo(token string, client string) (*TokenInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	tokenInfo := self.clients[client][token]
+	if tokenInfo == nil {
+		return nil, nil
+	}
+	return copyTokenInfo(tokenInfo), nil
+}
+
+func (self *MemoryStore) FindTokenInfo(token string) (*TokenInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for _, tokens := range self.clients {
+		if tokenInfo := tokens[token]; tokenInfo != nil {
+			return copyTokenInfo(tokenInfo), nil
+		}
+	}
+	return nil, nil
+}
+
+func (self *MemoryStore) ListTokenInfo() ([]*TokenInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	var tokenInfos []*TokenInfo
+	for _, tokens := range self.clients {
+		for _, tokenInfo := range tokens {
+			tokenInfos = append(tokenInfos, copyTokenInfo(tokenInfo))
+		}
+	}
+	return tokenInfos, nil
+}
+
+func (self *MemoryStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	tokens := self.clients[tokenInfo.Client]
+	if tokens == nil {
+		tokens = make(map[string]*TokenInfo)
+		self.clients[tokenInfo.Client] = tokens
+	}
+	if tokens[tokenInfo.Token] != nil {
+		return errors.New("duplicate token")
+	}
+	tokens[tokenInfo.Token] = copyTokenInfo(tokenInfo)
+	return nil
+}
+
+func (self *MemoryStore) DeleteTokenInfo(token string, client string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.clients[client], token)
+	return nil
+}
+
+func (self *MemoryStore) RevokeClient(client string) ([]*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var tokenInfos []*TokenInfo
+	for _, tokenInfo := range self.clients[client] {
+		tokenInfos = append(tokenInfos, tokenInfo)
+	}
+	delete(self.clients, client)
+	return tokenInfos, nil
+}
+
+func (self *MemoryStore) RevokeUser(user string) ([]*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var tokenInfos []*TokenInfo
+	for _, tokens := range self.clients {
+		for token, tokenInfo := range tokens {
+			if tokenInfo.User == user {
+				tokenInfos = append(tokenInfos, tokenInfo)
+				delete(tokens, token)
+			}
+		}
+	}
+	return tokenInfos, nil
+}
+
+func (self *MemoryStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	deleted := 0
+	for _, tokens := range self.clients {
+		for token, tokenInfo := range tokens {
+			if deleted >= limit {
+				return deleted, nil
+			}
+			if tokenInfo.ExpireTime.Before(now) {
+				delete(tokens, token)
+				deleted++
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func copyTokenInfo(tokenInfo *TokenInfo) *TokenInfo {
+	tokenCopy := *tokenInfo
+	tokenCopy.IssueTime = copyTime(tokenInfo.IssueTime)
+	tokenCopy.ExpireTime = copyTime(tokenInfo.ExpireTime)
+	return &tokenCopy
+}
+
+func copyTime(value *time.Time) *time.Time {
+	if value == nil {
+		return nil
+	}
+	timeCopy := *value
+	return &timeCopy
+}
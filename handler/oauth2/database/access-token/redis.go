@@ -0,0 +1,220 @@
+package accesstoken
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database/redis"
+)
+
+// RedisStore keeps every access token under its own key with a TTL matching
+// ExpireTime, so redis drops tokens by itself. Sorted sets per client and per
+// user, scored by expire time, index the tokens for bulk revocation. The
+// index expiry uses PEXPIRE NX and GT, which need redis 7.0 or later.
+type RedisStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+func NewRedisStore(client *redis.Client, keyPrefix string) *RedisStore {
+	return &RedisStore{client: client, keyPrefix: keyPrefix}
+}
+
+func (self *RedisStore) Close() error {
+	return self.client.Close()
+}
+
+func (self *RedisStore) GetTokenInfo(token string, client string) (*TokenInfo, error) {
+	tokenInfo, err := self.FindTokenInfo(token)
+	if err != nil || tokenInfo == nil {
+		return nil, err
+	}
+	if tokenInfo.Client != client {
+		return nil, nil
+	}
+	return tokenInfo, nil
+}
+
+func (self *RedisStore) FindTokenInfo(token string) (*TokenInfo, error) {
+	data, err := redis.Bytes(self.client.Do("GET", self.tokenKey(token)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo := &TokenInfo{}
+	err = json.Unmarshal(data, tokenInfo)
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
+
+// ListTokenInfo walks the token keys with SCAN, which is fine for the admin
+// command but too slow for anything on the request path.
+func (self *RedisStore) ListTokenInfo() ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	cursor := "0"
+	for {
+		reply, err := self.client.Do("SCAN", cursor, "MATCH", self.tokenKey("*"), "COUNT", 1000)
+		if err != nil {
+			return nil, err
+		}
+		scan, ok := reply.([]interface{})
+		if !ok || len(scan) != 2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		next, err := redis.Bytes(scan[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(scan[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			tokenInfo, err := self.FindTokenInfo(strings.TrimPrefix(key, self.tokenKey("")))
+			if err != nil {
+				return nil, err
+			}
+			// expired between SCAN and GET
+			if tokenInfo != nil {
+				tokenInfos = append(tokenInfos, tokenInfo)
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return tokenInfos, nil
+		}
+	}
+}
+
+func (self *RedisStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	data, err := json.Marshal(tokenInfo)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(*tokenInfo.ExpireTime).Milliseconds()
+	if ttl < 1 {
+		// already expired, redis rejects a zero ttl
+		ttl = 1
+	}
+	reply, err := self.client.Do("SET", self.tokenKey(tokenInfo.Token), data, "PX", ttl, "NX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errors.New("duplicate token")
+	}
+
+	expireScore := strconv.FormatInt(tokenInfo.ExpireTime.UnixMilli(), 10)
+	nowScore := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	var commands [][]interface{}
+	for _, indexKey := range self.indexKeys(tokenInfo) {
+		commands = append(commands,
+			[]interface{}{"ZADD", indexKey, expireScore, tokenInfo.Token},
+			[]interface{}{"ZREMRANGEBYSCORE", indexKey, "-inf", "(" + nowScore},
+			[]interface{}{"PEXPIRE", indexKey, ttl, "NX"},
+			[]interface{}{"PEXPIRE", indexKey, ttl, "GT"},
+		)
+	}
+	_, err = self.client.Transaction(commands)
+	return err
+}
+
+func (self *RedisStore) DeleteTokenInfo(token string, client string) error {
+	tokenInfo, err := self.GetTokenInfo(token, client)
+	if err != nil || tokenInfo == nil {
+		return err
+	}
+	return self.deleteTokenInfos([]*TokenInfo{tokenInfo})
+}
+
+// DeleteExpired has nothing to do, redis drops tokens when their TTL runs
+// out and PutTokenInfo trims the indexes.
+func (self *RedisStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	return 0, nil
+}
+
+// RevokeClient revokes every access token issued to the client.
+func (self *RedisStore) RevokeClient(client string) ([]*TokenInfo, error) {
+	return self.deleteIndexed(self.clientKey(client))
+}
+
+// RevokeUser revokes every access token issued for the user, whatever the
+// client.
+func (self *RedisStore) RevokeUser(user string) ([]*TokenInfo, error) {
+	return self.deleteIndexed(self.userKey(user))
+}
+
+// deleteIndexed deletes the tokens in the index and removes them from it. A
+// token added meanwhile stays indexed for the next revocation.
+func (self *RedisStore) deleteIndexed(indexKey string) ([]*TokenInfo, error) {
+	tokens, err := redis.Strings(self.client.Do("ZRANGE", indexKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var tokenInfos []*TokenInfo
+	var expired []interface{}
+	for _, token := range tokens {
+		tokenInfo, err := self.FindTokenInfo(token)
+		if err != nil {
+			return nil, err
+		}
+		if tokenInfo != nil {
+			tokenInfos = append(tokenInfos, tokenInfo)
+		} else {
+			expired = append(expired, token)
+		}
+	}
+	err = self.deleteTokenInfos(tokenInfos)
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) != 0 {
+		_, err = self.client.Do(append([]interface{}{"ZREM", indexKey}, expired...)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tokenInfos, nil
+}
+
+func (self *RedisStore) deleteTokenInfos(tokenInfos []*TokenInfo) error {
+	if len(tokenInfos) == 0 {
+		return nil
+	}
+	var commands [][]interface{}
+	for _, tokenInfo := range tokenInfos {
+		commands = append(commands, []interface{}{"DEL", self.tokenKey(tokenInfo.Token)})
+		for _, indexKey := range self.indexKeys(tokenInfo) {
+			commands = append(commands, []interface{}{"ZREM", indexKey, tokenInfo.Token})
+		}
+	}
+	_, err := self.client.Transaction(commands)
+	return err
+}
+
+func (self *RedisStore) tokenKey(token string) string {
+	return self.keyPrefix + "access-token:" + token
+}
+
+func (self *RedisStore) clientKey(client string) string {
+	return self.keyPrefix + "access-token-client:" + client
+}
+
+func (self *RedisStore) userKey(user string) string {
+	return self.keyPrefix + "access-token-user:" + user
+}
+
+func (self *RedisStore) indexKeys(tokenInfo *TokenInfo) []string {
+	indexKeys := []string{self.clientKey(tokenInfo.Client)}
+	if tokenInfo.User != "" {
+		indexKeys = append(indexKeys, self.userKey(tokenInfo.User))
+	}
+	return indexKeys
+}
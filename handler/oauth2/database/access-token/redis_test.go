@@ -0,0 +1,391 @@
+package accesstoken
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database/redis"
+)
+
+// fakeRedis serves the commands RedisStore uses over RESP, with keys that
+// expire like they do on a real server.
+type fakeRedis struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	strings  map[string][]byte
+	zsets    map[string]map[string]float64
+	expires  map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &fakeRedis{
+		listener: listener,
+		strings:  make(map[string][]byte),
+		zsets:    make(map[string]map[string]float64),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go self.serve(netConn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return self
+}
+
+func (self *fakeRedis) serve(netConn net.Conn) {
+	defer netConn.Close()
+	reader := bufio.NewReader(netConn)
+	var queued [][]string
+	multi := false
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch command := strings.ToUpper(args[0]); {
+		case command == "MULTI":
+			multi, queued, reply = true, nil, "+OK\r\n"
+		case command == "EXEC":
+			reply = fmt.Sprintf("*%v\r\n", len(queued))
+			for _, queuedArgs := range queued {
+				reply += self.do(queuedArgs)
+			}
+			multi, queued = false, nil
+		case multi:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = self.do(args)
+		}
+		_, err = io.WriteString(netConn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	var count int
+	_, err := fmt.Fscanf(reader, "*%d\r\n", &count)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		var size int
+		_, err = fmt.Fscanf(reader, "$%d\r\n", &size)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func (self *fakeRedis) do(args []string) string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := time.Now()
+	for key, expireTime := range self.expires {
+		if !expireTime.After(now) {
+			self.delete(key)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := self.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(string(value))
+	case "SET":
+		// SET key value PX ttl NX
+		if self.exists(args[1]) {
+			return "$-1\r\n"
+		}
+		ttl, _ := strconv.ParseInt(args[4], 10, 64)
+		self.strings[args[1]] = []byte(args[2])
+		self.expires[args[1]] = now.Add(time.Duration(ttl) * time.Millisecond)
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if self.exists(key) {
+				self.delete(key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%v\r\n", deleted)
+	case "PEXPIRE":
+		// PEXPIRE key ttl NX|GT, a key without ttl never has a greater one
+		if !self.exists(args[1]) {
+			return ":0\r\n"
+		}
+		ttl, _ := strconv.ParseInt(args[2], 10, 64)
+		expireTime := now.Add(time.Duration(ttl) * time.Millisecond)
+		current, hasTTL := self.expires[args[1]]
+		if args[3] == "NX" && hasTTL || args[3] == "GT" && (!hasTTL || !expireTime.After(current)) {
+			return ":0\r\n"
+		}
+		self.expires[args[1]] = expireTime
+		return ":1\r\n"
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		if self.zsets[args[1]] == nil {
+			self.zsets[args[1]] = make(map[string]float64)
+		}
+		self.zsets[args[1]][args[3]] = score
+		return ":1\r\n"
+	case "ZREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if _, ok := self.zsets[args[1]][member]; ok {
+				delete(self.zsets[args[1]], member)
+				removed++
+			}
+		}
+		self.dropEmpty(args[1])
+		return fmt.Sprintf(":%v\r\n", removed)
+	case "ZREMRANGEBYSCORE":
+		// only the "-inf" "(max" form the store sends
+		max, _ := strconv.ParseFloat(strings.TrimPrefix(args[3], "("), 64)
+		removed := 0
+		for member, score := range self.zsets[args[1]] {
+			if score < max {
+				delete(self.zsets[args[1]], member)
+				removed++
+			}
+		}
+		self.dropEmpty(args[1])
+		return fmt.Sprintf(":%v\r\n", removed)
+	case "ZRANGE":
+		// the whole set, 0 -1
+		members := make([]string, 0, len(self.zsets[args[1]]))
+		for member := range self.zsets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return self.zsets[args[1]][members[i]] < self.zsets[args[1]][members[j]]
+		})
+		reply := fmt.Sprintf("*%v\r\n", len(members))
+		for _, member := range members {
+			reply += bulk(member)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (self *fakeRedis) exists(key string) bool {
+	_, isString := self.strings[key]
+	_, isZSet := self.zsets[key]
+	return isString || isZSet
+}
+
+func (self *fakeRedis) delete(key string) {
+	delete(self.strings, key)
+	delete(self.zsets, key)
+	delete(self.expires, key)
+}
+
+// dropEmpty deletes an empty sorted set, redis does not keep them.
+func (self *fakeRedis) dropEmpty(key string) {
+	if set, ok := self.zsets[key]; ok && len(set) == 0 {
+		self.delete(key)
+	}
+}
+
+// ttl returns how long key has left, -1 without a ttl and -2 when it does
+// not exist.
+func (self *fakeRedis) ttl(key string) time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.exists(key) {
+		return -2
+	}
+	expireTime, ok := self.expires[key]
+	if !ok {
+		return -1
+	}
+	return time.Until(expireTime)
+}
+
+func (self *fakeRedis) members(key string) []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var members []string
+	for member := range self.zsets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%v\r\n%v\r\n", len(value), value)
+}
+
+func openFakeRedisStore(t *testing.T) (*RedisStore, *fakeRedis) {
+	fake := startFakeRedis(t)
+	client, err := redis.Dial(fake.listener.Addr().String(), "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := NewRedisStore(client, "test:")
+	t.Cleanup(func() {
+		self.Close()
+	})
+	return self, fake
+}
+
+func putToken(t *testing.T, self *RedisStore, token string, client string, user string, ttl time.Duration) {
+	expireTime := time.Now().Add(ttl)
+	err := self.PutTokenInfo(&TokenInfo{Token: token, Client: client, User: user, ExpireTime: &expireTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tokenNames(tokenInfos []*TokenInfo) []string {
+	var tokens []string
+	for _, tokenInfo := range tokenInfos {
+		tokens = append(tokens, tokenInfo.Token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func assertTTL(t *testing.T, fake *fakeRedis, key string, want time.Duration) {
+	t.Helper()
+	if got := fake.ttl(key); got > want || got < want-time.Minute {
+		t.Errorf("ttl of %v is %v, want about %v", key, got, want)
+	}
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	self, fake := openFakeRedisStore(t)
+	putToken(t, self, "a", "app", "alice", time.Hour)
+	assertTTL(t, fake, "test:access-token:a", time.Hour)
+	assertTTL(t, fake, "test:access-token-client:app", time.Hour)
+	assertTTL(t, fake, "test:access-token-user:alice", time.Hour)
+
+	// an index lives as long as its longest token
+	putToken(t, self, "b", "app", "", 2*time.Hour)
+	putToken(t, self, "c", "app", "", 30*time.Minute)
+	assertTTL(t, fake, "test:access-token:c", 30*time.Minute)
+	assertTTL(t, fake, "test:access-token-client:app", 2*time.Hour)
+	assertTTL(t, fake, "test:access-token-user:alice", time.Hour)
+	if got := fake.ttl("test:access-token-user:"); got != -2 {
+		t.Errorf("tokens without user are indexed under the empty user")
+	}
+
+	// expired tokens drop out and the next put trims them from the index
+	putToken(t, self, "expired", "app", "", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	tokenInfo, err := self.FindTokenInfo("expired")
+	if err != nil || tokenInfo != nil {
+		t.Errorf("got %v, %v for an expired token", tokenInfo, err)
+	}
+	putToken(t, self, "d", "app", "", time.Hour)
+	if got := fake.members("test:access-token-client:app"); strings.Join(got, " ") != "a b c d" {
+		t.Errorf("client index holds %v", got)
+	}
+}
+
+func TestRedisStoreRevoke(t *testing.T) {
+	self, fake := openFakeRedisStore(t)
+	putToken(t, self, "a1", "app", "alice", time.Hour)
+	putToken(t, self, "a2", "app", "bob", time.Hour)
+	putToken(t, self, "o1", "other", "alice", time.Hour)
+	putToken(t, self, "o2", "other", "", time.Hour)
+
+	tokenInfos, err := self.RevokeUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokenNames(tokenInfos); strings.Join(got, " ") != "a1 o1" {
+		t.Errorf("revoked %v for alice", got)
+	}
+	for _, test := range []struct {
+		token string
+		want  bool
+	}{{"a1", false}, {"a2", true}, {"o1", false}, {"o2", true}} {
+		tokenInfo, err := self.FindTokenInfo(test.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (tokenInfo != nil) != test.want {
+			t.Errorf("token %v exists %v, want %v", test.token, tokenInfo != nil, test.want)
+		}
+	}
+	// the other indexes lose the revoked tokens too
+	if got := fake.members("test:access-token-client:app"); strings.Join(got, " ") != "a2" {
+		t.Errorf("client index holds %v", got)
+	}
+	if got := fake.ttl("test:access-token-user:alice"); got != -2 {
+		t.Errorf("user index left behind")
+	}
+
+	tokenInfos, err = self.RevokeClient("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokenNames(tokenInfos); strings.Join(got, " ") != "o2" {
+		t.Errorf("revoked %v for other", got)
+	}
+	if got := fake.ttl("test:access-token-client:other"); got != -2 {
+		t.Errorf("client index left behind")
+	}
+	tokenInfos, err = self.RevokeClient("other")
+	if err != nil || len(tokenInfos) != 0 {
+		t.Errorf("got %v, %v revoking again", tokenInfos, err)
+	}
+}
+
+func TestRedisStoreRevokeSkipsExpired(t *testing.T) {
+	self, fake := openFakeRedisStore(t)
+	putToken(t, self, "live", "app", "", time.Hour)
+	putToken(t, self, "expired", "app", "", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if got := fake.members("test:access-token-client:app"); strings.Join(got, " ") != "expired live" {
+		t.Fatalf("client index holds %v", got)
+	}
+
+	tokenInfos, err := self.RevokeClient("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokenNames(tokenInfos); strings.Join(got, " ") != "live" {
+		t.Errorf("revoked %v", got)
+	}
+	if got := fake.members("test:access-token-client:app"); len(got) != 0 {
+		t.Errorf("client index holds %v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package accesstoken
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	tokenColumns = "token, client, username, scopes, refresh_family, issue_time, expire_time"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetTokenInfo(token string, client string) (*TokenInfo, error) {
+	row := self.db.QueryRow("SELECT "+tokenColumns+" FROM access_tokens WHERE client = ? AND token = ?", client, token)
+	return noTokenInfo(scanTokenInfo(row))
+}
+
+func (self *SQLStore) FindTokenInfo(token string) (*TokenInfo, error) {
+	row := self.db.QueryRow("SELECT "+tokenColumns+" FROM access_tokens WHERE token = ? LIMIT 1", token)
+	return noTokenInfo(scanTokenInfo(row))
+}
+
+func (self *SQLStore) ListTokenInfo() ([]*TokenInfo, error) {
+	rows, err := self.db.Query("SELECT " + tokenColumns + " FROM access_tokens ORDER BY client, token")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokenInfos []*TokenInfo
+	for rows.Next() {
+		tokenInfo, err := scanTokenInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokenInfos = append(tokenInfos, tokenInfo)
+	}
+	return tokenInfos, rows.Err()
+}
+
+func (self *SQLStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	result, err := self.db.Exec("INSERT INTO access_tokens ("+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		tokenInfo.Token,
+		tokenInfo.Client,
+		tokenInfo.User,
+		tokenInfo.Scopes,
+		tokenInfo.RefreshFamily,
+		database.TimeToSQL(tokenInfo.IssueTime),
+		database.TimeToSQL(tokenInfo.ExpireTime),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("duplicate token")
+	}
+	return nil
+}
+
+func (self *SQLStore) DeleteTokenInfo(token string, client string) error {
+	_, err := self.db.Exec("DELETE FROM access_tokens WHERE client = ? AND token = ?", client, token)
+	return err
+}
+
+func (self *SQLStore) RevokeClient(client string) ([]*TokenInfo, error) {
+	return self.deleteWhere("client", client)
+}
+
+func (self *SQLStore) RevokeUser(user string) ([]*TokenInfo, error) {
+	return self.deleteWhere("username", user)
+}
+
+// deleteWhere deletes the tokens whose indexed column has value and returns
+// them as they were.
+func (self *SQLStore) deleteWhere(column string, value string) ([]*TokenInfo, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(self.db.Rebind("SELECT "+tokenColumns+" FROM access_tokens WHERE "+column+" = ?"), value)
+	if err != nil {
+		return nil, err
+	}
+	var tokenInfos []*TokenInfo
+	for rows.Next() {
+		tokenInfo, err := scanTokenInfo(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tokenInfos = append(tokenInfos, tokenInfo)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(self.db.Rebind("DELETE FROM access_tokens WHERE "+column+" = ?"), value)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+func (self *SQLStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	result, err := self.db.Exec("DELETE FROM access_tokens WHERE (client, token) IN (SELECT client, token FROM access_tokens WHERE expire_time < ? LIMIT ?)", now.UnixNano(), limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// noTokenInfo turns sql.ErrNoRows into a nil token, like the other stores
+// report a missing one.
+func noTokenInfo(tokenInfo *TokenInfo, err error) (*TokenInfo, error) {
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return tokenInfo, err
+}
+
+func scanTokenInfo(row interface {
+	Scan(dest ...interface{}) error
+}) (*TokenInfo, error) {
+	tokenInfo := &TokenInfo{}
+	var issueTime, expireTime sql.NullInt64
+	err := row.Scan(
+		&tokenInfo.Token,
+		&tokenInfo.Client,
+		&tokenInfo.User,
+		&tokenInfo.Scopes,
+		&tokenInfo.RefreshFamily,
+		&issueTime,
+		&expireTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo.IssueTime = database.SQLToTime(issueTime)
+	tokenInfo.ExpireTime = database.SQLToTime(expireTime)
+	return tokenInfo, nil
+}
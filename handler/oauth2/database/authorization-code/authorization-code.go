@@ -0,0 +1,186 @@
+package authorizationcode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const ()
+
+var ()
+
+func init() {
+}
+
+type BoltStore struct {
+	db *database.BoltFile
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := database.OpenBoltFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open database for authorization-code: %v", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
+}
+
+func (self *BoltStore) Compact() (before int64, after int64, err error) {
+	return self.db.Compact()
+}
+
+type CodeInfo struct {
+	Code                string
+	Client              string
+	User                string
+	RedirectURI         string
+	Scopes              string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpireTime          *time.Time
+}
+
+func (self *BoltStore) GetCodeInfo(code string) (*CodeInfo, error) {
+	var codeInfo *CodeInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		var err error
+		codeInfo, err = readCodeInfo(tx, code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codeInfo, nil
+}
+
+func (self *BoltStore) PutCodeInfo(codeInfo *CodeInfo) error {
+	oldCodeInfo, err := self.GetCodeInfo(codeInfo.Code)
+	if err != nil {
+		return err
+	}
+	if oldCodeInfo != nil {
+		return errors.New("duplicate code")
+	}
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		codeBucket, err := tx.CreateBucket([]byte(codeInfo.Code))
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "code", codeInfo.Code)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "client", codeInfo.Client)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "user", codeInfo.User)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "redirect-uri", codeInfo.RedirectURI)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "scopes", codeInfo.Scopes)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "code-challenge", codeInfo.CodeChallenge)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "code-challenge-method", codeInfo.CodeChallengeMethod)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(codeBucket, "expire-time", codeInfo.ExpireTime)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
+// TakeCodeInfo reads and deletes the code in the same transaction, so a code
+// can only ever be redeemed once.
+func (self *BoltStore) TakeCodeInfo(code string) (*CodeInfo, error) {
+	var codeInfo *CodeInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		codeInfo, err = readCodeInfo(tx, code)
+		if err != nil || codeInfo == nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(code))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codeInfo, nil
+}
+
+// DeleteExpired deletes at most limit codes that expired before now and
+// returns how many it deleted.
+func (self *BoltStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	deleted := 0
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var expired []string
+		err := tx.ForEach(func(code []byte, _ *bolt.Bucket) error {
+			if len(expired) >= limit {
+				return nil
+			}
+			codeInfo, err := readCodeInfo(tx, string(code))
+			if err != nil {
+				return err
+			}
+			if codeInfo != nil && codeInfo.ExpireTime.Before(now) {
+				expired = append(expired, string(code))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, code := range expired {
+			err = tx.DeleteBucket([]byte(code))
+			if err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+func readCodeInfo(tx *bolt.Tx, code string) (*CodeInfo, error) {
+	codeBucket := tx.Bucket([]byte(code))
+	if codeBucket == nil {
+		return nil, nil
+	}
+	codeInfo := &CodeInfo{
+		Code:                code,
+		Client:              string(codeBucket.Get([]byte("client"))),
+		User:                string(codeBucket.Get([]byte("user"))),
+		RedirectURI:         string(codeBucket.Get([]byte("redirect-uri"))),
+		Scopes:              string(codeBucket.Get([]byte("scopes"))),
+		CodeChallenge:       string(codeBucket.Get([]byte("code-challenge"))),
+		CodeChallengeMethod: string(codeBucket.Get([]byte("code-challenge-method"))),
+	}
+	expireTime := &time.Time{}
+	err := expireTime.UnmarshalBinary(codeBucket.Get([]byte("expire-time")))
+	if err != nil {
+		return nil, err
+	}
+	codeInfo.ExpireTime = expireTime
+	return codeInfo, nil
+}
@@ -0,0 +1,74 @@
+package authorizationcode
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps authorization codes in process memory.
+type MemoryStore struct {
+	mutex sync.Mutex
+	codes map[string]*CodeInfo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{codes: make(map[string]*CodeInfo)}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetCodeInfo(code string) (*CodeInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	codeInfo := self.codes[code]
+	if codeInfo == nil {
+		return nil, nil
+	}
+	return copyCodeInfo(codeInfo), nil
+}
+
+func (self *MemoryStore) PutCodeInfo(codeInfo *CodeInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.codes[codeInfo.Code] != nil {
+		return errors.New("duplicate code")
+	}
+	self.codes[codeInfo.Code] = copyCodeInfo(codeInfo)
+	return nil
+}
+
+func (self *MemoryStore) TakeCodeInfo(code string) (*CodeInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	codeInfo := self.codes[code]
+	delete(self.codes, code)
+	return codeInfo, nil
+}
+
+func (self *MemoryStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	deleted := 0
+	for code, codeInfo := range self.codes {
+		if deleted >= limit {
+			break
+		}
+		if codeInfo.ExpireTime.Before(now) {
+			delete(self.codes, code)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func copyCodeInfo(codeInfo *CodeInfo) *CodeInfo {
+	codeCopy := *codeInfo
+	if codeInfo.ExpireTime != nil {
+		expireTime := *codeInfo.ExpireTime
+		codeCopy.ExpireTime = &expireTime
+	}
+	return &codeCopy
+}
@@ -0,0 +1,104 @@
+package authorizationcode
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	codeColumns = "code, client, username, redirect_uri, scopes, code_challenge, code_challenge_method, expire_time"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetCodeInfo(code string) (*CodeInfo, error) {
+	codeInfo := &CodeInfo{}
+	var expireTime sql.NullInt64
+	err := self.db.QueryRow("SELECT "+codeColumns+" FROM authorization_codes WHERE code = ?", code).Scan(
+		&codeInfo.Code,
+		&codeInfo.Client,
+		&codeInfo.User,
+		&codeInfo.RedirectURI,
+		&codeInfo.Scopes,
+		&codeInfo.CodeChallenge,
+		&codeInfo.CodeChallengeMethod,
+		&expireTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	codeInfo.ExpireTime = database.SQLToTime(expireTime)
+	return codeInfo, nil
+}
+
+func (self *SQLStore) PutCodeInfo(codeInfo *CodeInfo) error {
+	result, err := self.db.Exec("INSERT INTO authorization_codes ("+codeColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		codeInfo.Code,
+		codeInfo.Client,
+		codeInfo.User,
+		codeInfo.RedirectURI,
+		codeInfo.Scopes,
+		codeInfo.CodeChallenge,
+		codeInfo.CodeChallengeMethod,
+		database.TimeToSQL(codeInfo.ExpireTime),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("duplicate code")
+	}
+	return nil
+}
+
+// TakeCodeInfo only returns the code to the caller whose delete removed it,
+// so a code is redeemed once even across instances.
+func (self *SQLStore) TakeCodeInfo(code string) (*CodeInfo, error) {
+	codeInfo, err := self.GetCodeInfo(code)
+	if err != nil || codeInfo == nil {
+		return nil, err
+	}
+	result, err := self.db.Exec("DELETE FROM authorization_codes WHERE code = ?", code)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, nil
+	}
+	return codeInfo, nil
+}
+
+func (self *SQLStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	result, err := self.db.Exec("DELETE FROM authorization_codes WHERE code IN (SELECT code FROM authorization_codes WHERE expire_time < ? LIMIT ?)", now.UnixNano(), limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// BoltOptions stops bolt.Open from waiting forever on the file lock, for
+	// example when the admin command runs next to the server.
+	BoltOptions = &bolt.Options{Timeout: 2 * time.Second}
+)
+
+// BoltFile is a bolt database that can be compacted while the server runs.
+// Transactions hold a read lock, Compact takes the write lock while it swaps
+// the file.
+type BoltFile struct {
+	mutex    sync.RWMutex
+	db       *bolt.DB
+	fileName string
+}
+
+func OpenBoltFile(fileName string) (*BoltFile, error) {
+	db, err := bolt.Open(fileName, 0600, BoltOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltFile{db: db, fileName: fileName}, nil
+}
+
+func (self *BoltFile) View(fn func(*bolt.Tx) error) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.db.View(fn)
+}
+
+func (self *BoltFile) Update(fn func(*bolt.Tx) error) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.db.Update(fn)
+}
+
+func (self *BoltFile) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.db.Close()
+}
+
+// Compact rewrites the database into a new file and replaces the old one
+// with it. Bolt never shrinks its file, pages freed by deletes are only
+// reused, so this is the only way to give the space back. The new file is
+// opened and checked before it takes the place of the old one, on any failure
+// the old database stays in use.
+func (self *BoltFile) Compact() (before int64, after int64, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	compactName := self.fileName + ".compact"
+	os.Remove(compactName)
+	compactDB, err := bolt.Open(compactName, 0600, BoltOptions)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = self.db.View(func(tx *bolt.Tx) error {
+		before = tx.Size()
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return compactDB.Update(func(compactTx *bolt.Tx) error {
+				compactBucket, err := compactTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(bucket, compactBucket)
+			})
+		})
+	})
+	if err == nil {
+		err = compactDB.View(func(tx *bolt.Tx) error {
+			after = tx.Size()
+			return nil
+		})
+	}
+	compactDB.Close()
+	if err != nil {
+		os.Remove(compactName)
+		return 0, 0, err
+	}
+
+	db, err := openChecked(compactName)
+	if err != nil {
+		os.Remove(compactName)
+		return 0, 0, fmt.Errorf("fail to open %v after compaction: %v", compactName, err)
+	}
+	// the open handles follow their files, the old one keeps reading the
+	// replaced file until it is closed
+	err = os.Rename(compactName, self.fileName)
+	if err != nil {
+		db.Close()
+		os.Remove(compactName)
+		return 0, 0, fmt.Errorf("fail to replace %v: %v", self.fileName, err)
+	}
+	err = self.db.Close()
+	self.db = db
+	if err != nil {
+		return 0, 0, fmt.Errorf("fail to close %v before compaction: %v", self.fileName, err)
+	}
+	return before, after, nil
+}
+
+// openChecked opens a database and checks its consistency.
+func openChecked(fileName string) (*bolt.DB, error) {
+	db, err := bolt.Open(fileName, 0600, BoltOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		var firstErr error
+		// the check only ends once every error was received
+		for err := range tx.Check() {
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func copyBucket(bucket *bolt.Bucket, compactBucket *bolt.Bucket) error {
+	compactBucket.FillPercent = 1.0
+	return bucket.ForEach(func(key []byte, value []byte) error {
+		if value != nil {
+			return compactBucket.Put(key, value)
+		}
+		nestedBucket, err := compactBucket.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return copyBucket(bucket.Bucket(key), nestedBucket)
+	})
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// fillBoltFile writes count buckets with a nested bucket each, then deletes
+// every bucket but the first keep so the file has pages to give back.
+func fillBoltFile(t *testing.T, boltFile *BoltFile, count int, keep int) {
+	err := boltFile.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < count; i++ {
+			bucket, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket-%04d", i)))
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte("value"), []byte(fmt.Sprintf("value-%04d", i)))
+			if err != nil {
+				return err
+			}
+			nested, err := bucket.CreateBucket([]byte("nested"))
+			if err != nil {
+				return err
+			}
+			err = nested.Put([]byte("padding"), make([]byte, 1024))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = boltFile.Update(func(tx *bolt.Tx) error {
+		for i := keep; i < count; i++ {
+			err := tx.DeleteBucket([]byte(fmt.Sprintf("bucket-%04d", i)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkBoltFile reads back the buckets fillBoltFile kept.
+func checkBoltFile(t *testing.T, boltFile *BoltFile, keep int) {
+	t.Helper()
+	err := boltFile.View(func(tx *bolt.Tx) error {
+		found := 0
+		err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			want := "value-" + string(name[len("bucket-"):])
+			if value := string(bucket.Get([]byte("value"))); value != want {
+				return fmt.Errorf("got %q in %s, want %q", value, name, want)
+			}
+			nested := bucket.Bucket([]byte("nested"))
+			if nested == nil || len(nested.Get([]byte("padding"))) != 1024 {
+				return fmt.Errorf("lost the nested bucket of %s", name)
+			}
+			found++
+			return nil
+		})
+		if err == nil && found != keep {
+			err = fmt.Errorf("got %v buckets, want %v", found, keep)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "compact.db")
+	boltFile, err := OpenBoltFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillBoltFile(t, boltFile, 500, 10)
+
+	before, after, err := boltFile.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Errorf("compacted %v bytes into %v, want fewer", before, after)
+	}
+	if _, err := os.Stat(fileName + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("the compact file was left behind: %v", err)
+	}
+	checkBoltFile(t, boltFile, 10)
+
+	// the compacted file is the one in use and the one found on disk
+	err = boltFile.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("bucket-0009"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = boltFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltFile, err = OpenBoltFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltFile.Close()
+	checkBoltFile(t, boltFile, 9)
+}
+
+func TestCompactFailureKeepsDatabase(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "compact.db")
+	boltFile, err := OpenBoltFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltFile.Close()
+	fillBoltFile(t, boltFile, 20, 10)
+
+	// a directory in the way of the compact file makes the compaction fail
+	err = os.MkdirAll(filepath.Join(fileName+".compact", "in-the-way"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = boltFile.Compact()
+	if err == nil {
+		t.Fatal("compacted into a directory")
+	}
+	checkBoltFile(t, boltFile, 10)
+	err = boltFile.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("bucket-0009"))
+	})
+	if err != nil {
+		t.Fatalf("database unusable after a failed compaction: %v", err)
+	}
+}
@@ -2,25 +2,34 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"time"
 
-	"github.com/MochiKung/account-interface/config"
 	"github.com/MochiKung/account-interface/handler/oauth2/database"
 )
 
 const ()
 
-var (
-	db *bolt.DB
-)
+var ()
 
 func init() {
-	var err error
-	db, err = bolt.Open(config.Default.Database.BoltDB.ClientDB, 0600, nil)
+}
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := bolt.Open(fileName, 0600, database.BoltOptions)
 	if err != nil {
-		panic("fail to open database for access-token")
+		return nil, fmt.Errorf("fail to open database for client: %v", err)
 	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
 }
 
 type ClientInfo struct {
@@ -35,6 +44,7 @@ type ClientInfo struct {
 	RedirectURIImplicit    string
 	ClientName             string
 	Description            string
+	PublicClient           bool
 	Salt                   []byte
 	CreateDate             *time.Time
 	UpdateDate             *time.Time
@@ -42,146 +52,340 @@ type ClientInfo struct {
 	UpdateUser             string
 	CreateIP               string
 	UpdateIP               string
+	// RegistrationTokenHash is the sha-256 of the registration access token
+	// of a dynamically registered client, nil for other clients
+	RegistrationTokenHash []byte
+	// AccessTokenTTL, RefreshTokenTTL, SessionLifetime and IdleTimeout are in
+	// seconds, 0 keeps the server default of the token-lifetime config
+	AccessTokenTTL  int64
+	RefreshTokenTTL int64
+	SessionLifetime int64
+	IdleTimeout     int64
+	// IssueRefreshTokens overrides whether the client gets refresh tokens,
+	// nil keeps the server default
+	IssueRefreshTokens *bool
+	// DefaultScopes are granted when a request names no scope, as far as the
+	// grant allows them
+	DefaultScopes map[string]bool
+	// Version counts the writes to the client, an update or delete only
+	// succeeds at the version the caller read
+	Version int64
 }
 
-func GetClientInfo(username string) (*ClientInfo, error) {
+func (self *BoltStore) GetClientInfo(username string) (*ClientInfo, error) {
 	var clientInfo *ClientInfo
-	err := db.View(func(tx *bolt.Tx) error {
+	err := self.db.View(func(tx *bolt.Tx) error {
 		clientBucket := tx.Bucket([]byte(username))
 		if clientBucket == nil {
 			return nil
 		}
-		clientInfo = &ClientInfo{}
-		clientInfo.ClientUsername = string(clientBucket.Get([]byte("client_username")))
-		clientInfo.EncryptedPassword = clientBucket.Get([]byte("client_password"))
-		clientInfo.OwnerUsername = string(clientBucket.Get([]byte("owner_username")))
-		clientInfo.GrantAuthorizationCode = getGrantScopes(clientBucket, "authorization_code")
-		clientInfo.GrantImplicit = getGrantScopes(clientBucket, "implicit")
-		clientInfo.GrantResourceOwner = getGrantScopes(clientBucket, "resource_owner_credential")
-		clientInfo.GrantClientCredentials = getGrantScopes(clientBucket, "client_credential")
-		clientInfo.RedirectURIAuthorCode = string(clientBucket.Get([]byte("redirect_uri_author_code")))
-		clientInfo.RedirectURIImplicit = string(clientBucket.Get([]byte("redirect_uri_implicit")))
-		clientInfo.ClientName = string(clientBucket.Get([]byte("client_name")))
-		clientInfo.Description = string(clientBucket.Get([]byte("description")))
-		clientInfo.Salt = clientBucket.Get([]byte("salt"))
-		if dataBinary := clientBucket.Get([]byte("create_date")); dataBinary != nil {
-			createDate := &time.Time{}
-			err := createDate.UnmarshalBinary(dataBinary)
-			if err != nil {
-				return err
-			}
-			clientInfo.CreateDate = createDate
-		}
-		if dataBinary := clientBucket.Get([]byte("update_date")); dataBinary != nil {
-			updateDate := &time.Time{}
-			err := updateDate.UnmarshalBinary(dataBinary)
+		var err error
+		clientInfo, err = readClientInfo(clientBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return clientInfo, nil
+}
+
+func (self *BoltStore) ListClientInfo() ([]*ClientInfo, error) {
+	var clientInfos []*ClientInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, clientBucket *bolt.Bucket) error {
+			clientInfo, err := readClientInfo(clientBucket)
 			if err != nil {
 				return err
 			}
-			clientInfo.UpdateDate = updateDate
-		}
-		clientInfo.CreateUser = string(clientBucket.Get([]byte("create_user")))
-		clientInfo.UpdateUser = string(clientBucket.Get([]byte("update_user")))
-		clientInfo.CreateIP = string(clientBucket.Get([]byte("create_ip")))
-		clientInfo.UpdateIP = string(clientBucket.Get([]byte("update_ip")))
-		return nil
+			clientInfos = append(clientInfos, clientInfo)
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return clientInfo, nil
+	return clientInfos, nil
 }
 
-func PutClientInfo(clientInfo *ClientInfo) error {
-	oldClientInfo, err := GetClientInfo(clientInfo.ClientUsername)
+func (self *BoltStore) PutClientInfo(clientInfo *ClientInfo) error {
+	oldClientInfo, err := self.GetClientInfo(clientInfo.ClientUsername)
 	if err != nil && err.Error() != "client not exist" {
 		return err
 	}
 	if oldClientInfo != nil {
 		return errors.New("duplicate client username")
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = self.db.Update(func(tx *bolt.Tx) error {
 		clientBucket, err := tx.CreateBucket([]byte(clientInfo.ClientUsername))
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "client_username", clientInfo.ClientUsername)
-		if err != nil {
-			return err
-		}
-		err = database.AddKeyValue(clientBucket, "client_password", clientInfo.EncryptedPassword)
-		if err != nil {
-			return err
-		}
-		err = database.AddKeyValue(clientBucket, "owner_username", clientInfo.OwnerUsername)
-		if err != nil {
-			return err
-		}
-		err = database.AddKeyValue(clientBucket, "authorization_code", clientInfo.GrantAuthorizationCode)
-		if err != nil {
-			return err
-		}
-		err = database.AddKeyValue(clientBucket, "implicit", clientInfo.GrantImplicit)
-		if err != nil {
-			return err
-		}
-		err = database.AddKeyValue(clientBucket, "resource_owner_credential", clientInfo.GrantResourceOwner)
+		return writeClientInfo(clientBucket, clientInfo, 1)
+	})
+	if err != nil {
+		return err
+	}
+	clientInfo.Version = 1
+	return nil
+}
+
+// UpdateClientInfo replaces every field of an existing client that is still
+// at clientInfo.Version and moves clientInfo to the new version.
+func (self *BoltStore) UpdateClientInfo(clientInfo *ClientInfo) error {
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		err := checkVersion(tx, clientInfo.ClientUsername, clientInfo.Version)
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "client_credential", clientInfo.GrantClientCredentials)
+		err = tx.DeleteBucket([]byte(clientInfo.ClientUsername))
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "redirect_uri_author_code", clientInfo.RedirectURIAuthorCode)
+		clientBucket, err := tx.CreateBucket([]byte(clientInfo.ClientUsername))
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "redirect_uri_implicit", clientInfo.RedirectURIImplicit)
-		if err != nil {
-			return err
+		return writeClientInfo(clientBucket, clientInfo, clientInfo.Version+1)
+	})
+	if err != nil {
+		return err
+	}
+	clientInfo.Version++
+	return nil
+}
+
+// DeleteClientInfo deletes the client if it is still at version, version 0
+// deletes it at any version.
+func (self *BoltStore) DeleteClientInfo(username string, version int64) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		if version == 0 && tx.Bucket([]byte(username)) == nil {
+			return errors.New("client not exist")
 		}
-		err = database.AddKeyValue(clientBucket, "client_name", clientInfo.ClientName)
-		if err != nil {
-			return err
+		if version != 0 {
+			err := checkVersion(tx, username, version)
+			if err != nil {
+				return err
+			}
 		}
-		err = database.AddKeyValue(clientBucket, "description", clientInfo.Description)
-		if err != nil {
-			return err
+		return tx.DeleteBucket([]byte(username))
+	})
+}
+
+func (self *BoltStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		clientBucket := tx.Bucket([]byte(username))
+		if clientBucket == nil {
+			return errors.New("client not exist")
 		}
-		err = database.AddKeyValue(clientBucket, "salt", clientInfo.Salt)
+		err := clientBucket.Put([]byte("client_password"), encryptedPassword)
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "create_date", clientInfo.CreateDate)
+		version, err := database.GetInt64(clientBucket, "version")
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "update_date", clientInfo.UpdateDate)
+		err = database.AddKeyValue(clientBucket, "version", version+1)
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(clientBucket, "create_user", clientInfo.CreateUser)
-		if err != nil {
-			return err
+		if salt == nil {
+			return clientBucket.Delete([]byte("salt"))
 		}
-		err = database.AddKeyValue(clientBucket, "update_user", clientInfo.UpdateUser)
+		return clientBucket.Put([]byte("salt"), salt)
+	})
+}
+
+func checkVersion(tx *bolt.Tx, username string, version int64) error {
+	clientBucket := tx.Bucket([]byte(username))
+	if clientBucket == nil {
+		return errors.New("client not exist")
+	}
+	storedVersion, err := database.GetInt64(clientBucket, "version")
+	if err != nil {
+		return err
+	}
+	if storedVersion != version {
+		return errors.New("client version conflict")
+	}
+	return nil
+}
+
+func writeClientInfo(clientBucket *bolt.Bucket, clientInfo *ClientInfo, version int64) error {
+	err := database.AddKeyValue(clientBucket, "client_username", clientInfo.ClientUsername)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "client_password", clientInfo.EncryptedPassword)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "owner_username", clientInfo.OwnerUsername)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "authorization_code", clientInfo.GrantAuthorizationCode)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "implicit", clientInfo.GrantImplicit)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "resource_owner_credential", clientInfo.GrantResourceOwner)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "client_credential", clientInfo.GrantClientCredentials)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "default_scopes", clientInfo.DefaultScopes)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "redirect_uri_author_code", clientInfo.RedirectURIAuthorCode)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "redirect_uri_implicit", clientInfo.RedirectURIImplicit)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "client_name", clientInfo.ClientName)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "description", clientInfo.Description)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "public_client", clientInfo.PublicClient)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "salt", clientInfo.Salt)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "create_date", clientInfo.CreateDate)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "update_date", clientInfo.UpdateDate)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "create_user", clientInfo.CreateUser)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "update_user", clientInfo.UpdateUser)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "create_ip", clientInfo.CreateIP)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "update_ip", clientInfo.UpdateIP)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "registration_token_hash", clientInfo.RegistrationTokenHash)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "access_token_ttl", clientInfo.AccessTokenTTL)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "refresh_token_ttl", clientInfo.RefreshTokenTTL)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "session_lifetime", clientInfo.SessionLifetime)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "idle_timeout", clientInfo.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "issue_refresh_tokens", clientInfo.IssueRefreshTokens)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(clientBucket, "version", version)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func readClientInfo(clientBucket *bolt.Bucket) (*ClientInfo, error) {
+	clientInfo := &ClientInfo{}
+	clientInfo.ClientUsername = string(clientBucket.Get([]byte("client_username")))
+	clientInfo.EncryptedPassword = database.GetBytes(clientBucket, "client_password")
+	clientInfo.OwnerUsername = string(clientBucket.Get([]byte("owner_username")))
+	clientInfo.GrantAuthorizationCode = getGrantScopes(clientBucket, "authorization_code")
+	clientInfo.GrantImplicit = getGrantScopes(clientBucket, "implicit")
+	clientInfo.GrantResourceOwner = getGrantScopes(clientBucket, "resource_owner_credential")
+	clientInfo.GrantClientCredentials = getGrantScopes(clientBucket, "client_credential")
+	clientInfo.DefaultScopes = getGrantScopes(clientBucket, "default_scopes")
+	clientInfo.RedirectURIAuthorCode = string(clientBucket.Get([]byte("redirect_uri_author_code")))
+	clientInfo.RedirectURIImplicit = string(clientBucket.Get([]byte("redirect_uri_implicit")))
+	clientInfo.ClientName = string(clientBucket.Get([]byte("client_name")))
+	clientInfo.Description = string(clientBucket.Get([]byte("description")))
+	clientInfo.PublicClient = string(clientBucket.Get([]byte("public_client"))) == "true"
+	clientInfo.Salt = database.GetBytes(clientBucket, "salt")
+	if dataBinary := clientBucket.Get([]byte("create_date")); dataBinary != nil {
+		createDate := &time.Time{}
+		err := createDate.UnmarshalBinary(dataBinary)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = database.AddKeyValue(clientBucket, "create_ip", clientInfo.CreateIP)
+		clientInfo.CreateDate = createDate
+	}
+	if dataBinary := clientBucket.Get([]byte("update_date")); dataBinary != nil {
+		updateDate := &time.Time{}
+		err := updateDate.UnmarshalBinary(dataBinary)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = database.AddKeyValue(clientBucket, "update_ip", clientInfo.UpdateIP)
+		clientInfo.UpdateDate = updateDate
+	}
+	clientInfo.CreateUser = string(clientBucket.Get([]byte("create_user")))
+	clientInfo.UpdateUser = string(clientBucket.Get([]byte("update_user")))
+	clientInfo.CreateIP = string(clientBucket.Get([]byte("create_ip")))
+	clientInfo.UpdateIP = string(clientBucket.Get([]byte("update_ip")))
+	clientInfo.RegistrationTokenHash = database.GetBytes(clientBucket, "registration_token_hash")
+	for _, value := range []struct {
+		key string
+		to  *int64
+	}{
+		{"access_token_ttl", &clientInfo.AccessTokenTTL},
+		{"refresh_token_ttl", &clientInfo.RefreshTokenTTL},
+		{"session_lifetime", &clientInfo.SessionLifetime},
+		{"idle_timeout", &clientInfo.IdleTimeout},
+	} {
+		var err error
+		*value.to, err = database.GetInt64(clientBucket, value.key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return nil
-	})
-	return err
+	}
+	clientInfo.IssueRefreshTokens = database.GetBool(clientBucket, "issue_refresh_tokens")
+	version, err := database.GetInt64(clientBucket, "version")
+	if err != nil {
+		return nil, err
+	}
+	clientInfo.Version = version
+	return clientInfo, nil
 }
+
 func getGrantScopes(bucket *bolt.Bucket, grant string) map[string]bool {
 	scopesByte := bucket.Get([]byte(grant))
 	if scopesByte == nil {
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps clients in process memory. Everything is lost when the
+// process exits, so it only suits tests and throwaway deployments.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	clients map[string]*ClientInfo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{clients: make(map[string]*ClientInfo)}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetClientInfo(username string) (*ClientInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	clientInfo := self.clients[username]
+	if clientInfo == nil {
+		return nil, nil
+	}
+	return copyClientInfo(clientInfo), nil
+}
+
+func (self *MemoryStore) ListClientInfo() ([]*ClientInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	var clientInfos []*ClientInfo
+	for _, clientInfo := range self.clients {
+		clientInfos = append(clientInfos, copyClientInfo(clientInfo))
+	}
+	// same order as the bolt buckets
+	sort.Slice(clientInfos, func(i, j int) bool {
+		return clientInfos[i].ClientUsername < clientInfos[j].ClientUsername
+	})
+	return clientInfos, nil
+}
+
+func (self *MemoryStore) PutClientInfo(clientInfo *ClientInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.clients[clientInfo.ClientUsername] != nil {
+		return errors.New("duplicate client username")
+	}
+	clientInfo.Version = 1
+	self.clients[clientInfo.ClientUsername] = copyClientInfo(clientInfo)
+	return nil
+}
+
+func (self *MemoryStore) UpdateClientInfo(clientInfo *ClientInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	err := self.checkVersion(clientInfo.ClientUsername, clientInfo.Version)
+	if err != nil {
+		return err
+	}
+	clientInfo.Version++
+	self.clients[clientInfo.ClientUsername] = copyClientInfo(clientInfo)
+	return nil
+}
+
+func (self *MemoryStore) DeleteClientInfo(username string, version int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.clients[username] == nil {
+		return errors.New("client not exist")
+	}
+	if version != 0 {
+		err := self.checkVersion(username, version)
+		if err != nil {
+			return err
+		}
+	}
+	delete(self.clients, username)
+	return nil
+}
+
+func (self *MemoryStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	clientInfo := self.clients[username]
+	if clientInfo == nil {
+		return errors.New("client not exist")
+	}
+	clientInfo.EncryptedPassword = copyBytes(encryptedPassword)
+	clientInfo.Salt = copyBytes(salt)
+	clientInfo.Version++
+	return nil
+}
+
+func (self *MemoryStore) checkVersion(username string, version int64) error {
+	clientInfo := self.clients[username]
+	if clientInfo == nil {
+		return errors.New("client not exist")
+	}
+	if clientInfo.Version != version {
+		return errors.New("client version conflict")
+	}
+	return nil
+}
+
+// copyClientInfo makes a deep copy, so callers can never change a stored
+// client without going through the store.
+func copyClientInfo(clientInfo *ClientInfo) *ClientInfo {
+	clientCopy := *clientInfo
+	clientCopy.EncryptedPassword = copyBytes(clientInfo.EncryptedPassword)
+	clientCopy.Salt = copyBytes(clientInfo.Salt)
+	clientCopy.RegistrationTokenHash = copyBytes(clientInfo.RegistrationTokenHash)
+	clientCopy.GrantAuthorizationCode = copySet(clientInfo.GrantAuthorizationCode)
+	clientCopy.GrantImplicit = copySet(clientInfo.GrantImplicit)
+	clientCopy.GrantResourceOwner = copySet(clientInfo.GrantResourceOwner)
+	clientCopy.GrantClientCredentials = copySet(clientInfo.GrantClientCredentials)
+	clientCopy.DefaultScopes = copySet(clientInfo.DefaultScopes)
+	clientCopy.CreateDate = copyTime(clientInfo.CreateDate)
+	clientCopy.UpdateDate = copyTime(clientInfo.UpdateDate)
+	if clientInfo.IssueRefreshTokens != nil {
+		issueRefreshTokens := *clientInfo.IssueRefreshTokens
+		clientCopy.IssueRefreshTokens = &issueRefreshTokens
+	}
+	return &clientCopy
+}
+
+func copyBytes(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	if set == nil {
+		return nil
+	}
+	setCopy := make(map[string]bool, len(set))
+	for key, value := range set {
+		setCopy[key] = value
+	}
+	return setCopy
+}
+
+func copyTime(value *time.Time) *time.Time {
+	if value == nil {
+		return nil
+	}
+	timeCopy := *value
+	return &timeCopy
+}
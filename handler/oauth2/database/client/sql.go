@@ -0,0 +1,225 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	clientColumns = "client_username, client_password, owner_username, grant_authorization_code, grant_implicit, grant_resource_owner, grant_client_credentials, default_scopes, redirect_uri_author_code, redirect_uri_implicit, client_name, description, public_client, salt, create_date, update_date, create_user, update_user, create_ip, update_ip, registration_token_hash, access_token_ttl, refresh_token_ttl, session_lifetime, idle_timeout, issue_refresh_tokens, version"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetClientInfo(username string) (*ClientInfo, error) {
+	row := self.db.QueryRow("SELECT "+clientColumns+" FROM clients WHERE client_username = ?", username)
+	clientInfo, err := scanClientInfo(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clientInfo, nil
+}
+
+func (self *SQLStore) ListClientInfo() ([]*ClientInfo, error) {
+	rows, err := self.db.Query("SELECT " + clientColumns + " FROM clients ORDER BY client_username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clientInfos []*ClientInfo
+	for rows.Next() {
+		clientInfo, err := scanClientInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		clientInfos = append(clientInfos, clientInfo)
+	}
+	return clientInfos, rows.Err()
+}
+
+func (self *SQLStore) PutClientInfo(clientInfo *ClientInfo) error {
+	result, err := self.db.Exec("INSERT INTO clients ("+clientColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		clientInfo.ClientUsername,
+		clientInfo.EncryptedPassword,
+		clientInfo.OwnerUsername,
+		database.SetToSQL(clientInfo.GrantAuthorizationCode),
+		database.SetToSQL(clientInfo.GrantImplicit),
+		database.SetToSQL(clientInfo.GrantResourceOwner),
+		database.SetToSQL(clientInfo.GrantClientCredentials),
+		database.SetToSQL(clientInfo.DefaultScopes),
+		clientInfo.RedirectURIAuthorCode,
+		clientInfo.RedirectURIImplicit,
+		clientInfo.ClientName,
+		clientInfo.Description,
+		clientInfo.PublicClient,
+		clientInfo.Salt,
+		database.TimeToSQL(clientInfo.CreateDate),
+		database.TimeToSQL(clientInfo.UpdateDate),
+		clientInfo.CreateUser,
+		clientInfo.UpdateUser,
+		clientInfo.CreateIP,
+		clientInfo.UpdateIP,
+		clientInfo.RegistrationTokenHash,
+		clientInfo.AccessTokenTTL,
+		clientInfo.RefreshTokenTTL,
+		clientInfo.SessionLifetime,
+		clientInfo.IdleTimeout,
+		database.BoolToSQL(clientInfo.IssueRefreshTokens),
+		1,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("duplicate client username")
+	}
+	clientInfo.Version = 1
+	return nil
+}
+
+func (self *SQLStore) UpdateClientInfo(clientInfo *ClientInfo) error {
+	result, err := self.db.Exec("UPDATE clients SET client_password = ?, owner_username = ?, grant_authorization_code = ?, grant_implicit = ?, grant_resource_owner = ?, grant_client_credentials = ?, default_scopes = ?, redirect_uri_author_code = ?, redirect_uri_implicit = ?, client_name = ?, description = ?, public_client = ?, salt = ?, create_date = ?, update_date = ?, create_user = ?, update_user = ?, create_ip = ?, update_ip = ?, registration_token_hash = ?, access_token_ttl = ?, refresh_token_ttl = ?, session_lifetime = ?, idle_timeout = ?, issue_refresh_tokens = ?, version = version + 1 WHERE client_username = ? AND version = ?",
+		clientInfo.EncryptedPassword,
+		clientInfo.OwnerUsername,
+		database.SetToSQL(clientInfo.GrantAuthorizationCode),
+		database.SetToSQL(clientInfo.GrantImplicit),
+		database.SetToSQL(clientInfo.GrantResourceOwner),
+		database.SetToSQL(clientInfo.GrantClientCredentials),
+		database.SetToSQL(clientInfo.DefaultScopes),
+		clientInfo.RedirectURIAuthorCode,
+		clientInfo.RedirectURIImplicit,
+		clientInfo.ClientName,
+		clientInfo.Description,
+		clientInfo.PublicClient,
+		clientInfo.Salt,
+		database.TimeToSQL(clientInfo.CreateDate),
+		database.TimeToSQL(clientInfo.UpdateDate),
+		clientInfo.CreateUser,
+		clientInfo.UpdateUser,
+		clientInfo.CreateIP,
+		clientInfo.UpdateIP,
+		clientInfo.RegistrationTokenHash,
+		clientInfo.AccessTokenTTL,
+		clientInfo.RefreshTokenTTL,
+		clientInfo.SessionLifetime,
+		clientInfo.IdleTimeout,
+		database.BoolToSQL(clientInfo.IssueRefreshTokens),
+		clientInfo.ClientUsername,
+		clientInfo.Version,
+	)
+	err = self.checkClientUpdated(clientInfo.ClientUsername, result, err)
+	if err != nil {
+		return err
+	}
+	clientInfo.Version++
+	return nil
+}
+
+func (self *SQLStore) DeleteClientInfo(username string, version int64) error {
+	if version == 0 {
+		result, err := self.db.Exec("DELETE FROM clients WHERE client_username = ?", username)
+		return self.checkClientUpdated(username, result, err)
+	}
+	result, err := self.db.Exec("DELETE FROM clients WHERE client_username = ? AND version = ?", username, version)
+	return self.checkClientUpdated(username, result, err)
+}
+
+func (self *SQLStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	result, err := self.db.Exec("UPDATE clients SET client_password = ?, salt = ?, version = version + 1 WHERE client_username = ?", encryptedPassword, salt, username)
+	return self.checkClientUpdated(username, result, err)
+}
+
+// checkClientUpdated tells a missing client from one at another version when
+// a statement matched no row.
+func (self *SQLStore) checkClientUpdated(username string, result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		return nil
+	}
+	var found int
+	err = self.db.QueryRow("SELECT COUNT(*) FROM clients WHERE client_username = ?", username).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return errors.New("client not exist")
+	}
+	return errors.New("client version conflict")
+}
+
+func scanClientInfo(row interface {
+	Scan(dest ...interface{}) error
+}) (*ClientInfo, error) {
+	clientInfo := &ClientInfo{}
+	var grantAuthorizationCode, grantImplicit, grantResourceOwner, grantClientCredentials, defaultScopes sql.NullString
+	var createDate, updateDate sql.NullInt64
+	var issueRefreshTokens sql.NullBool
+	err := row.Scan(
+		&clientInfo.ClientUsername,
+		&clientInfo.EncryptedPassword,
+		&clientInfo.OwnerUsername,
+		&grantAuthorizationCode,
+		&grantImplicit,
+		&grantResourceOwner,
+		&grantClientCredentials,
+		&defaultScopes,
+		&clientInfo.RedirectURIAuthorCode,
+		&clientInfo.RedirectURIImplicit,
+		&clientInfo.ClientName,
+		&clientInfo.Description,
+		&clientInfo.PublicClient,
+		&clientInfo.Salt,
+		&createDate,
+		&updateDate,
+		&clientInfo.CreateUser,
+		&clientInfo.UpdateUser,
+		&clientInfo.CreateIP,
+		&clientInfo.UpdateIP,
+		&clientInfo.RegistrationTokenHash,
+		&clientInfo.AccessTokenTTL,
+		&clientInfo.RefreshTokenTTL,
+		&clientInfo.SessionLifetime,
+		&clientInfo.IdleTimeout,
+		&issueRefreshTokens,
+		&clientInfo.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	clientInfo.GrantAuthorizationCode = database.SQLToSet(grantAuthorizationCode)
+	clientInfo.GrantImplicit = database.SQLToSet(grantImplicit)
+	clientInfo.GrantResourceOwner = database.SQLToSet(grantResourceOwner)
+	clientInfo.GrantClientCredentials = database.SQLToSet(grantClientCredentials)
+	clientInfo.DefaultScopes = database.SQLToSet(defaultScopes)
+	clientInfo.CreateDate = database.SQLToTime(createDate)
+	clientInfo.UpdateDate = database.SQLToTime(updateDate)
+	clientInfo.IssueRefreshTokens = database.SQLToBool(issueRefreshTokens)
+	return clientInfo, nil
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"github.com/boltdb/bolt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +21,18 @@ func AddKeyValue(bucket *bolt.Bucket, key string, value interface{}) error {
 		if value != "" {
 			return bucket.Put([]byte(key), []byte(value))
 		}
+	case int64:
+		if value != 0 {
+			return bucket.Put([]byte(key), []byte(strconv.FormatInt(value, 10)))
+		}
+	case bool:
+		if value {
+			return bucket.Put([]byte(key), []byte("true"))
+		}
+	case *bool:
+		if value != nil {
+			return bucket.Put([]byte(key), []byte(strconv.FormatBool(*value)))
+		}
 	case []byte:
 		if value != nil {
 			return bucket.Put([]byte(key), value)
@@ -39,21 +53,60 @@ func AddKeyValue(bucket *bolt.Bucket, key string, value interface{}) error {
 	return nil
 }
 
+// GetInt64 reads a value written by AddKeyValue, 0 when the key is missing.
+func GetInt64(bucket *bolt.Bucket, key string) (int64, error) {
+	valueByte := bucket.Get([]byte(key))
+	if valueByte == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(valueByte), 10, 64)
+}
+
+// GetBool reads a *bool written by AddKeyValue, nil when the key is missing.
+func GetBool(bucket *bolt.Bucket, key string) *bool {
+	valueByte := bucket.Get([]byte(key))
+	if valueByte == nil {
+		return nil
+	}
+	value := string(valueByte) == "true"
+	return &value
+}
+
+// GetBytes copies a value out of the bucket, nil when the key is missing. The
+// slices of bolt are only valid until the transaction ends.
+func GetBytes(bucket *bolt.Bucket, key string) []byte {
+	valueByte := bucket.Get([]byte(key))
+	if valueByte == nil {
+		return nil
+	}
+	return append([]byte{}, valueByte...)
+}
+
+// SetToString joins a scope set sorted and space delimited, the form of the
+// scope parameter of RFC 6749.
 func SetToString(scopeMap map[string]bool) string {
-	var scopes string
+	return strings.Join(SortedScopes(scopeMap), " ")
+}
+
+// SortedScopes lists the scopes of a set sorted, an empty list rather than
+// nil for the empty set.
+func SortedScopes(scopeMap map[string]bool) []string {
+	scopes := []string{}
 	for key, value := range scopeMap {
-		if value {
-			scopes += key + ","
+		if value && key != "" {
+			scopes = append(scopes, key)
 		}
 	}
-	if len(scopes) == 0 {
-		return ""
-	}
-	return scopes[:len(scopes)-1]
+	sort.Strings(scopes)
+	return scopes
 }
 
+// StringToSet splits scopes on spaces, and on the commas stored and sent
+// before scopes were space delimited. An empty string is the empty set.
 func StringToSet(scopesString string) map[string]bool {
-	scopes := strings.Split(scopesString, ",")
+	scopes := strings.FieldsFunc(scopesString, func(char rune) bool {
+		return char == ',' || char == ' '
+	})
 	scopeMap := make(map[string]bool)
 	for _, scope := range scopes {
 		scopeMap[scope] = true
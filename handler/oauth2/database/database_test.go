@@ -0,0 +1,59 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStringToSet(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		scopes string
+		want   map[string]bool
+		string string
+	}{
+		{"space delimited", "read write", map[string]bool{"read": true, "write": true}, "read write"},
+		{"comma delimited", "write,read", map[string]bool{"read": true, "write": true}, "read write"},
+		{"mixed delimiters", " read, write  admin,,", map[string]bool{"admin": true, "read": true, "write": true}, "admin read write"},
+		{"duplicates", "read read,read", map[string]bool{"read": true}, "read"},
+		{"single scope", "read", map[string]bool{"read": true}, "read"},
+		{"empty", "", map[string]bool{}, ""},
+		{"only delimiters", " , ", map[string]bool{}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := StringToSet(test.scopes)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			if scopes := SetToString(got); scopes != test.string {
+				t.Fatalf("got %q back, want %q", scopes, test.string)
+			}
+			if again := StringToSet(SetToString(got)); !reflect.DeepEqual(again, got) {
+				t.Errorf("got %v after a round trip, want %v", again, got)
+			}
+		})
+	}
+}
+
+func TestSetToString(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		scopeMap map[string]bool
+		want     string
+	}{
+		{"sorted", map[string]bool{"write": true, "admin": true, "read": true}, "admin read write"},
+		{"false members left out", map[string]bool{"read": true, "write": false}, "read"},
+		{"empty scope left out", map[string]bool{"": true, "read": true}, "read"},
+		{"empty", map[string]bool{}, ""},
+		{"nil", nil, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SetToString(test.scopeMap); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if scopes := SortedScopes(nil); scopes == nil || len(scopes) != 0 {
+		t.Errorf("got %#v for the empty set, want an empty list", scopes)
+	}
+}
@@ -0,0 +1,209 @@
+package loginattempt
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const ()
+
+var ()
+
+func init() {
+}
+
+type BoltStore struct {
+	db *database.BoltFile
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := database.OpenBoltFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open database for login-attempt: %v", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
+}
+
+func (self *BoltStore) Compact() (before int64, after int64, err error) {
+	return self.db.Compact()
+}
+
+// AttemptInfo counts the failed credential checks of one key, a username,
+// client or address. The count starts over once ExpireTime passes.
+type AttemptInfo struct {
+	Key         string
+	Failures    int64
+	LastFailure *time.Time
+	ExpireTime  *time.Time
+}
+
+func (self *BoltStore) GetAttemptInfo(key string) (*AttemptInfo, error) {
+	var attemptInfo *AttemptInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		var err error
+		attemptInfo, err = readAttemptInfo(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attemptInfo, nil
+}
+
+// AddFailure counts a failure at now in one transaction and returns the new
+// count.
+func (self *BoltStore) AddFailure(key string, now time.Time, expireTime time.Time) (*AttemptInfo, error) {
+	var attemptInfo *AttemptInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		attemptInfo, err = readAttemptInfo(tx, key)
+		if err != nil {
+			return err
+		}
+		attemptInfo = nextAttemptInfo(attemptInfo, key, now, expireTime)
+		attemptBucket, err := tx.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(attemptBucket, "failures", attemptInfo.Failures)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(attemptBucket, "last-failure", attemptInfo.LastFailure)
+		if err != nil {
+			return err
+		}
+		return database.AddKeyValue(attemptBucket, "expire-time", attemptInfo.ExpireTime)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attemptInfo, nil
+}
+
+// RemoveFailure takes back the failure AddFailure counted at reserved. The
+// last failure goes back to lastFailure unless another one came after, a
+// count that drops to none is deleted.
+func (self *BoltStore) RemoveFailure(key string, reserved time.Time, lastFailure time.Time) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		attemptInfo, err := readAttemptInfo(tx, key)
+		if err != nil || attemptInfo == nil {
+			return err
+		}
+		attemptInfo = previousAttemptInfo(attemptInfo, reserved, lastFailure)
+		if attemptInfo == nil {
+			return tx.DeleteBucket([]byte(key))
+		}
+		attemptBucket := tx.Bucket([]byte(key))
+		err = database.AddKeyValue(attemptBucket, "failures", attemptInfo.Failures)
+		if err != nil {
+			return err
+		}
+		return database.AddKeyValue(attemptBucket, "last-failure", attemptInfo.LastFailure)
+	})
+}
+
+func (self *BoltStore) DeleteAttemptInfo(key string) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(key))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// DeleteExpired deletes at most limit counts that expired before now and
+// returns how many it deleted.
+func (self *BoltStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	deleted := 0
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var expired []string
+		err := tx.ForEach(func(key []byte, _ *bolt.Bucket) error {
+			if len(expired) >= limit {
+				return nil
+			}
+			attemptInfo, err := readAttemptInfo(tx, string(key))
+			if err != nil {
+				return err
+			}
+			if attemptInfo != nil && attemptInfo.ExpireTime.Before(now) {
+				expired = append(expired, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			err = tx.DeleteBucket([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+// nextAttemptInfo adds a failure to attemptInfo, or starts a new count when
+// there is none or it expired.
+func nextAttemptInfo(attemptInfo *AttemptInfo, key string, now time.Time, expireTime time.Time) *AttemptInfo {
+	failures := int64(1)
+	if attemptInfo != nil && attemptInfo.ExpireTime.After(now) {
+		failures = attemptInfo.Failures + 1
+	}
+	return &AttemptInfo{
+		Key:         key,
+		Failures:    failures,
+		LastFailure: &now,
+		ExpireTime:  &expireTime,
+	}
+}
+
+// previousAttemptInfo takes a failure counted at reserved off attemptInfo,
+// nil when none are left.
+func previousAttemptInfo(attemptInfo *AttemptInfo, reserved time.Time, lastFailure time.Time) *AttemptInfo {
+	if attemptInfo.Failures <= 1 {
+		return nil
+	}
+	attemptInfo.Failures--
+	if attemptInfo.LastFailure.Equal(reserved) {
+		attemptInfo.LastFailure = &lastFailure
+	}
+	return attemptInfo
+}
+
+func readAttemptInfo(tx *bolt.Tx, key string) (*AttemptInfo, error) {
+	attemptBucket := tx.Bucket([]byte(key))
+	if attemptBucket == nil {
+		return nil, nil
+	}
+	failures, err := database.GetInt64(attemptBucket, "failures")
+	if err != nil {
+		return nil, err
+	}
+	attemptInfo := &AttemptInfo{
+		Key:         key,
+		Failures:    failures,
+		LastFailure: &time.Time{},
+		ExpireTime:  &time.Time{},
+	}
+	err = attemptInfo.LastFailure.UnmarshalBinary(attemptBucket.Get([]byte("last-failure")))
+	if err != nil {
+		return nil, err
+	}
+	err = attemptInfo.ExpireTime.UnmarshalBinary(attemptBucket.Get([]byte("expire-time")))
+	if err != nil {
+		return nil, err
+	}
+	return attemptInfo, nil
+}
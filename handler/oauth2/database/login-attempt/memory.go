@@ -0,0 +1,85 @@
+package loginattempt
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps failure counts in process memory, a restart forgets
+// them.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	attempts map[string]*AttemptInfo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: make(map[string]*AttemptInfo)}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetAttemptInfo(key string) (*AttemptInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	attemptInfo := self.attempts[key]
+	if attemptInfo == nil {
+		return nil, nil
+	}
+	return copyAttemptInfo(attemptInfo), nil
+}
+
+func (self *MemoryStore) AddFailure(key string, now time.Time, expireTime time.Time) (*AttemptInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	attemptInfo := nextAttemptInfo(self.attempts[key], key, now, expireTime)
+	self.attempts[key] = attemptInfo
+	return copyAttemptInfo(attemptInfo), nil
+}
+
+func (self *MemoryStore) RemoveFailure(key string, reserved time.Time, lastFailure time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	attemptInfo := self.attempts[key]
+	if attemptInfo == nil {
+		return nil
+	}
+	attemptInfo = previousAttemptInfo(attemptInfo, reserved, lastFailure)
+	if attemptInfo == nil {
+		delete(self.attempts, key)
+	}
+	return nil
+}
+
+func (self *MemoryStore) DeleteAttemptInfo(key string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.attempts, key)
+	return nil
+}
+
+func (self *MemoryStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	deleted := 0
+	for key, attemptInfo := range self.attempts {
+		if deleted >= limit {
+			break
+		}
+		if attemptInfo.ExpireTime.Before(now) {
+			delete(self.attempts, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func copyAttemptInfo(attemptInfo *AttemptInfo) *AttemptInfo {
+	attemptCopy := *attemptInfo
+	lastFailure := *attemptInfo.LastFailure
+	attemptCopy.LastFailure = &lastFailure
+	expireTime := *attemptInfo.ExpireTime
+	attemptCopy.ExpireTime = &expireTime
+	return &attemptCopy
+}
@@ -0,0 +1,93 @@
+package loginattempt
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	attemptColumns = "attempt_key, failures, last_failure, expire_time"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetAttemptInfo(key string) (*AttemptInfo, error) {
+	attemptInfo := &AttemptInfo{}
+	var lastFailure, expireTime sql.NullInt64
+	err := self.db.QueryRow("SELECT "+attemptColumns+" FROM login_attempts WHERE attempt_key = ?", key).Scan(
+		&attemptInfo.Key,
+		&attemptInfo.Failures,
+		&lastFailure,
+		&expireTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attemptInfo.LastFailure = database.SQLToTime(lastFailure)
+	attemptInfo.ExpireTime = database.SQLToTime(expireTime)
+	return attemptInfo, nil
+}
+
+// AddFailure counts in a single upsert, so failures reported by several
+// instances at once all count.
+func (self *SQLStore) AddFailure(key string, now time.Time, expireTime time.Time) (*AttemptInfo, error) {
+	_, err := self.db.Exec("INSERT INTO login_attempts ("+attemptColumns+") VALUES (?, 1, ?, ?) "+
+		"ON CONFLICT (attempt_key) DO UPDATE SET "+
+		"failures = CASE WHEN login_attempts.expire_time > excluded.last_failure THEN login_attempts.failures + 1 ELSE 1 END, "+
+		"last_failure = excluded.last_failure, expire_time = excluded.expire_time",
+		key,
+		now.UnixNano(),
+		expireTime.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return self.GetAttemptInfo(key)
+}
+
+// RemoveFailure decrements in place, then drops a count that reached none.
+func (self *SQLStore) RemoveFailure(key string, reserved time.Time, lastFailure time.Time) error {
+	_, err := self.db.Exec("UPDATE login_attempts SET failures = failures - 1, "+
+		"last_failure = CASE WHEN last_failure = ? THEN ? ELSE last_failure END "+
+		"WHERE attempt_key = ? AND failures > 0",
+		reserved.UnixNano(),
+		lastFailure.UnixNano(),
+		key,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = self.db.Exec("DELETE FROM login_attempts WHERE attempt_key = ? AND failures <= 0", key)
+	return err
+}
+
+func (self *SQLStore) DeleteAttemptInfo(key string) error {
+	_, err := self.db.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key)
+	return err
+}
+
+func (self *SQLStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	result, err := self.db.Exec("DELETE FROM login_attempts WHERE attempt_key IN (SELECT attempt_key FROM login_attempts WHERE expire_time < ? LIMIT ?)", now.UnixNano(), limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,63 @@
+CREATE TABLE clients (
+	client_username TEXT PRIMARY KEY,
+	client_password BYTEA,
+	owner_username TEXT NOT NULL DEFAULT '',
+	grant_authorization_code TEXT,
+	grant_implicit TEXT,
+	grant_resource_owner TEXT,
+	grant_client_credentials TEXT,
+	redirect_uri_author_code TEXT NOT NULL DEFAULT '',
+	redirect_uri_implicit TEXT NOT NULL DEFAULT '',
+	client_name TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	public_client BOOLEAN NOT NULL DEFAULT FALSE,
+	salt BYTEA,
+	create_date BIGINT,
+	update_date BIGINT,
+	create_user TEXT NOT NULL DEFAULT '',
+	update_user TEXT NOT NULL DEFAULT '',
+	create_ip TEXT NOT NULL DEFAULT '',
+	update_ip TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE users (
+	username TEXT PRIMARY KEY,
+	uid TEXT NOT NULL DEFAULT '',
+	password BYTEA,
+	salt BYTEA
+);
+
+CREATE TABLE access_tokens (
+	token TEXT NOT NULL,
+	client TEXT NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	scopes TEXT NOT NULL DEFAULT '',
+	refresh_family TEXT NOT NULL DEFAULT '',
+	issue_time BIGINT,
+	expire_time BIGINT NOT NULL,
+	PRIMARY KEY (client, token)
+);
+CREATE INDEX access_tokens_token ON access_tokens (token);
+
+CREATE TABLE refresh_tokens (
+	token TEXT PRIMARY KEY,
+	client TEXT NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	scopes TEXT NOT NULL DEFAULT '',
+	family TEXT NOT NULL,
+	access_token TEXT NOT NULL DEFAULT '',
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	expire_time BIGINT NOT NULL
+);
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+
+CREATE TABLE authorization_codes (
+	code TEXT PRIMARY KEY,
+	client TEXT NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	redirect_uri TEXT NOT NULL DEFAULT '',
+	scopes TEXT NOT NULL DEFAULT '',
+	code_challenge TEXT NOT NULL DEFAULT '',
+	code_challenge_method TEXT NOT NULL DEFAULT '',
+	expire_time BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE clients ADD COLUMN registration_token_hash BYTEA;
@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN state TEXT NOT NULL DEFAULT 'active';
+UPDATE users SET state = 'disabled' WHERE disabled;
+ALTER TABLE users DROP COLUMN disabled;
+ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN create_date BIGINT;
+ALTER TABLE users ADD COLUMN update_date BIGINT;
@@ -0,0 +1,7 @@
+CREATE TABLE login_attempts (
+	attempt_key TEXT PRIMARY KEY,
+	failures BIGINT NOT NULL,
+	last_failure BIGINT NOT NULL,
+	expire_time BIGINT NOT NULL
+);
+CREATE INDEX login_attempts_expire_time ON login_attempts (expire_time);
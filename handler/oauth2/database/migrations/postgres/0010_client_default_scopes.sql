@@ -0,0 +1 @@
+ALTER TABLE clients ADD COLUMN default_scopes TEXT;
@@ -0,0 +1,3 @@
+CREATE INDEX access_tokens_expire_time ON access_tokens (expire_time);
+CREATE INDEX refresh_tokens_expire_time ON refresh_tokens (expire_time);
+CREATE INDEX authorization_codes_expire_time ON authorization_codes (expire_time);
@@ -0,0 +1,6 @@
+ALTER TABLE clients ADD COLUMN access_token_ttl BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN refresh_token_ttl BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN session_lifetime BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN idle_timeout BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN issue_refresh_tokens INTEGER;
+ALTER TABLE refresh_tokens ADD COLUMN session_expire_time BIGINT;
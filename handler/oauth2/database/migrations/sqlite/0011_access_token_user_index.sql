@@ -0,0 +1 @@
+CREATE INDEX access_tokens_username ON access_tokens (username);
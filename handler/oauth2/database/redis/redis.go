@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPoolSize = 8
+	defaultTimeout  = 5 * time.Second
+)
+
+var (
+	ErrNil = errors.New("redis: nil reply")
+)
+
+// Error is an error reply sent by the server. The connection stays usable
+// after one, unlike after network or protocol errors.
+type Error string
+
+func (self Error) Error() string {
+	return string(self)
+}
+
+// Client speaks RESP2 over a small pool of connections. Replies come back as
+// string (simple strings), int64, []byte (bulk strings), nil, []interface{}
+// or Error.
+type Client struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *conn
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+}
+
+func Dial(address string, password string, db int, poolSize int) (*Client, error) {
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+	client := &Client{
+		address:  address,
+		password: password,
+		db:       db,
+		timeout:  defaultTimeout,
+		idle:     make(chan *conn, poolSize),
+	}
+	_, err := client.Do("PING")
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("fail to connect to redis at %v: %v", address, err)
+	}
+	return client, nil
+}
+
+func (self *Client) Close() error {
+	for {
+		select {
+		case c := <-self.idle:
+			c.netConn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (self *Client) Do(args ...interface{}) (interface{}, error) {
+	replies, err := self.Pipeline([][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := replies[0].(Error); ok {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends every command before reading any reply. Error replies are
+// returned in place, only failures of the connection itself end up in err.
+func (self *Client) Pipeline(commands [][]interface{}) ([]interface{}, error) {
+	c, err := self.get()
+	if err != nil {
+		return nil, err
+	}
+	c.netConn.SetDeadline(time.Now().Add(self.timeout))
+	for _, args := range commands {
+		err = c.writeCommand(args)
+		if err != nil {
+			c.netConn.Close()
+			return nil, err
+		}
+	}
+	err = c.writer.Flush()
+	if err != nil {
+		c.netConn.Close()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		replies[i], err = c.readReply()
+		if err != nil {
+			c.netConn.Close()
+			return nil, err
+		}
+	}
+	self.put(c)
+	return replies, nil
+}
+
+// Transaction wraps the commands in MULTI/EXEC and returns their replies.
+func (self *Client) Transaction(commands [][]interface{}) ([]interface{}, error) {
+	pipeline := make([][]interface{}, 0, len(commands)+2)
+	pipeline = append(pipeline, []interface{}{"MULTI"})
+	pipeline = append(pipeline, commands...)
+	pipeline = append(pipeline, []interface{}{"EXEC"})
+	replies, err := self.Pipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies[:len(replies)-1] {
+		if replyErr, ok := reply.(Error); ok {
+			return nil, replyErr
+		}
+	}
+	switch execReply := replies[len(replies)-1].(type) {
+	case Error:
+		return nil, execReply
+	case []interface{}:
+		for _, reply := range execReply {
+			if replyErr, ok := reply.(Error); ok {
+				return nil, replyErr
+			}
+		}
+		return execReply, nil
+	}
+	return nil, errors.New("redis: transaction aborted")
+}
+
+func (self *Client) get() (*conn, error) {
+	select {
+	case c := <-self.idle:
+		return c, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", self.address, self.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+	}
+	var setup [][]interface{}
+	if self.password != "" {
+		setup = append(setup, []interface{}{"AUTH", self.password})
+	}
+	if self.db != 0 {
+		setup = append(setup, []interface{}{"SELECT", self.db})
+	}
+	netConn.SetDeadline(time.Now().Add(self.timeout))
+	for _, args := range setup {
+		err = c.writeCommand(args)
+		if err == nil {
+			err = c.writer.Flush()
+		}
+		var reply interface{}
+		if err == nil {
+			reply, err = c.readReply()
+		}
+		if replyErr, ok := reply.(Error); ok {
+			err = replyErr
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (self *Client) put(c *conn) {
+	select {
+	case self.idle <- c:
+	default:
+		c.netConn.Close()
+	}
+}
+
+func (self *conn) writeCommand(args []interface{}) error {
+	self.writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		var value string
+		switch arg := arg.(type) {
+		case string:
+			value = arg
+		case []byte:
+			value = string(arg)
+		case int:
+			value = strconv.Itoa(arg)
+		case int64:
+			value = strconv.FormatInt(arg, 10)
+		default:
+			return fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		self.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n")
+		self.writer.WriteString(value)
+		_, err := self.writer.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *conn) readReply() (interface{}, error) {
+	line, err := self.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return Error(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(self.reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			replies[i], err = self.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+func Bytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch reply := reply.(type) {
+	case []byte:
+		return reply, nil
+	case string:
+		return []byte(reply), nil
+	case nil:
+		return nil, ErrNil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %T", reply)
+}
+
+func Strings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	replies, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply type %T", reply)
+	}
+	values := make([]string, 0, len(replies))
+	for _, element := range replies {
+		value, err := Bytes(element, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(value))
+	}
+	return values, nil
+}
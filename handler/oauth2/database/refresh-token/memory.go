@@ -0,0 +1,123 @@
+package refreshtoken
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps refresh tokens in process memory with the same family
+// index as the bolt store.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	tokens   map[string]*TokenInfo
+	families map[string]map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens:   make(map[string]*TokenInfo),
+		families: make(map[string]map[string]bool),
+	}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetTokenInfo(token string) (*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	tokenInfo := self.tokens[token]
+	if tokenInfo == nil {
+		return nil, nil
+	}
+	return copyTokenInfo(tokenInfo), nil
+}
+
+func (self *MemoryStore) ListTokenInfo() ([]*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var tokenInfos []*TokenInfo
+	for _, tokenInfo := range self.tokens {
+		tokenInfos = append(tokenInfos, copyTokenInfo(tokenInfo))
+	}
+	return tokenInfos, nil
+}
+
+func (self *MemoryStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.tokens[tokenInfo.Token] != nil {
+		return errors.New("duplicate token")
+	}
+	self.tokens[tokenInfo.Token] = copyTokenInfo(tokenInfo)
+	family := self.families[tokenInfo.Family]
+	if family == nil {
+		family = make(map[string]bool)
+		self.families[tokenInfo.Family] = family
+	}
+	family[tokenInfo.Token] = true
+	return nil
+}
+
+func (self *MemoryStore) UseTokenInfo(token string) (*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	tokenInfo := self.tokens[token]
+	if tokenInfo == nil {
+		return nil, nil
+	}
+	previous := copyTokenInfo(tokenInfo)
+	tokenInfo.Used = true
+	return previous, nil
+}
+
+func (self *MemoryStore) DeleteFamily(family string) ([]*TokenInfo, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var tokenInfos []*TokenInfo
+	for token := range self.families[family] {
+		if tokenInfo := self.tokens[token]; tokenInfo != nil {
+			tokenInfos = append(tokenInfos, tokenInfo)
+			delete(self.tokens, token)
+		}
+	}
+	delete(self.families, family)
+	return tokenInfos, nil
+}
+
+func (self *MemoryStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	deleted := 0
+	for token, tokenInfo := range self.tokens {
+		if deleted >= limit {
+			break
+		}
+		if !tokenInfo.ExpireTime.Before(now) {
+			continue
+		}
+		delete(self.tokens, token)
+		family := self.families[tokenInfo.Family]
+		delete(family, token)
+		if len(family) == 0 {
+			delete(self.families, tokenInfo.Family)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func copyTokenInfo(tokenInfo *TokenInfo) *TokenInfo {
+	tokenCopy := *tokenInfo
+	if tokenInfo.ExpireTime != nil {
+		expireTime := *tokenInfo.ExpireTime
+		tokenCopy.ExpireTime = &expireTime
+	}
+	if tokenInfo.SessionExpireTime != nil {
+		sessionExpireTime := *tokenInfo.SessionExpireTime
+		tokenCopy.SessionExpireTime = &sessionExpireTime
+	}
+	return &tokenCopy
+}
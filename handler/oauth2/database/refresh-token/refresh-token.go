@@ -0,0 +1,283 @@
+package refreshtoken
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const ()
+
+var (
+	tokenBucketName  = []byte("token")
+	familyBucketName = []byte("family")
+)
+
+func init() {
+}
+
+type BoltStore struct {
+	db *database.BoltFile
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := database.OpenBoltFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open database for refresh-token: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokenBucketName)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(familyBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
+}
+
+func (self *BoltStore) Compact() (before int64, after int64, err error) {
+	return self.db.Compact()
+}
+
+// TokenInfo is a refresh token. Every refresh token issued by rotating
+// another one shares its Family, so a replayed token can take down the whole
+// chain. SessionExpireTime, when set, is the end of the session the family
+// was granted for, rotation never issues a token past it.
+type TokenInfo struct {
+	Token             string
+	Client            string
+	User              string
+	Scopes            string
+	Family            string
+	AccessToken       string
+	Used              bool
+	ExpireTime        *time.Time
+	SessionExpireTime *time.Time
+}
+
+func (self *BoltStore) GetTokenInfo(token string) (*TokenInfo, error) {
+	var tokenInfo *TokenInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tokenInfo, err = readTokenInfo(tx, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
+
+func (self *BoltStore) ListTokenInfo() ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucketName).ForEach(func(token []byte, _ []byte) error {
+			tokenInfo, err := readTokenInfo(tx, string(token))
+			if err != nil || tokenInfo == nil {
+				return err
+			}
+			tokenInfos = append(tokenInfos, tokenInfo)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+func (self *BoltStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		tokenBucket, err := tx.Bucket(tokenBucketName).CreateBucket([]byte(tokenInfo.Token))
+		if err == bolt.ErrBucketExists {
+			return errors.New("duplicate token")
+		}
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "token", tokenInfo.Token)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "client", tokenInfo.Client)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "user", tokenInfo.User)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "scopes", tokenInfo.Scopes)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "family", tokenInfo.Family)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "access-token", tokenInfo.AccessToken)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "used", tokenInfo.Used)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "expire-time", tokenInfo.ExpireTime)
+		if err != nil {
+			return err
+		}
+		err = database.AddKeyValue(tokenBucket, "session-expire-time", tokenInfo.SessionExpireTime)
+		if err != nil {
+			return err
+		}
+		familyBucket, err := tx.Bucket(familyBucketName).CreateBucketIfNotExists([]byte(tokenInfo.Family))
+		if err != nil {
+			return err
+		}
+		return familyBucket.Put([]byte(tokenInfo.Token), []byte{})
+	})
+	return err
+}
+
+// UseTokenInfo marks the token as used and returns it as it was before, so
+// the caller sees Used set when the token is presented for a second time.
+func (self *BoltStore) UseTokenInfo(token string) (*TokenInfo, error) {
+	var tokenInfo *TokenInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		tokenInfo, err = readTokenInfo(tx, token)
+		if err != nil || tokenInfo == nil {
+			return err
+		}
+		return database.AddKeyValue(tx.Bucket(tokenBucketName).Bucket([]byte(token)), "used", true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
+
+// DeleteFamily removes every refresh token of the family and returns them.
+func (self *BoltStore) DeleteFamily(family string) ([]*TokenInfo, error) {
+	var tokenInfos []*TokenInfo
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		familyBucket := tx.Bucket(familyBucketName).Bucket([]byte(family))
+		if familyBucket == nil {
+			return nil
+		}
+		err := familyBucket.ForEach(func(token, _ []byte) error {
+			tokenInfo, err := readTokenInfo(tx, string(token))
+			if err != nil || tokenInfo == nil {
+				return err
+			}
+			tokenInfos = append(tokenInfos, tokenInfo)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tokenInfo := range tokenInfos {
+			err = tx.Bucket(tokenBucketName).DeleteBucket([]byte(tokenInfo.Token))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(familyBucketName).DeleteBucket([]byte(family))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+// DeleteExpired deletes at most limit tokens that expired before now and
+// returns how many it deleted. Families left without tokens go as well.
+func (self *BoltStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	deleted := 0
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		var expired []*TokenInfo
+		err := tx.Bucket(tokenBucketName).ForEach(func(token []byte, _ []byte) error {
+			if len(expired) >= limit {
+				return nil
+			}
+			tokenInfo, err := readTokenInfo(tx, string(token))
+			if err != nil {
+				return err
+			}
+			if tokenInfo != nil && tokenInfo.ExpireTime.Before(now) {
+				expired = append(expired, tokenInfo)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tokenInfo := range expired {
+			err = tx.Bucket(tokenBucketName).DeleteBucket([]byte(tokenInfo.Token))
+			if err != nil {
+				return err
+			}
+			familyBucket := tx.Bucket(familyBucketName).Bucket([]byte(tokenInfo.Family))
+			if familyBucket == nil {
+				continue
+			}
+			err = familyBucket.Delete([]byte(tokenInfo.Token))
+			if err != nil {
+				return err
+			}
+			if key, _ := familyBucket.Cursor().First(); key == nil {
+				err = tx.Bucket(familyBucketName).DeleteBucket([]byte(tokenInfo.Family))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+func readTokenInfo(tx *bolt.Tx, token string) (*TokenInfo, error) {
+	tokenBucket := tx.Bucket(tokenBucketName).Bucket([]byte(token))
+	if tokenBucket == nil {
+		return nil, nil
+	}
+	tokenInfo := &TokenInfo{
+		Token:       token,
+		Client:      string(tokenBucket.Get([]byte("client"))),
+		User:        string(tokenBucket.Get([]byte("user"))),
+		Scopes:      string(tokenBucket.Get([]byte("scopes"))),
+		Family:      string(tokenBucket.Get([]byte("family"))),
+		AccessToken: string(tokenBucket.Get([]byte("access-token"))),
+		Used:        string(tokenBucket.Get([]byte("used"))) == "true",
+	}
+	expireTime := &time.Time{}
+	err := expireTime.UnmarshalBinary(tokenBucket.Get([]byte("expire-time")))
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo.ExpireTime = expireTime
+	if dataBinary := tokenBucket.Get([]byte("session-expire-time")); dataBinary != nil {
+		sessionExpireTime := &time.Time{}
+		err := sessionExpireTime.UnmarshalBinary(dataBinary)
+		if err != nil {
+			return nil, err
+		}
+		tokenInfo.SessionExpireTime = sessionExpireTime
+	}
+	return tokenInfo, nil
+}
@@ -0,0 +1,167 @@
+package refreshtoken
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	tokenColumns = "token, client, username, scopes, family, access_token, used, expire_time, session_expire_time"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetTokenInfo(token string) (*TokenInfo, error) {
+	row := self.db.QueryRow("SELECT "+tokenColumns+" FROM refresh_tokens WHERE token = ?", token)
+	tokenInfo, err := scanTokenInfo(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfo, nil
+}
+
+func (self *SQLStore) ListTokenInfo() ([]*TokenInfo, error) {
+	rows, err := self.db.Query("SELECT " + tokenColumns + " FROM refresh_tokens ORDER BY token")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokenInfos []*TokenInfo
+	for rows.Next() {
+		tokenInfo, err := scanTokenInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokenInfos = append(tokenInfos, tokenInfo)
+	}
+	return tokenInfos, rows.Err()
+}
+
+func (self *SQLStore) PutTokenInfo(tokenInfo *TokenInfo) error {
+	result, err := self.db.Exec("INSERT INTO refresh_tokens ("+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		tokenInfo.Token,
+		tokenInfo.Client,
+		tokenInfo.User,
+		tokenInfo.Scopes,
+		tokenInfo.Family,
+		tokenInfo.AccessToken,
+		tokenInfo.Used,
+		database.TimeToSQL(tokenInfo.ExpireTime),
+		database.TimeToSQL(tokenInfo.SessionExpireTime),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("duplicate token")
+	}
+	return nil
+}
+
+// UseTokenInfo flips used with a conditional update, so of two instances
+// racing on the same token only one sees it unused.
+func (self *SQLStore) UseTokenInfo(token string) (*TokenInfo, error) {
+	result, err := self.db.Exec("UPDATE refresh_tokens SET used = ? WHERE token = ? AND used = ?", true, token, false)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo, err := self.GetTokenInfo(token)
+	if err != nil || tokenInfo == nil {
+		return nil, err
+	}
+	tokenInfo.Used = updated == 0
+	return tokenInfo, nil
+}
+
+func (self *SQLStore) DeleteFamily(family string) ([]*TokenInfo, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(self.db.Rebind("SELECT "+tokenColumns+" FROM refresh_tokens WHERE family = ?"), family)
+	if err != nil {
+		return nil, err
+	}
+	var tokenInfos []*TokenInfo
+	for rows.Next() {
+		tokenInfo, err := scanTokenInfo(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tokenInfos = append(tokenInfos, tokenInfo)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(self.db.Rebind("DELETE FROM refresh_tokens WHERE family = ?"), family)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return tokenInfos, nil
+}
+
+func (self *SQLStore) DeleteExpired(now time.Time, limit int) (int, error) {
+	result, err := self.db.Exec("DELETE FROM refresh_tokens WHERE token IN (SELECT token FROM refresh_tokens WHERE expire_time < ? LIMIT ?)", now.UnixNano(), limit)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func scanTokenInfo(row interface {
+	Scan(dest ...interface{}) error
+}) (*TokenInfo, error) {
+	tokenInfo := &TokenInfo{}
+	var expireTime, sessionExpireTime sql.NullInt64
+	err := row.Scan(
+		&tokenInfo.Token,
+		&tokenInfo.Client,
+		&tokenInfo.User,
+		&tokenInfo.Scopes,
+		&tokenInfo.Family,
+		&tokenInfo.AccessToken,
+		&tokenInfo.Used,
+		&expireTime,
+		&sessionExpireTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo.ExpireTime = database.SQLToTime(expireTime)
+	tokenInfo.SessionExpireTime = database.SQLToTime(sessionExpireTime)
+	return tokenInfo, nil
+}
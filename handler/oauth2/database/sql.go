@@ -0,0 +1,201 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLiteDriver   = "sqlite"
+	PostgresDriver = "postgres"
+
+	// any constant shared by every instance, it only has to stay the same
+	migrationLockID = 7265
+)
+
+var (
+	//go:embed migrations
+	migrations embed.FS
+)
+
+// SQLDB is a database/sql handle that knows its driver, so queries can be
+// written once with ? placeholders and rebound for PostgreSQL.
+type SQLDB struct {
+	*sql.DB
+	Driver string
+}
+
+func OpenSQL(driver string, dataSource string) (*SQLDB, error) {
+	if driver != SQLiteDriver && driver != PostgresDriver {
+		return nil, fmt.Errorf("invalid sql config: unknown driver %v", driver)
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open sql database: %v", err)
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail to open sql database: %v", err)
+	}
+	if driver == SQLiteDriver {
+		// sqlite has a single writer, more connections only trade waiting
+		// for SQLITE_BUSY errors
+		db.SetMaxOpenConns(1)
+	}
+	return &SQLDB{DB: db, Driver: driver}, nil
+}
+
+func (self *SQLDB) Rebind(query string) string {
+	if self.Driver != PostgresDriver {
+		return query
+	}
+	var builder strings.Builder
+	n := 0
+	for _, char := range query {
+		if char == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String()
+}
+
+func (self *SQLDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return self.DB.Exec(self.Rebind(query), args...)
+}
+
+func (self *SQLDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return self.DB.QueryRow(self.Rebind(query), args...)
+}
+
+func (self *SQLDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return self.DB.Query(self.Rebind(query), args...)
+}
+
+// Migrate applies every embedded migration of the driver that is not in
+// schema_migrations yet. Each migration runs in its own transaction, on
+// PostgreSQL under an advisory lock so instances starting together do not
+// race each other.
+func (self *SQLDB) Migrate() error {
+	_, err := self.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("fail to create schema_migrations: %v", err)
+	}
+	dir := path.Join("migrations", self.Driver)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("invalid migration file name %v", name)
+		}
+		script, err := fs.ReadFile(migrations, path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = self.migrate(version, string(script))
+		if err != nil {
+			return fmt.Errorf("fail to apply migration %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (self *SQLDB) migrate(version int, script string) error {
+	tx, err := self.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if self.Driver == PostgresDriver {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID)
+		if err != nil {
+			return err
+		}
+	}
+	var applied int
+	err = tx.QueryRow(self.Rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	_, err = tx.Exec(script)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(self.Rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// times are stored as unix nanoseconds, NULL for a nil time
+func TimeToSQL(value *time.Time) sql.NullInt64 {
+	if value == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: value.UnixNano(), Valid: true}
+}
+
+func SQLToTime(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	timeValue := time.Unix(0, value.Int64)
+	return &timeValue
+}
+
+// scope sets use the same string form as in bolt, NULL for a nil set
+func SetToSQL(value map[string]bool) sql.NullString {
+	if value == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: SetToString(value), Valid: true}
+}
+
+func SQLToSet(value sql.NullString) map[string]bool {
+	if !value.Valid {
+		return nil
+	}
+	return StringToSet(value.String)
+}
+
+// optional flags are NULL when unset
+func BoolToSQL(value *bool) sql.NullBool {
+	if value == nil {
+		return sql.NullBool{}
+	}
+	return sql.NullBool{Bool: *value, Valid: true}
+}
+
+func SQLToBool(value sql.NullBool) *bool {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Bool
+}
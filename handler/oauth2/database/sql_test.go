@@ -0,0 +1,115 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		driver string
+		query  string
+		want   string
+	}{
+		{"postgres", PostgresDriver, "SELECT a FROM t WHERE b = ? AND c = ?", "SELECT a FROM t WHERE b = $1 AND c = $2"},
+		{"postgres without placeholders", PostgresDriver, "SELECT COUNT(*) FROM t", "SELECT COUNT(*) FROM t"},
+		{"postgres two digit placeholders", PostgresDriver,
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"},
+		{"postgres placeholders without spaces", PostgresDriver, "(?,?)", "($1,$2)"},
+		{"sqlite", SQLiteDriver, "SELECT a FROM t WHERE b = ? AND c = ?", "SELECT a FROM t WHERE b = ? AND c = ?"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := &SQLDB{Driver: test.driver}
+			if got := db.Rebind(test.query); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// readSchema returns the applied migration versions and the sql of every
+// table and index.
+func readSchema(t *testing.T, db *SQLDB) ([]int, map[string]string) {
+	t.Helper()
+	var versions []int
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	rows.Close()
+
+	schema := make(map[string]string)
+	rows, err = db.Query("SELECT name, COALESCE(sql, '') FROM sqlite_master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, sql string
+		err = rows.Scan(&name, &sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema[name] = sql
+	}
+	return versions, schema
+}
+
+func TestMigrateTwice(t *testing.T) {
+	dataSource := filepath.Join(t.TempDir(), "oauth2.db")
+	db, err := OpenSQL(SQLiteDriver, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, schema := readSchema(t, db)
+	if len(versions) != 11 {
+		t.Fatalf("got versions %v, want 1 to 11", versions)
+	}
+	for i, version := range versions {
+		if version != i+1 {
+			t.Fatalf("got versions %v, want 1 to 11", versions)
+		}
+	}
+
+	// once more on the same handle, then as an instance starting up again
+	err = db.Migrate()
+	if err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	db.Close()
+	db, err = OpenSQL(SQLiteDriver, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Migrate()
+	if err != nil {
+		t.Fatalf("migrating after a restart: %v", err)
+	}
+	againVersions, againSchema := readSchema(t, db)
+	if len(againVersions) != len(versions) {
+		t.Errorf("got versions %v, want %v", againVersions, versions)
+	}
+	if len(againSchema) != len(schema) {
+		t.Errorf("got %v tables and indexes, want %v", len(againSchema), len(schema))
+	}
+	for name, sql := range schema {
+		if againSchema[name] != sql {
+			t.Errorf("%v changed from %q to %q", name, sql, againSchema[name])
+		}
+	}
+}
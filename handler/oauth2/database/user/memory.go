@@ -0,0 +1,142 @@
+package user
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps users in process memory. Everything is lost when the
+// process exits, so it only suits tests and throwaway deployments.
+type MemoryStore struct {
+	mutex sync.RWMutex
+	users map[string]*UserInfo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{users: make(map[string]*UserInfo)}
+}
+
+func (self *MemoryStore) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) GetUserInfo(username string) (*UserInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	userInfo := self.users[username]
+	if userInfo == nil {
+		return nil, nil
+	}
+	return copyUserInfo(userInfo), nil
+}
+
+func (self *MemoryStore) ListUserInfo() ([]*UserInfo, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	var userInfos []*UserInfo
+	for _, userInfo := range self.users {
+		userInfos = append(userInfos, copyUserInfo(userInfo))
+	}
+	sort.Slice(userInfos, func(i, j int) bool {
+		return userInfos[i].Username < userInfos[j].Username
+	})
+	return userInfos, nil
+}
+
+func (self *MemoryStore) PutUserInfo(userInfo *UserInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.users[userInfo.Username] != nil {
+		return errors.New("duplicate user")
+	}
+	defaultState(userInfo)
+	userInfo.Version = 1
+	self.users[userInfo.Username] = copyUserInfo(userInfo)
+	return nil
+}
+
+func (self *MemoryStore) UpdateUserInfo(userInfo *UserInfo) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	err := self.checkVersion(userInfo.Username, userInfo.Version)
+	if err != nil {
+		return err
+	}
+	defaultState(userInfo)
+	userInfo.Version++
+	self.users[userInfo.Username] = copyUserInfo(userInfo)
+	return nil
+}
+
+func (self *MemoryStore) DeleteUserInfo(username string, version int64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.users[username] == nil {
+		return errors.New("user not exist")
+	}
+	if version != 0 {
+		err := self.checkVersion(username, version)
+		if err != nil {
+			return err
+		}
+	}
+	delete(self.users, username)
+	return nil
+}
+
+func (self *MemoryStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	userInfo := self.users[username]
+	if userInfo == nil {
+		return errors.New("user not exist")
+	}
+	userInfo.EncryptedPassword = copyBytes(encryptedPassword)
+	userInfo.Salt = copyBytes(salt)
+	userInfo.Version++
+	return nil
+}
+
+func (self *MemoryStore) checkVersion(username string, version int64) error {
+	userInfo := self.users[username]
+	if userInfo == nil {
+		return errors.New("user not exist")
+	}
+	if userInfo.Version != version {
+		return errors.New("user version conflict")
+	}
+	return nil
+}
+
+func copyUserInfo(userInfo *UserInfo) *UserInfo {
+	userCopy := *userInfo
+	userCopy.EncryptedPassword = copyBytes(userInfo.EncryptedPassword)
+	userCopy.Salt = copyBytes(userInfo.Salt)
+	userCopy.CreateDate = copyTime(userInfo.CreateDate)
+	userCopy.UpdateDate = copyTime(userInfo.UpdateDate)
+	userCopy.TOTPSecret = copyBytes(userInfo.TOTPSecret)
+	if userInfo.RecoveryCodes != nil {
+		userCopy.RecoveryCodes = make(map[string]bool)
+		for code, value := range userInfo.RecoveryCodes {
+			userCopy.RecoveryCodes[code] = value
+		}
+	}
+	return &userCopy
+}
+
+func copyBytes(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func copyTime(value *time.Time) *time.Time {
+	if value == nil {
+		return nil
+	}
+	timeCopy := *value
+	return &timeCopy
+}
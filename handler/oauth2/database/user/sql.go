@@ -0,0 +1,181 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+)
+
+const (
+	userColumns = "uid, username, password, salt, state, email, display_name, create_date, update_date, totp_secret, totp_enabled, totp_last_step, recovery_codes, version"
+)
+
+type SQLStore struct {
+	db *database.SQLDB
+}
+
+func NewSQLStore(db *database.SQLDB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close leaves the connection pool open, it is shared by the other stores and
+// closed by its owner.
+func (self *SQLStore) Close() error {
+	return nil
+}
+
+func (self *SQLStore) GetUserInfo(username string) (*UserInfo, error) {
+	userInfo, err := scanUserInfo(self.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return userInfo, nil
+}
+
+func (self *SQLStore) ListUserInfo() ([]*UserInfo, error) {
+	rows, err := self.db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var userInfos []*UserInfo
+	for rows.Next() {
+		userInfo, err := scanUserInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		userInfos = append(userInfos, userInfo)
+	}
+	return userInfos, rows.Err()
+}
+
+func (self *SQLStore) PutUserInfo(userInfo *UserInfo) error {
+	defaultState(userInfo)
+	result, err := self.db.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		userInfo.UID,
+		userInfo.Username,
+		userInfo.EncryptedPassword,
+		userInfo.Salt,
+		userInfo.State,
+		userInfo.Email,
+		userInfo.DisplayName,
+		database.TimeToSQL(userInfo.CreateDate),
+		database.TimeToSQL(userInfo.UpdateDate),
+		userInfo.TOTPSecret,
+		userInfo.TOTPEnabled,
+		userInfo.TOTPLastStep,
+		database.SetToString(userInfo.RecoveryCodes),
+		1,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errors.New("duplicate user")
+	}
+	userInfo.Version = 1
+	return nil
+}
+
+func (self *SQLStore) UpdateUserInfo(userInfo *UserInfo) error {
+	defaultState(userInfo)
+	result, err := self.db.Exec("UPDATE users SET uid = ?, password = ?, salt = ?, state = ?, email = ?, display_name = ?, create_date = ?, update_date = ?, totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, version = version + 1 WHERE username = ? AND version = ?",
+		userInfo.UID,
+		userInfo.EncryptedPassword,
+		userInfo.Salt,
+		userInfo.State,
+		userInfo.Email,
+		userInfo.DisplayName,
+		database.TimeToSQL(userInfo.CreateDate),
+		database.TimeToSQL(userInfo.UpdateDate),
+		userInfo.TOTPSecret,
+		userInfo.TOTPEnabled,
+		userInfo.TOTPLastStep,
+		database.SetToString(userInfo.RecoveryCodes),
+		userInfo.Username,
+		userInfo.Version,
+	)
+	err = self.checkUserUpdated(userInfo.Username, result, err)
+	if err != nil {
+		return err
+	}
+	userInfo.Version++
+	return nil
+}
+
+func (self *SQLStore) DeleteUserInfo(username string, version int64) error {
+	if version == 0 {
+		result, err := self.db.Exec("DELETE FROM users WHERE username = ?", username)
+		return self.checkUserUpdated(username, result, err)
+	}
+	result, err := self.db.Exec("DELETE FROM users WHERE username = ? AND version = ?", username, version)
+	return self.checkUserUpdated(username, result, err)
+}
+
+func (self *SQLStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	result, err := self.db.Exec("UPDATE users SET password = ?, salt = ?, version = version + 1 WHERE username = ?", encryptedPassword, salt, username)
+	return self.checkUserUpdated(username, result, err)
+}
+
+// checkUserUpdated tells a missing user from one at another version when a
+// statement matched no row.
+func (self *SQLStore) checkUserUpdated(username string, result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		return nil
+	}
+	var found int
+	err = self.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return errors.New("user not exist")
+	}
+	return errors.New("user version conflict")
+}
+
+func scanUserInfo(row interface {
+	Scan(dest ...interface{}) error
+}) (*UserInfo, error) {
+	userInfo := &UserInfo{}
+	var createDate, updateDate sql.NullInt64
+	var recoveryCodes string
+	err := row.Scan(
+		&userInfo.UID,
+		&userInfo.Username,
+		&userInfo.EncryptedPassword,
+		&userInfo.Salt,
+		&userInfo.State,
+		&userInfo.Email,
+		&userInfo.DisplayName,
+		&createDate,
+		&updateDate,
+		&userInfo.TOTPSecret,
+		&userInfo.TOTPEnabled,
+		&userInfo.TOTPLastStep,
+		&recoveryCodes,
+		&userInfo.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	userInfo.CreateDate = database.SQLToTime(createDate)
+	userInfo.UpdateDate = database.SQLToTime(updateDate)
+	userInfo.RecoveryCodes = recoveryCodeSet(recoveryCodes)
+	return userInfo, nil
+}
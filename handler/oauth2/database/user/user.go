@@ -2,24 +2,41 @@ package user
 
 import (
 	"errors"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"time"
 
-	"github.com/MochiKung/account-interface/config"
 	"github.com/MochiKung/account-interface/handler/oauth2/database"
 )
 
-const ()
-
-var (
-	db *bolt.DB
+// account states, only active accounts can sign in
+const (
+	PendingState  = "pending"
+	ActiveState   = "active"
+	LockedState   = "locked"
+	DisabledState = "disabled"
+	DeletedState  = "deleted"
 )
 
+var ()
+
 func init() {
-	var err error
-	db, err = bolt.Open(config.Default.Database.BoltDB.UserDB, 0600, nil)
+}
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(fileName string) (*BoltStore, error) {
+	db, err := bolt.Open(fileName, 0600, database.BoltOptions)
 	if err != nil {
-		panic("fail to open database for access-token")
+		return nil, fmt.Errorf("fail to open database for user: %v", err)
 	}
+	return &BoltStore{db: db}, nil
+}
+
+func (self *BoltStore) Close() error {
+	return self.db.Close()
 }
 
 type UserInfo struct {
@@ -27,21 +44,60 @@ type UserInfo struct {
 	Username          string
 	EncryptedPassword []byte
 	Salt              []byte
+	State             string
+	Email             string
+	DisplayName       string
+	CreateDate        *time.Time
+	UpdateDate        *time.Time
+	// TOTPSecret is set once enrollment starts, TOTPEnabled once the user
+	// proved to have it with a first code
+	TOTPSecret  []byte
+	TOTPEnabled bool
+	// TOTPLastStep is the time step of the last accepted code, a code is only
+	// accepted for a later step
+	TOTPLastStep int64
+	// RecoveryCodes holds the hex sha-256 of the unused recovery codes
+	RecoveryCodes map[string]bool
+	// Version counts the writes to the user, an update or delete only
+	// succeeds at the version the caller read
+	Version int64
+}
+
+// Active tells whether the account may sign in.
+func (self *UserInfo) Active() bool {
+	return self.State == ActiveState
+}
+
+func ValidState(state string) bool {
+	switch state {
+	case PendingState, ActiveState, LockedState, DisabledState, DeletedState:
+		return true
+	}
+	return false
+}
+
+// MFAEnabled tells whether signing in needs a second factor.
+func (self *UserInfo) MFAEnabled() bool {
+	return self.TOTPEnabled && self.TOTPSecret != nil
 }
 
-func GetUserInfo(username string) (*UserInfo, error) {
+// defaultState makes users created without a state active.
+func defaultState(userInfo *UserInfo) {
+	if userInfo.State == "" {
+		userInfo.State = ActiveState
+	}
+}
+
+func (self *BoltStore) GetUserInfo(username string) (*UserInfo, error) {
 	var userInfo *UserInfo
-	err := db.View(func(tx *bolt.Tx) error {
+	err := self.db.View(func(tx *bolt.Tx) error {
 		userBucket := tx.Bucket([]byte(username))
 		if userBucket == nil {
 			return nil
 		}
-		userInfo = &UserInfo{}
-		userInfo.UID = string(userBucket.Get([]byte("uid")))
-		userInfo.Username = string(userBucket.Get([]byte("username")))
-		userInfo.EncryptedPassword = userBucket.Get([]byte("password"))
-		userInfo.Salt = userBucket.Get([]byte("salt"))
-		return nil
+		var err error
+		userInfo, err = readUserInfo(userBucket)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -50,36 +106,241 @@ func GetUserInfo(username string) (*UserInfo, error) {
 	return userInfo, nil
 }
 
-func PutUserInfo(userInfo *UserInfo) error {
-	oldUserInfo, err := GetUserInfo(userInfo.Username)
+func (self *BoltStore) ListUserInfo() ([]*UserInfo, error) {
+	var userInfos []*UserInfo
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, userBucket *bolt.Bucket) error {
+			userInfo, err := readUserInfo(userBucket)
+			if err != nil {
+				return err
+			}
+			userInfos = append(userInfos, userInfo)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return userInfos, nil
+}
+
+func (self *BoltStore) PutUserInfo(userInfo *UserInfo) error {
+	oldUserInfo, err := self.GetUserInfo(userInfo.Username)
 	if err != nil && err.Error() != "user not exist" {
 		return err
 	}
 	if oldUserInfo != nil {
 		return errors.New("duplicate user")
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
+	defaultState(userInfo)
+	err = self.db.Update(func(tx *bolt.Tx) error {
 		userBucket, err := tx.CreateBucket([]byte(userInfo.Username))
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(userBucket, "uid", userInfo.UID)
+		return writeUserInfo(userBucket, userInfo, 1)
+	})
+	if err != nil {
+		return err
+	}
+	userInfo.Version = 1
+	return nil
+}
+
+// UpdateUserInfo replaces every field of an existing user that is still at
+// userInfo.Version and moves userInfo to the new version.
+func (self *BoltStore) UpdateUserInfo(userInfo *UserInfo) error {
+	defaultState(userInfo)
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		err := checkVersion(tx, userInfo.Username, userInfo.Version)
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteBucket([]byte(userInfo.Username))
+		if err != nil {
+			return err
+		}
+		userBucket, err := tx.CreateBucket([]byte(userInfo.Username))
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(userBucket, "username", userInfo.Username)
+		return writeUserInfo(userBucket, userInfo, userInfo.Version+1)
+	})
+	if err != nil {
+		return err
+	}
+	userInfo.Version++
+	return nil
+}
+
+// DeleteUserInfo deletes the user if it is still at version, version 0
+// deletes it at any version.
+func (self *BoltStore) DeleteUserInfo(username string, version int64) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		if version == 0 && tx.Bucket([]byte(username)) == nil {
+			return errors.New("user not exist")
+		}
+		if version != 0 {
+			err := checkVersion(tx, username, version)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket([]byte(username))
+	})
+}
+
+func (self *BoltStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket([]byte(username))
+		if userBucket == nil {
+			return errors.New("user not exist")
+		}
+		err := userBucket.Put([]byte("password"), encryptedPassword)
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(userBucket, "password", userInfo.EncryptedPassword)
+		version, err := database.GetInt64(userBucket, "version")
 		if err != nil {
 			return err
 		}
-		err = database.AddKeyValue(userBucket, "salt", userInfo.Salt)
+		err = database.AddKeyValue(userBucket, "version", version+1)
 		if err != nil {
 			return err
 		}
-		return nil
+		if salt == nil {
+			return userBucket.Delete([]byte("salt"))
+		}
+		return userBucket.Put([]byte("salt"), salt)
 	})
-	return err
+}
+
+func checkVersion(tx *bolt.Tx, username string, version int64) error {
+	userBucket := tx.Bucket([]byte(username))
+	if userBucket == nil {
+		return errors.New("user not exist")
+	}
+	storedVersion, err := database.GetInt64(userBucket, "version")
+	if err != nil {
+		return err
+	}
+	if storedVersion != version {
+		return errors.New("user version conflict")
+	}
+	return nil
+}
+
+func writeUserInfo(userBucket *bolt.Bucket, userInfo *UserInfo, version int64) error {
+	err := database.AddKeyValue(userBucket, "uid", userInfo.UID)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "username", userInfo.Username)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "password", userInfo.EncryptedPassword)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "salt", userInfo.Salt)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "state", userInfo.State)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "email", userInfo.Email)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "display_name", userInfo.DisplayName)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "create_date", userInfo.CreateDate)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "update_date", userInfo.UpdateDate)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "totp_secret", userInfo.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "totp_enabled", userInfo.TOTPEnabled)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "totp_last_step", userInfo.TOTPLastStep)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "recovery_codes", userInfo.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	err = database.AddKeyValue(userBucket, "version", version)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func readUserInfo(userBucket *bolt.Bucket) (*UserInfo, error) {
+	userInfo := &UserInfo{}
+	userInfo.UID = string(userBucket.Get([]byte("uid")))
+	userInfo.Username = string(userBucket.Get([]byte("username")))
+	userInfo.EncryptedPassword = database.GetBytes(userBucket, "password")
+	userInfo.Salt = database.GetBytes(userBucket, "salt")
+	userInfo.State = string(userBucket.Get([]byte("state")))
+	// users written before states only had a disabled flag
+	if userInfo.State == "" && string(userBucket.Get([]byte("disabled"))) == "true" {
+		userInfo.State = DisabledState
+	}
+	defaultState(userInfo)
+	userInfo.Email = string(userBucket.Get([]byte("email")))
+	userInfo.DisplayName = string(userBucket.Get([]byte("display_name")))
+	if dataBinary := userBucket.Get([]byte("create_date")); dataBinary != nil {
+		createDate := &time.Time{}
+		err := createDate.UnmarshalBinary(dataBinary)
+		if err != nil {
+			return nil, err
+		}
+		userInfo.CreateDate = createDate
+	}
+	if dataBinary := userBucket.Get([]byte("update_date")); dataBinary != nil {
+		updateDate := &time.Time{}
+		err := updateDate.UnmarshalBinary(dataBinary)
+		if err != nil {
+			return nil, err
+		}
+		userInfo.UpdateDate = updateDate
+	}
+	userInfo.TOTPSecret = database.GetBytes(userBucket, "totp_secret")
+	userInfo.TOTPEnabled = string(userBucket.Get([]byte("totp_enabled"))) == "true"
+	lastStep, err := database.GetInt64(userBucket, "totp_last_step")
+	if err != nil {
+		return nil, err
+	}
+	userInfo.TOTPLastStep = lastStep
+	userInfo.RecoveryCodes = recoveryCodeSet(string(userBucket.Get([]byte("recovery_codes"))))
+	version, err := database.GetInt64(userBucket, "version")
+	if err != nil {
+		return nil, err
+	}
+	userInfo.Version = version
+	return userInfo, nil
+}
+
+// recoveryCodeSet reads the stored recovery codes, none when used up.
+func recoveryCodeSet(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+	return database.StringToSet(value)
 }
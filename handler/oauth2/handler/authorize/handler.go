@@ -0,0 +1,399 @@
+package authorize
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/authorization-code"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath    = oauth2.PrefixPath + "/authorize"
+	codeResponse  = "code"
+	codeExpiresIn = 600
+
+	// the login form carries the value of this cookie, a page of another site
+	// cannot post it
+	csrfCookie      = "authorize_csrf"
+	csrfParam       = "csrf_token"
+	csrfTokenLength = 32
+
+	consentParam = "consent"
+	allowConsent = "allow"
+	denyConsent  = "deny"
+)
+
+var (
+	loginTemplate = template.Must(template.New("login").Parse(loginPage))
+	errorTemplate = template.Must(template.New("error").Parse(errorPage))
+)
+
+func init() {
+}
+
+type Handler struct {
+	stores *store.Stores
+}
+
+// loginForm signs the user in and asks them to approve the request in one
+// step, there is no session to remember either.
+type loginForm struct {
+	Action       string
+	Params       url.Values
+	CSRFToken    string
+	ClientName   string
+	RedirectHost string
+	Scopes       []string
+	Error        string
+}
+
+// consent is what the login form shows of the authorization request.
+type consent struct {
+	clientName   string
+	redirectHost string
+	scopes       string
+}
+
+func New(stores *store.Stores) *Handler {
+	self := &Handler{stores: stores}
+	return self
+}
+
+func (self *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	for _, value := range req.Form {
+		if len(value) > 1 {
+			writeErrorPage(resp, "request parameters must not be included more than once")
+			return
+		}
+	}
+
+	// the client and redirect uri must be valid before anything is sent back
+	// to the redirect uri
+	clientUsername := req.Form.Get("client_id")
+	if clientUsername == "" {
+		writeErrorPage(resp, "missing client_id")
+		return
+	}
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientUsername)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		writeErrorPage(resp, "unknown client")
+		return
+	}
+	requestRedirectURI := req.Form.Get("redirect_uri")
+	redirectURI := clientInfo.RedirectURIAuthorCode
+	if redirectURI == "" {
+		writeErrorPage(resp, "client has no registered redirect uri")
+		return
+	}
+	if requestRedirectURI != "" && requestRedirectURI != redirectURI {
+		writeErrorPage(resp, "redirect uri mismatch")
+		return
+	}
+
+	state := req.Form.Get("state")
+	scopes := req.Form.Get("scope")
+
+	// verify response type
+	if req.Form.Get("response_type") != codeResponse {
+		redirectError(resp, req, redirectURI, "unsupported_response_type", state)
+		return
+	}
+
+	// verify client grant
+	if clientInfo.GrantAuthorizationCode == nil {
+		redirectError(resp, req, redirectURI, "unauthorized_client", state)
+		return
+	}
+
+	// verify client grant scope, the code carries the granted scope
+	scopes, ok := verify.VerifyGrantScopes(clientInfo, oauth2.AuthorizationCodeGrant, scopes)
+	if !ok {
+		redirectError(resp, req, redirectURI, "invalid_scope", state)
+		return
+	}
+
+	// verify proof key, public clients have no secret to redeem the code with
+	codeChallenge := req.Form.Get("code_challenge")
+	codeChallengeMethod := req.Form.Get("code_challenge_method")
+	if codeChallenge == "" {
+		if clientInfo.PublicClient {
+			redirectError(resp, req, redirectURI, "invalid_request", state)
+			return
+		}
+		codeChallengeMethod = ""
+	} else {
+		if codeChallengeMethod == "" {
+			codeChallengeMethod = oauth2.PlainCodeChallengeMethod
+		}
+		if codeChallengeMethod != oauth2.PlainCodeChallengeMethod && codeChallengeMethod != oauth2.S256CodeChallengeMethod {
+			redirectError(resp, req, redirectURI, "invalid_request", state)
+			return
+		}
+		if !verify.VerifyCodeChallengeFormat(codeChallenge) {
+			redirectError(resp, req, redirectURI, "invalid_request", state)
+			return
+		}
+	}
+
+	page := &consent{
+		clientName:   clientInfo.ClientName,
+		redirectHost: redirectHost(redirectURI),
+		scopes:       scopes,
+	}
+	if page.clientName == "" {
+		page.clientName = clientUsername
+	}
+	if req.Method != "POST" {
+		writeLoginPage(resp, req, page, "")
+		return
+	}
+	if !verifyCSRFToken(req) {
+		writeLoginPageStatus(resp, req, page, http.StatusForbidden, "the sign in form expired, please try again")
+		return
+	}
+	if req.PostForm.Get(consentParam) == denyConsent {
+		redirectError(resp, req, redirectURI, "access_denied", state)
+		return
+	}
+
+	// authenticate resource owner, who approves the request in the same post
+	username := req.PostForm.Get("username")
+	password := req.PostForm.Get("password")
+	if username == "" || password == "" || req.PostForm.Get(consentParam) != allowConsent {
+		writeLoginPage(resp, req, page, "")
+		return
+	}
+	attempt, err := lockout.Default.Check(self.stores.Attempts, req, lockout.UserKey(username))
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.Header().Set("Retry-After", strconv.FormatInt(locked.RetryAfterSeconds(), 10))
+		writeLoginPageStatus(resp, req, page, http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts, try again in %v seconds", locked.RetryAfterSeconds()))
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer attempt.Release()
+	userInfo, err := self.stores.Users.GetUserInfo(username)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if !verify.VerifyUserPassword(self.stores.Users, userInfo, password) {
+		attempt.Fail()
+		writeLoginPage(resp, req, page, "invalid username or password")
+		return
+	}
+	if !userInfo.Active() {
+		attempt.Release()
+		writeLoginPage(resp, req, page, "the account is not active")
+		return
+	}
+	if userInfo.MFAEnabled() {
+		otp := req.PostForm.Get("otp")
+		if otp == "" {
+			writeLoginPage(resp, req, page, "enter the one-time code of your authenticator app or a recovery code")
+			return
+		}
+		if !verify.VerifySecondFactor(self.stores.Users, userInfo, otp) {
+			attempt.Fail()
+			writeLoginPage(resp, req, page, "invalid one-time code")
+			return
+		}
+	}
+	attempt.Succeed()
+
+	// generate new code
+	codeInfo := &authorizationcode.CodeInfo{}
+	codeInfo.Code = stringgenerator.AuthorizationCode.Generate()
+	codeInfo.Client = clientUsername
+	codeInfo.User = username
+	codeInfo.RedirectURI = requestRedirectURI
+	codeInfo.Scopes = scopes
+	codeInfo.CodeChallenge = codeChallenge
+	codeInfo.CodeChallengeMethod = codeChallengeMethod
+	expireTime := time.Now().Add(time.Duration(codeExpiresIn) * time.Second)
+	codeInfo.ExpireTime = &expireTime
+	err = self.stores.Codes.PutCodeInfo(codeInfo)
+	for err != nil && err.Error() == "duplicate code" {
+		codeInfo.Code = stringgenerator.AuthorizationCode.Generate()
+		err = self.stores.Codes.PutCodeInfo(codeInfo)
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	redirect(resp, req, redirectURI, url.Values{"code": {codeInfo.Code}}, state)
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"response_types_supported":         []string{codeResponse},
+		"response_modes_supported":         []string{"query"},
+		"code_challenge_methods_supported": []string{oauth2.S256CodeChallengeMethod, oauth2.PlainCodeChallengeMethod},
+	}
+}
+
+func redirectError(resp http.ResponseWriter, req *http.Request, redirectURI string, errorTag string, state string) {
+	redirect(resp, req, redirectURI, url.Values{"error": {errorTag}}, state)
+}
+
+func redirect(resp http.ResponseWriter, req *http.Request, redirectURI string, params url.Values, state string) {
+	location, err := url.Parse(redirectURI)
+	if err != nil {
+		writeErrorPage(resp, "invalid redirect uri")
+		return
+	}
+	query := location.Query()
+	for key, value := range params {
+		query[key] = value
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	location.RawQuery = query.Encode()
+	resp.Header().Set("Cache-Control", "no-store")
+	http.Redirect(resp, req, location.String(), http.StatusFound)
+}
+
+// redirectHost is where the user is sent back to, as shown to them.
+func redirectHost(redirectURI string) string {
+	location, err := url.Parse(redirectURI)
+	if err != nil || location.Host == "" {
+		return redirectURI
+	}
+	return location.Host
+}
+
+// csrfToken returns the token of the browser's cookie, setting a new one
+// when there is none.
+func csrfToken(resp http.ResponseWriter, req *http.Request) string {
+	cookie, err := req.Cookie(csrfCookie)
+	if err == nil && len(cookie.Value) == csrfTokenLength {
+		return cookie.Value
+	}
+	token := stringgenerator.RandomString(csrfTokenLength)
+	http.SetCookie(resp, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     PrefixPath,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// verifyCSRFToken tells whether a post came from a login form this server
+// sent to the same browser.
+func verifyCSRFToken(req *http.Request) bool {
+	cookie, err := req.Cookie(csrfCookie)
+	if err != nil || len(cookie.Value) != csrfTokenLength {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.PostForm.Get(csrfParam))) == 1
+}
+
+func writeLoginPage(resp http.ResponseWriter, req *http.Request, page *consent, message string) {
+	status := http.StatusOK
+	if message != "" {
+		status = http.StatusUnauthorized
+	}
+	writeLoginPageStatus(resp, req, page, status, message)
+}
+
+func writeLoginPageStatus(resp http.ResponseWriter, req *http.Request, page *consent, status int, message string) {
+	params := url.Values{}
+	for key, value := range req.Form {
+		switch key {
+		case "username", "password", "otp", csrfParam, consentParam:
+		default:
+			params[key] = value
+		}
+	}
+	csrfToken := csrfToken(resp, req)
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("X-Frame-Options", "DENY")
+	resp.WriteHeader(status)
+	err := loginTemplate.Execute(resp, &loginForm{
+		Action:       PrefixPath,
+		Params:       params,
+		CSRFToken:    csrfToken,
+		ClientName:   page.clientName,
+		RedirectHost: page.redirectHost,
+		Scopes:       strings.Fields(page.scopes),
+		Error:        message,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeErrorPage(resp http.ResponseWriter, message string) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(http.StatusBadRequest)
+	err := errorTemplate.Execute(resp, message)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+const loginPage = `<!DOCTYPE html>
+<html>
+<head><title>Sign in</title></head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<p>{{.ClientName}} asks to access your account{{if .Scopes}} with the scopes{{end}}:</p>
+{{if .Scopes}}<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}<p>Allowing sends you back to {{.RedirectHost}}.</p>
+<form method="POST" action="{{.Action}}">
+{{range $key, $value := .Params}}<input type="hidden" name="{{$key}}" value="{{index $value 0}}">
+{{end}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>Username <input type="text" name="username"></label>
+<label>Password <input type="password" name="password"></label>
+<label>One-time code, if enabled <input type="text" name="otp" autocomplete="one-time-code"></label>
+<button type="submit" name="consent" value="allow">Sign in and allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`
+
+const errorPage = `<!DOCTYPE html>
+<html>
+<head><title>Authorization error</title></head>
+<body>
+<p>{{.}}</p>
+</body>
+</html>
+`
@@ -0,0 +1,146 @@
+package introspect
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/token/response-writer"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath           = oauth2.PrefixPath + "/introspect"
+	refreshTokenTypeHint = "refresh_token"
+	accessTokenType      = "bearer"
+)
+
+var ()
+
+func init() {
+}
+
+type Handler struct {
+	stores *store.Stores
+}
+
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+}
+
+func New(stores *store.Stores) *Handler {
+	self := &Handler{stores: stores}
+	return self
+}
+
+func (self *Handler) ServeHTTP(httpRes http.ResponseWriter, req *http.Request) {
+	resp := response.NewResponseWriter(httpRes)
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	for _, value := range req.Form {
+		if len(value) > 1 {
+			resp.WriteError(&response.InvalidRequestError, "request parameters must not be included more than once")
+			return
+		}
+	}
+
+	clientInfo, err := verify.AuthenticateClient(self.stores, req)
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.WriteLocked(&response.InvalidClientError, locked.RetryAfterSeconds())
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		resp.WriteError(&response.InvalidClientError, "")
+		return
+	}
+
+	token := req.Form.Get("token")
+	if token == "" {
+		resp.WriteError(&response.InvalidRequestError, "missing token")
+		return
+	}
+
+	var introspection *introspectionResponse
+	if req.Form.Get("token_type_hint") == refreshTokenTypeHint {
+		introspection, err = self.introspectRefreshToken(token)
+		if err == nil && introspection == nil {
+			introspection, err = self.introspectAccessToken(token)
+		}
+	} else {
+		introspection, err = self.introspectAccessToken(token)
+		if err == nil && introspection == nil {
+			introspection, err = self.introspectRefreshToken(token)
+		}
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if introspection == nil {
+		introspection = &introspectionResponse{Active: false}
+	}
+	resp.WriteObject(introspection)
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	}
+}
+
+func (self *Handler) introspectAccessToken(token string) (*introspectionResponse, error) {
+	tokenInfo, err := self.stores.Tokens.FindTokenInfo(token)
+	if err != nil || tokenInfo == nil {
+		return nil, err
+	}
+	if tokenInfo.ExpireTime.Before(time.Now()) {
+		return &introspectionResponse{Active: false}, nil
+	}
+	introspection := &introspectionResponse{
+		Active:    true,
+		Scope:     verify.NormalizeScopes(tokenInfo.Scopes),
+		ClientID:  tokenInfo.Client,
+		Username:  tokenInfo.User,
+		TokenType: accessTokenType,
+		Exp:       tokenInfo.ExpireTime.Unix(),
+	}
+	if tokenInfo.IssueTime != nil {
+		introspection.Iat = tokenInfo.IssueTime.Unix()
+	}
+	return introspection, nil
+}
+
+func (self *Handler) introspectRefreshToken(token string) (*introspectionResponse, error) {
+	tokenInfo, err := self.stores.RefreshTokens.GetTokenInfo(token)
+	if err != nil || tokenInfo == nil {
+		return nil, err
+	}
+	if tokenInfo.Used || tokenInfo.ExpireTime.Before(time.Now()) {
+		return &introspectionResponse{Active: false}, nil
+	}
+	return &introspectionResponse{
+		Active:   true,
+		Scope:    verify.NormalizeScopes(tokenInfo.Scopes),
+		ClientID: tokenInfo.Client,
+		Username: tokenInfo.User,
+		Exp:      tokenInfo.ExpireTime.Unix(),
+	}, nil
+}
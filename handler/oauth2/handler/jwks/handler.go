@@ -0,0 +1,76 @@
+package jwks
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/jwt"
+)
+
+const (
+	PrefixPath    = oauth2.PrefixPath + "/jwks"
+	WellKnownPath = "/.well-known/jwks.json"
+)
+
+var ()
+
+func init() {
+}
+
+type Handler struct {
+}
+
+type keySetResponse struct {
+	Keys []*jwt.JWK `json:"keys"`
+}
+
+func New() *Handler {
+	self := &Handler{}
+	return self
+}
+
+func (self *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	keys, err := jwt.Keys.PublicKeys()
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	data, err := json.Marshal(&keySetResponse{Keys: keys})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// keep caches short so a newly published key is picked up well before
+	// it becomes active
+	resp.Header().Set("Content-Type", "application/jwk-set+json")
+	resp.Header().Set("Cache-Control", "public, max-age=300")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(data)
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	keys, err := jwt.Keys.PublicKeys()
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+	var algorithms []string
+	found := make(map[string]bool)
+	for _, key := range keys {
+		if !found[key.Algorithm] {
+			found[key.Algorithm] = true
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	return map[string]interface{}{
+		"access_token_signing_alg_values_supported": algorithms,
+	}
+}
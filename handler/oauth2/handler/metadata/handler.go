@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+)
+
+const (
+	AuthorizationServerPath = "/.well-known/oauth-authorization-server"
+	OpenIDConfigurationPath = "/.well-known/openid-configuration"
+)
+
+var ()
+
+func init() {
+}
+
+// Handler serves the authorization server metadata. The document is built
+// from the endpoint registry on every request, so it always describes the
+// handlers that are actually served. scopes_supported lists the scopes the
+// clients are granted, unless the config overrides it.
+type Handler struct {
+	stores *store.Stores
+	scopes []string
+	openID bool
+}
+
+func New(stores *store.Stores, metadataConfig *config.Metadata) *Handler {
+	self := &Handler{stores: stores}
+	if metadataConfig != nil {
+		self.scopes = strings.Fields(metadataConfig.ScopesSupported)
+	}
+	return self
+}
+
+func NewOpenID(stores *store.Stores, metadataConfig *config.Metadata) *Handler {
+	self := New(stores, metadataConfig)
+	self.openID = true
+	return self
+}
+
+func (self *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	issuer := oauth2.Issuer(req)
+	document := map[string]interface{}{
+		"issuer": issuer,
+	}
+	for _, endpoint := range oauth2.Endpoints() {
+		if endpoint.MetadataName != "" {
+			document[endpoint.MetadataName] = issuer + endpoint.Path
+		}
+		if provider, ok := endpoint.Handler.(oauth2.MetadataProvider); ok {
+			for key, value := range provider.Metadata() {
+				document[key] = value
+			}
+		}
+	}
+
+	scopes := self.scopes
+	if len(scopes) == 0 {
+		var err error
+		scopes, err = self.registeredScopes()
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+	if len(scopes) > 0 {
+		document["scopes_supported"] = scopes
+	}
+	if self.openID {
+		document["subject_types_supported"] = []string{"public"}
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if config.Default.AccessToken.Issuer == "" {
+		// the issuer comes from the Host header, a shared cache must not hand
+		// it to requests for another host
+		resp.Header().Set("Cache-Control", "private, max-age=300")
+		resp.Header().Set("Vary", "Host")
+	} else {
+		resp.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(data)
+}
+
+// registeredScopes returns every scope granted to at least one client.
+func (self *Handler) registeredScopes() ([]string, error) {
+	clientInfos, err := self.stores.Clients.ListClientInfo()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, clientInfo := range clientInfos {
+		for _, grantScopes := range []map[string]bool{
+			clientInfo.GrantAuthorizationCode,
+			clientInfo.GrantImplicit,
+			clientInfo.GrantResourceOwner,
+			clientInfo.GrantClientCredentials,
+		} {
+			for scope, granted := range grantScopes {
+				if granted && scope != "" {
+					found[scope] = true
+				}
+			}
+		}
+	}
+	scopes := make([]string, 0, len(found))
+	for scope := range found {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
@@ -0,0 +1,465 @@
+package register
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/client-secret"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/token/response-writer"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath = oauth2.PrefixPath + "/register"
+
+	clientIDLength = 32
+	maxBodySize    = 64 * 1024
+
+	// recorded as the create and update user of registered clients
+	registrationUser = "registration"
+
+	clientSecretBasic = "client_secret_basic"
+	noneAuthMethod    = "none"
+	codeResponse      = "code"
+)
+
+var ()
+
+func init() {
+}
+
+// Handler serves dynamic client registration (RFC 7591) on PrefixPath and
+// the management of registered clients (RFC 7592) on PrefixPath/{client_id}.
+// Management requests authenticate with the registration access token handed
+// out at registration, only its sha-256 is stored.
+type Handler struct {
+	stores             *store.Stores
+	open               bool
+	initialAccessToken string
+	scopes             map[string]bool
+	grantTypes         map[string]bool
+}
+
+// clientMetadata holds the registered metadata this server understands,
+// other fields of a request are ignored.
+type clientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+type registrationRequest struct {
+	clientMetadata
+	ClientID string `json:"client_id"`
+}
+
+type registrationResponse struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+	clientMetadata
+}
+
+func New(stores *store.Stores, registrationConfig *config.Registration) *Handler {
+	self := &Handler{
+		stores:             stores,
+		open:               registrationConfig.Open,
+		initialAccessToken: registrationConfig.InitialAccessToken,
+		scopes:             make(map[string]bool),
+		grantTypes:         make(map[string]bool),
+	}
+	for _, scope := range strings.Fields(registrationConfig.Scopes) {
+		self.scopes[scope] = true
+	}
+	for _, grantType := range strings.Fields(registrationConfig.GrantTypes) {
+		self.grantTypes[grantType] = true
+	}
+	return self
+}
+
+func (self *Handler) ServeHTTP(httpRes http.ResponseWriter, req *http.Request) {
+	resp := response.NewResponseWriter(httpRes)
+	clientID := strings.Trim(strings.TrimPrefix(req.URL.Path, PrefixPath), "/")
+	if clientID == "" {
+		if req.Method != "POST" {
+			resp.Header().Set("Allow", "POST")
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		self.registerClient(resp, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "PUT", "DELETE":
+	default:
+		resp.Header().Set("Allow", "GET, PUT, DELETE")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	clientInfo, err := self.authenticateRegistration(req, clientID)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		// unknown clients look the same as wrong tokens
+		writeInvalidToken(resp)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		resp.WriteObject(newRegistrationResponse(req, clientInfo))
+	case "PUT":
+		self.updateClient(resp, req, clientInfo)
+	case "DELETE":
+		self.deleteClient(resp, clientInfo)
+	}
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"registration_endpoint_auth_methods_supported": []string{"bearer"},
+	}
+}
+
+func (self *Handler) registerClient(resp *response.ResponseWriter, req *http.Request) {
+	if self.anonymous() {
+		if !self.open {
+			writeInvalidToken(resp)
+			return
+		}
+	} else if !equalTokens(verify.BearerToken(req), self.initialAccessToken) {
+		writeInvalidToken(resp)
+		return
+	}
+	request, ok := readRegistrationRequest(resp, req)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	clientInfo := &client.ClientInfo{
+		ClientUsername: stringgenerator.RandomString(clientIDLength),
+		CreateDate:     &now,
+		CreateUser:     registrationUser,
+		CreateIP:       oauth2.RemoteIP(req),
+	}
+	if !self.applyMetadata(resp, &request.clientMetadata, clientInfo, now, req) {
+		return
+	}
+	secret, err := clientsecret.Update(clientInfo)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	registrationToken := stringgenerator.RegistrationToken.Generate()
+	clientInfo.RegistrationTokenHash = hashToken(registrationToken)
+	err = self.stores.Clients.PutClientInfo(clientInfo)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	log.Printf("registered client %v from %v\n", clientInfo.ClientUsername, clientInfo.CreateIP)
+
+	registration := newRegistrationResponse(req, clientInfo)
+	registration.ClientSecret = secret
+	if secret != "" {
+		registration.ClientSecretExpiresAt = new(int64)
+	}
+	registration.RegistrationAccessToken = registrationToken
+	resp.Header().Set("Location", registration.RegistrationClientURI)
+	resp.WriteObjectStatus(http.StatusCreated, registration)
+}
+
+func (self *Handler) updateClient(resp *response.ResponseWriter, req *http.Request, clientInfo *client.ClientInfo) {
+	request, ok := readRegistrationRequest(resp, req)
+	if !ok {
+		return
+	}
+	if request.ClientID != clientInfo.ClientUsername {
+		resp.WriteError(&response.InvalidRequestError, "client_id must match the registered client")
+		return
+	}
+	if !self.applyMetadata(resp, &request.clientMetadata, clientInfo, time.Now(), req) {
+		return
+	}
+	secret, err := clientsecret.Update(clientInfo)
+	if err == nil {
+		err = self.stores.Clients.UpdateClientInfo(clientInfo)
+	}
+	if err != nil {
+		writeStoreError(resp, err)
+		return
+	}
+	registration := newRegistrationResponse(req, clientInfo)
+	registration.ClientSecret = secret
+	if secret != "" {
+		registration.ClientSecretExpiresAt = new(int64)
+	}
+	resp.WriteObject(registration)
+}
+
+func (self *Handler) deleteClient(resp *response.ResponseWriter, clientInfo *client.ClientInfo) {
+	revoked, err := self.stores.DeleteClient(clientInfo.ClientUsername, clientInfo.Version)
+	if err != nil {
+		writeStoreError(resp, err)
+		return
+	}
+	log.Printf("deregistered client %v and revoked %v tokens\n", clientInfo.ClientUsername, revoked)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateRegistration returns the client when the request bears its
+// registration access token, nil otherwise.
+func (self *Handler) authenticateRegistration(req *http.Request, clientID string) (*client.ClientInfo, error) {
+	token := verify.BearerToken(req)
+	if token == "" {
+		return nil, nil
+	}
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientID)
+	if err != nil || clientInfo == nil {
+		return nil, err
+	}
+	if len(clientInfo.RegistrationTokenHash) == 0 {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare(hashToken(token), clientInfo.RegistrationTokenHash) != 1 {
+		return nil, nil
+	}
+	return clientInfo, nil
+}
+
+// applyMetadata validates the requested metadata against the registration
+// policy and copies it onto clientInfo. It writes the error response and
+// returns false when the metadata is not acceptable.
+func (self *Handler) applyMetadata(resp *response.ResponseWriter, metadata *clientMetadata, clientInfo *client.ClientInfo, now time.Time, req *http.Request) bool {
+	grantTypes := metadata.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{oauth2.AuthorizationCodeGrant}
+	}
+	requested := make(map[string]bool)
+	for _, grantType := range grantTypes {
+		switch grantType {
+		case oauth2.AuthorizationCodeGrant, oauth2.ClientCredentialsGrant, oauth2.ResourceOwnerCredentialsGrant, oauth2.RefreshTokenGrant:
+		default:
+			resp.WriteError(&response.InvalidClientMetadataError, "unsupported grant type "+grantType)
+			return false
+		}
+		if !self.grantTypes[grantType] || grantType == oauth2.AuthorizationCodeGrant && self.anonymous() {
+			resp.WriteError(&response.InvalidClientMetadataError, "grant type "+grantType+" is not open to registration")
+			return false
+		}
+		requested[grantType] = true
+	}
+	for _, responseType := range metadata.ResponseTypes {
+		if responseType != codeResponse || !requested[oauth2.AuthorizationCodeGrant] {
+			resp.WriteError(&response.InvalidClientMetadataError, "response types must match the grant types")
+			return false
+		}
+	}
+
+	public := false
+	switch metadata.TokenEndpointAuthMethod {
+	case clientSecretBasic, "":
+	case noneAuthMethod:
+		public = true
+	default:
+		resp.WriteError(&response.InvalidClientMetadataError, "unsupported token endpoint auth method "+metadata.TokenEndpointAuthMethod)
+		return false
+	}
+	if public && requested[oauth2.ClientCredentialsGrant] {
+		resp.WriteError(&response.InvalidClientMetadataError, "client credentials grant needs a confidential client")
+		return false
+	}
+
+	redirectURI := ""
+	if requested[oauth2.AuthorizationCodeGrant] {
+		// a client has a single redirect uri for the authorization code grant
+		if len(metadata.RedirectURIs) != 1 {
+			resp.WriteError(&response.InvalidRedirectURIError, "exactly one redirect uri is required")
+			return false
+		}
+		redirectURI = metadata.RedirectURIs[0]
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			resp.WriteError(&response.InvalidRedirectURIError, "redirect uri must be absolute and without fragment")
+			return false
+		}
+		if parsed.Scheme != "https" && !(parsed.Scheme == "http" && isLoopback(parsed.Hostname())) {
+			resp.WriteError(&response.InvalidRedirectURIError, "redirect uri must use https, or http on a loopback address")
+			return false
+		}
+	} else if len(metadata.RedirectURIs) != 0 {
+		resp.WriteError(&response.InvalidRedirectURIError, "redirect uris are only used by the authorization code grant")
+		return false
+	}
+
+	scopes := make(map[string]bool)
+	if metadata.Scope == "" {
+		for scope := range self.scopes {
+			scopes[scope] = true
+		}
+	}
+	for _, scope := range strings.Fields(metadata.Scope) {
+		if !self.scopes[scope] {
+			resp.WriteError(&response.InvalidClientMetadataError, "scope "+scope+" is not open to registration")
+			return false
+		}
+		scopes[scope] = true
+	}
+
+	clientInfo.ClientName = metadata.ClientName
+	clientInfo.PublicClient = public
+	clientInfo.RedirectURIAuthorCode = redirectURI
+	clientInfo.GrantAuthorizationCode = grantScopes(requested[oauth2.AuthorizationCodeGrant], scopes)
+	clientInfo.GrantResourceOwner = grantScopes(requested[oauth2.ResourceOwnerCredentialsGrant], scopes)
+	clientInfo.GrantClientCredentials = grantScopes(requested[oauth2.ClientCredentialsGrant], scopes)
+	clientInfo.UpdateDate = &now
+	clientInfo.UpdateUser = registrationUser
+	clientInfo.UpdateIP = oauth2.RemoteIP(req)
+	return true
+}
+
+// anonymous tells whether anyone may register, without an initial access
+// token to vouch for the client.
+func (self *Handler) anonymous() bool {
+	return self.initialAccessToken == ""
+}
+
+// isLoopback allows plain http redirects to native apps on this machine
+// (RFC 8252 section 7.3).
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func readRegistrationRequest(resp *response.ResponseWriter, req *http.Request) (*registrationRequest, bool) {
+	request := &registrationRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, maxBodySize)).Decode(request)
+	if err != nil {
+		resp.WriteError(&response.InvalidClientMetadataError, "request body must be a json object of client metadata")
+		return nil, false
+	}
+	return request, true
+}
+
+func newRegistrationResponse(req *http.Request, clientInfo *client.ClientInfo) *registrationResponse {
+	registration := &registrationResponse{
+		ClientID:              clientInfo.ClientUsername,
+		RegistrationClientURI: oauth2.Issuer(req) + PrefixPath + "/" + url.PathEscape(clientInfo.ClientUsername),
+		clientMetadata: clientMetadata{
+			ClientName:              clientInfo.ClientName,
+			TokenEndpointAuthMethod: clientSecretBasic,
+		},
+	}
+	if clientInfo.CreateDate != nil {
+		registration.ClientIDIssuedAt = clientInfo.CreateDate.Unix()
+	}
+	if clientInfo.PublicClient {
+		registration.TokenEndpointAuthMethod = noneAuthMethod
+	}
+	scopes := make(map[string]bool)
+	if clientInfo.GrantAuthorizationCode != nil {
+		registration.GrantTypes = append(registration.GrantTypes, oauth2.AuthorizationCodeGrant)
+		registration.ResponseTypes = []string{codeResponse}
+		registration.RedirectURIs = []string{clientInfo.RedirectURIAuthorCode}
+		mergeScopes(scopes, clientInfo.GrantAuthorizationCode)
+	}
+	if clientInfo.GrantClientCredentials != nil {
+		registration.GrantTypes = append(registration.GrantTypes, oauth2.ClientCredentialsGrant)
+		mergeScopes(scopes, clientInfo.GrantClientCredentials)
+	}
+	if clientInfo.GrantResourceOwner != nil {
+		registration.GrantTypes = append(registration.GrantTypes, oauth2.ResourceOwnerCredentialsGrant)
+		mergeScopes(scopes, clientInfo.GrantResourceOwner)
+	}
+	// refresh tokens come with the grants that act for a user
+	if clientInfo.GrantAuthorizationCode != nil || clientInfo.GrantResourceOwner != nil {
+		registration.GrantTypes = append(registration.GrantTypes, oauth2.RefreshTokenGrant)
+	}
+	sorted := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		sorted = append(sorted, scope)
+	}
+	sort.Strings(sorted)
+	registration.Scope = strings.Join(sorted, " ")
+	return registration
+}
+
+// grantScopes returns the scope set of a grant, nil when the grant is not
+// requested. A requested grant without scopes still gets an empty set, so
+// it stays distinguishable from a grant the client does not have.
+func grantScopes(requested bool, scopes map[string]bool) map[string]bool {
+	if !requested {
+		return nil
+	}
+	grant := make(map[string]bool, len(scopes))
+	for scope := range scopes {
+		grant[scope] = true
+	}
+	return grant
+}
+
+func mergeScopes(scopes map[string]bool, grant map[string]bool) {
+	for scope, granted := range grant {
+		if granted && scope != "" {
+			scopes[scope] = true
+		}
+	}
+}
+
+func hashToken(token string) []byte {
+	digest := sha256.Sum256([]byte(token))
+	return digest[:]
+}
+
+// equalTokens compares digests, so the time taken tells nothing about the
+// length or prefix of the expected token.
+func equalTokens(token string, expected string) bool {
+	return token != "" && subtle.ConstantTimeCompare(hashToken(token), hashToken(expected)) == 1
+}
+
+func writeInvalidToken(resp *response.ResponseWriter) {
+	resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	resp.WriteError(&response.InvalidTokenError, "")
+}
+
+// writeStoreError answers a failed write of a client read at the start of
+// the request. A client deleted in between is gone like an unknown one.
+func writeStoreError(resp *response.ResponseWriter, err error) {
+	switch err.Error() {
+	case "client not exist":
+		writeInvalidToken(resp)
+	case "client version conflict":
+		resp.WriteError(&response.ConflictError, "")
+	default:
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,154 @@
+package revoke
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/token/response-writer"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/verify"
+)
+
+const (
+	PrefixPath           = oauth2.PrefixPath + "/revoke"
+	accessTokenTypeHint  = "access_token"
+	refreshTokenTypeHint = "refresh_token"
+)
+
+var ()
+
+func init() {
+}
+
+type Handler struct {
+	stores *store.Stores
+}
+
+func New(stores *store.Stores) *Handler {
+	self := &Handler{stores: stores}
+	return self
+}
+
+func (self *Handler) ServeHTTP(httpRes http.ResponseWriter, req *http.Request) {
+	resp := response.NewResponseWriter(httpRes)
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	for _, value := range req.Form {
+		if len(value) > 1 {
+			resp.WriteError(&response.InvalidRequestError, "request parameters must not be included more than once")
+			return
+		}
+	}
+
+	clientInfo, err := self.authenticateClient(req)
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.WriteLocked(&response.InvalidClientError, locked.RetryAfterSeconds())
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if clientInfo == nil {
+		resp.WriteError(&response.InvalidClientError, "")
+		return
+	}
+
+	token := req.Form.Get("token")
+	if token == "" {
+		resp.WriteError(&response.InvalidRequestError, "missing token")
+		return
+	}
+
+	// the hint only decides which store is searched first
+	switch req.Form.Get("token_type_hint") {
+	case "", accessTokenTypeHint, refreshTokenTypeHint:
+	default:
+		resp.WriteError(&response.UnsupportedTokenTypeError, "")
+		return
+	}
+	var found bool
+	if req.Form.Get("token_type_hint") == refreshTokenTypeHint {
+		found, err = self.revokeRefreshToken(clientInfo, token)
+		if err == nil && !found {
+			found, err = self.revokeAccessToken(clientInfo, token)
+		}
+	} else {
+		found, err = self.revokeAccessToken(clientInfo, token)
+		if err == nil && !found {
+			found, err = self.revokeRefreshToken(clientInfo, token)
+		}
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if found {
+		log.Printf("client %v revoked a token\n", clientInfo.ClientUsername)
+	}
+
+	// invalid and unknown tokens are reported as revoked as well
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	return map[string]interface{}{
+		"revocation_endpoint_auth_methods_supported": []string{"client_secret_basic", "none"},
+	}
+}
+
+func (self *Handler) authenticateClient(req *http.Request) (*client.ClientInfo, error) {
+	if _, _, ok := req.BasicAuth(); ok {
+		return verify.AuthenticateClient(self.stores, req)
+	}
+
+	// public clients identify themselves with client_id only
+	clientUsername := req.Form.Get("client_id")
+	if clientUsername == "" {
+		return nil, nil
+	}
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientUsername)
+	if err != nil || clientInfo == nil || !clientInfo.PublicClient {
+		return nil, err
+	}
+	return clientInfo, nil
+}
+
+func (self *Handler) revokeAccessToken(clientInfo *client.ClientInfo, token string) (bool, error) {
+	tokenInfo, err := self.stores.Tokens.FindTokenInfo(token)
+	if err != nil || tokenInfo == nil || tokenInfo.Client != clientInfo.ClientUsername {
+		return false, err
+	}
+	err = self.stores.Tokens.DeleteTokenInfo(tokenInfo.Token, tokenInfo.Client)
+	if err != nil {
+		return false, err
+	}
+	if tokenInfo.RefreshFamily != "" {
+		err = self.stores.RevokeRefreshTokenFamily(tokenInfo.RefreshFamily)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (self *Handler) revokeRefreshToken(clientInfo *client.ClientInfo, token string) (bool, error) {
+	tokenInfo, err := self.stores.RefreshTokens.GetTokenInfo(token)
+	if err != nil || tokenInfo == nil || tokenInfo.Client != clientInfo.ClientUsername {
+		return false, err
+	}
+	err = self.stores.RevokeRefreshTokenFamily(tokenInfo.Family)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
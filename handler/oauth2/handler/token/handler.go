@@ -1,34 +1,66 @@
 package token
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
+	"github.com/MochiKung/account-interface/config"
 	"github.com/MochiKung/account-interface/handler/oauth2"
 	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
 	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/refresh-token"
 	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
 	"github.com/MochiKung/account-interface/handler/oauth2/handler/token/response-writer"
+	"github.com/MochiKung/account-interface/handler/oauth2/jwt"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
 	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+	"github.com/MochiKung/account-interface/handler/oauth2/token-lifetime"
 	"github.com/MochiKung/account-interface/handler/oauth2/verify"
 )
 
 const (
 	PrefixPath = oauth2.PrefixPath + "/token"
-	expiresIn  = 3600
-)
 
-var ()
+	jwtAccessTokenFormat = "jwt"
+)
 
-func init() {
+// LoadSigningKeys (re)loads the jwt signing keys from conf. Keys that stop
+// being active stay published for as long as a token signed by them lives,
+// which is at most the max-access-token lifetime.
+func LoadSigningKeys(conf *config.Root) error {
+	accessTokenConfig := &conf.AccessToken
+	if accessTokenConfig.Format != jwtAccessTokenFormat {
+		return nil
+	}
+	if accessTokenConfig.Issuer == "" || accessTokenConfig.Audience == "" {
+		return errors.New("invalid access-token config: jwt format requires issuer and audience")
+	}
+	policy, err := tokenlifetime.New(conf.TokenLifetime)
+	if err != nil {
+		return err
+	}
+	return jwt.Keys.Load(accessTokenConfig.SigningKeys, policy.MaxAccessToken)
 }
 
+var (
+	grantHandlers = map[string]func(*Handler, *response.ResponseWriter, *http.Request){
+		oauth2.AuthorizationCodeGrant:        (*Handler).serveAuthorizationCode,
+		oauth2.ResourceOwnerCredentialsGrant: (*Handler).serveResourceOwnerCredentials,
+		oauth2.ClientCredentialsGrant:        (*Handler).serveClientCredentials,
+		oauth2.RefreshTokenGrant:             (*Handler).serveRefreshToken,
+	}
+)
+
 type Handler struct {
+	stores *store.Stores
 }
 
-func New() *Handler {
-	self := &Handler{}
+func New(stores *store.Stores) *Handler {
+	self := &Handler{stores: stores}
 	return self
 }
 
@@ -45,18 +77,27 @@ func (self *Handler) ServeHTTP(httpRes http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
-	grantType := req.Form.Get("grant_type")
-	switch grantType {
-	case oauth2.ResourceOwnerCredentialsGrant:
-		serveResourceOwnerCredentials(resp, req)
-	case oauth2.ClientCredentialsGrant:
-		serveClientCredentials(resp, req)
-	default:
+	serveGrant, ok := grantHandlers[req.Form.Get("grant_type")]
+	if !ok {
 		resp.WriteError(&response.UnsupportedGrantTypeError, "")
+		return
+	}
+	serveGrant(self, resp, req)
+}
+
+func (self *Handler) Metadata() map[string]interface{} {
+	grantTypes := make([]string, 0, len(grantHandlers))
+	for grantType := range grantHandlers {
+		grantTypes = append(grantTypes, grantType)
+	}
+	sort.Strings(grantTypes)
+	return map[string]interface{}{
+		"grant_types_supported":                 grantTypes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "none"},
 	}
 }
 
-func serveClientCredentials(resp *response.ResponseWriter, req *http.Request) {
+func (self *Handler) serveClientCredentials(resp *response.ResponseWriter, req *http.Request) {
 	grantType := req.Form.Get("grant_type")
 	scopes := req.Form.Get("scope")
 	username, password, ok := req.BasicAuth()
@@ -65,20 +106,14 @@ func serveClientCredentials(resp *response.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	clientInfo, err := client.GetClientInfo(username)
+	clientInfo, err := self.stores.Clients.GetClientInfo(username)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if clientInfo == nil {
-		resp.WriteError(&response.InvalidClientError, "")
-		return
-	}
-
 	// verify password
-	if !verify.VerifyClientPassword(clientInfo, password) {
-		resp.WriteError(&response.InvalidClientError, "")
+	if !self.verifyClientPassword(resp, req, username, clientInfo, password) {
 		return
 	}
 
@@ -89,33 +124,17 @@ func serveClientCredentials(resp *response.ResponseWriter, req *http.Request) {
 	}
 
 	// verify client grant scope
-	if !verify.VerifyGrantScopes(clientInfo, grantType, scopes) {
+	scopes, ok = verify.VerifyGrantScopes(clientInfo, grantType, scopes)
+	if !ok {
 		resp.WriteError(&response.InvalidScopeError, "")
 		return
 	}
 
 	// generate new token
-	token := stringgenerator.RandomString(8)
-	tokenInfo := &accesstoken.TokenInfo{}
-	tokenInfo.Token = token
-	tokenInfo.Client = username
-	tokenInfo.User = ""
-	tokenInfo.Scopes = scopes
-	expireTime := time.Now().Add(time.Duration(expiresIn) * time.Second)
-	tokenInfo.ExpireTime = &expireTime
-	for err := accesstoken.PutTokenInfo(tokenInfo); err != nil && err.Error() == "duplicate token"; {
-		tokenInfo.Token = stringgenerator.RandomString(8)
-		err = accesstoken.PutTokenInfo(tokenInfo)
-	}
-	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	resp.WriteSuccess(tokenInfo.Token, expiresIn, "", scopes)
+	self.issueAccessToken(resp, username, "", scopes, nil, tokenlifetime.Default.ForClient(clientInfo))
 }
 
-func serveResourceOwnerCredentials(resp *response.ResponseWriter, req *http.Request) {
+func (self *Handler) serveResourceOwnerCredentials(resp *response.ResponseWriter, req *http.Request) {
 	grantType := req.Form.Get("grant_type")
 	username := req.Form.Get("username")
 	password := req.Form.Get("password")
@@ -126,14 +145,14 @@ func serveResourceOwnerCredentials(resp *response.ResponseWriter, req *http.Requ
 		return
 	}
 
-	clientInfo, err := client.GetClientInfo(clientUsername)
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientUsername)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if clientInfo == nil {
-		resp.WriteError(&response.InvalidClientError, "")
+	// verify client password
+	if !self.verifyClientPassword(resp, req, clientUsername, clientInfo, clientPassword) {
 		return
 	}
 
@@ -142,58 +161,401 @@ func serveResourceOwnerCredentials(resp *response.ResponseWriter, req *http.Requ
 		return
 	}
 
-	userInfo, err := user.GetUserInfo(username)
+	// verify resource owner credential
+	userInfo, attempt, ok := self.verifyUserPassword(resp, req, username, password)
+	if !ok {
+		return
+	}
+	defer attempt.Release()
+
+	// verify client grant
+	if clientInfo.GrantResourceOwner == nil {
+		resp.WriteError(&response.UnauthorizedClientError, "")
+		return
+	}
+
+	// verify client grant scope
+	scopes, ok = verify.VerifyGrantScopes(clientInfo, grantType, scopes)
+	if !ok {
+		resp.WriteError(&response.InvalidScopeError, "")
+		return
+	}
+
+	// verify second factor last, a code is spent once accepted
+	if userInfo.MFAEnabled() {
+		otp := req.Form.Get("otp")
+		if otp == "" {
+			resp.WriteError(&response.MFARequiredError, "")
+			return
+		}
+		if !verify.VerifySecondFactor(self.stores.Users, userInfo, otp) {
+			attempt.Fail()
+			resp.WriteError(&response.InvalidGrantError, "the one-time password is invalid")
+			return
+		}
+	}
+	attempt.Succeed()
+
+	// generate new token
+	policy := tokenlifetime.Default.ForClient(clientInfo)
+	self.issueAccessToken(resp, clientUsername, username, scopes, newRefreshToken(scopes, policy), policy)
+}
+
+func (self *Handler) serveAuthorizationCode(resp *response.ResponseWriter, req *http.Request) {
+	code := req.Form.Get("code")
+	redirectURI := req.Form.Get("redirect_uri")
+	codeVerifier := req.Form.Get("code_verifier")
+	clientUsername, clientPassword, ok := req.BasicAuth()
+	if !ok {
+		// public clients identify themselves with client_id only
+		clientUsername = req.Form.Get("client_id")
+		if clientUsername == "" {
+			resp.WriteError(&response.InvalidClientError, "")
+			return
+		}
+	}
+
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientUsername)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if userInfo == nil {
+	// verify client password
+	if ok {
+		if !self.verifyClientPassword(resp, req, clientUsername, clientInfo, clientPassword) {
+			return
+		}
+	} else if clientInfo == nil || !clientInfo.PublicClient || codeVerifier == "" {
+		resp.WriteError(&response.InvalidClientError, "")
+		return
+	}
+
+	// verify client grant
+	if clientInfo.GrantAuthorizationCode == nil {
+		resp.WriteError(&response.UnauthorizedClientError, "")
+		return
+	}
+
+	if code == "" {
+		resp.WriteError(&response.InvalidRequestError, "missing code")
+		return
+	}
+
+	// redeem code, it is removed whether or not the checks below pass
+	codeInfo, err := self.stores.Codes.TakeCodeInfo(code)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if codeInfo == nil || codeInfo.Client != clientUsername || codeInfo.ExpireTime.Before(time.Now()) {
 		resp.WriteError(&response.InvalidGrantError, "")
 		return
 	}
 
+	// redirect uri must match when it was sent with the authorization request
+	if codeInfo.RedirectURI != "" && codeInfo.RedirectURI != redirectURI {
+		resp.WriteError(&response.InvalidGrantError, "")
+		return
+	}
+
+	// verify proof key, required for every code issued with a challenge and
+	// for every code redeemed without client authentication
+	if codeInfo.CodeChallenge != "" || !ok {
+		if codeInfo.CodeChallenge == "" || !verify.VerifyCodeVerifier(codeInfo.CodeChallenge, codeInfo.CodeChallengeMethod, codeVerifier) {
+			resp.WriteError(&response.InvalidGrantError, "")
+			return
+		}
+	}
+
+	if !self.verifyActiveUser(resp, codeInfo.User) {
+		return
+	}
+
+	// generate new token
+	policy := tokenlifetime.Default.ForClient(clientInfo)
+	self.issueAccessToken(resp, clientUsername, codeInfo.User, codeInfo.Scopes, newRefreshToken(codeInfo.Scopes, policy), policy)
+}
+
+func (self *Handler) serveRefreshToken(resp *response.ResponseWriter, req *http.Request) {
+	refreshToken := req.Form.Get("refresh_token")
+	scopes := req.Form.Get("scope")
+	clientUsername, clientPassword, ok := req.BasicAuth()
+	if !ok {
+		// public clients identify themselves with client_id only
+		clientUsername = req.Form.Get("client_id")
+		if clientUsername == "" {
+			resp.WriteError(&response.InvalidClientError, "")
+			return
+		}
+	}
+
+	clientInfo, err := self.stores.Clients.GetClientInfo(clientUsername)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	// verify client password
-	if !verify.VerifyClientPassword(clientInfo, clientPassword) {
+	if ok {
+		if !self.verifyClientPassword(resp, req, clientUsername, clientInfo, clientPassword) {
+			return
+		}
+	} else if clientInfo == nil || !clientInfo.PublicClient {
 		resp.WriteError(&response.InvalidClientError, "")
 		return
 	}
 
-	// verify resource owner credential
-	if !verify.VerifyUserPassword(userInfo, password) {
-		resp.WriteError(&response.InvalidGrantError, "")
+	if refreshToken == "" {
+		resp.WriteError(&response.InvalidRequestError, "missing refresh_token")
 		return
 	}
 
-	// verify client grant
-	if clientInfo.GrantResourceOwner == nil {
+	// refresh tokens issued before they were turned off for the client stop
+	// working with it
+	policy := tokenlifetime.Default.ForClient(clientInfo)
+	if !policy.RefreshTokens {
 		resp.WriteError(&response.UnauthorizedClientError, "")
 		return
 	}
 
-	// verify client grant scope
-	if !verify.VerifyGrantScopes(clientInfo, grantType, scopes) {
+	// only the client the token was issued to may use it up, a token of
+	// another client is refused before it is marked used
+	refreshTokenInfo, err := self.stores.RefreshTokens.GetTokenInfo(refreshToken)
+	if err == nil && refreshTokenInfo != nil && refreshTokenInfo.Client == clientUsername {
+		refreshTokenInfo, err = self.stores.RefreshTokens.UseTokenInfo(refreshToken)
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if refreshTokenInfo == nil || refreshTokenInfo.Client != clientUsername {
+		resp.WriteError(&response.InvalidGrantError, "")
+		return
+	}
+
+	// a rotated refresh token was replayed, assume it leaked and revoke every
+	// token issued from the same grant
+	if refreshTokenInfo.Used {
+		err = self.stores.RevokeRefreshTokenFamily(refreshTokenInfo.Family)
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		resp.WriteError(&response.InvalidGrantError, "")
+		return
+	}
+
+	if refreshTokenInfo.ExpireTime.Before(time.Now()) {
+		resp.WriteError(&response.InvalidGrantError, "")
+		return
+	}
+
+	if refreshTokenInfo.User != "" && !self.verifyActiveUser(resp, refreshTokenInfo.User) {
+		return
+	}
+
+	// verify requested scope is not wider than the original grant
+	if verify.NormalizeScopes(scopes) == "" {
+		scopes = refreshTokenInfo.Scopes
+	} else if !verify.VerifyScopeSubset(refreshTokenInfo.Scopes, scopes) {
 		resp.WriteError(&response.InvalidScopeError, "")
 		return
 	}
 
-	// generate new token
-	token := stringgenerator.RandomString(8)
+	// generate new token, the new refresh token keeps the original scope and
+	// session
+	self.issueAccessToken(resp, clientUsername, refreshTokenInfo.User, scopes, &refreshtoken.TokenInfo{
+		Family:            refreshTokenInfo.Family,
+		Scopes:            refreshTokenInfo.Scopes,
+		SessionExpireTime: refreshTokenInfo.SessionExpireTime,
+	}, policy)
+}
+
+// verifyClientPassword checks the password of a client under the lockout,
+// writing the error response when it fails. An unknown client, a nil
+// clientInfo, fails the same way a wrong password does.
+func (self *Handler) verifyClientPassword(resp *response.ResponseWriter, req *http.Request, clientUsername string, clientInfo *client.ClientInfo, password string) bool {
+	attempt, err := lockout.Default.Check(self.stores.Attempts, req, lockout.ClientKey(clientUsername))
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.WriteLocked(&response.InvalidClientError, locked.RetryAfterSeconds())
+		return false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+	if !verify.VerifyClientPassword(self.stores.Clients, clientInfo, password) {
+		attempt.Fail()
+		resp.WriteError(&response.InvalidClientError, "")
+		return false
+	}
+	attempt.Succeed()
+	return true
+}
+
+// verifyUserPassword checks the password of a user under the lockout,
+// writing the error response when it fails. Unknown usernames count as
+// failures too, so a lockout does not tell which users exist. The failures
+// are only cleared by the caller, once a second factor passed as well, it
+// must end or release the returned attempt.
+func (self *Handler) verifyUserPassword(resp *response.ResponseWriter, req *http.Request, username string, password string) (*user.UserInfo, *lockout.Attempt, bool) {
+	attempt, err := lockout.Default.Check(self.stores.Attempts, req, lockout.UserKey(username))
+	if locked, ok := err.(*lockout.LockedError); ok {
+		resp.WriteLocked(&response.InvalidGrantError, locked.RetryAfterSeconds())
+		return nil, nil, false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return nil, nil, false
+	}
+	userInfo, err := self.stores.Users.GetUserInfo(username)
+	if err != nil {
+		attempt.Release()
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return nil, nil, false
+	}
+	if !verify.VerifyUserPassword(self.stores.Users, userInfo, password) {
+		attempt.Fail()
+		resp.WriteError(&response.InvalidGrantError, "")
+		return nil, nil, false
+	}
+	if !userInfo.Active() {
+		attempt.Release()
+		resp.WriteError(&response.InvalidGrantError, "the account is not active")
+		return nil, nil, false
+	}
+	return userInfo, attempt, true
+}
+
+// verifyActiveUser checks that the user a grant was issued for still exists
+// and may sign in, the account may have been deactivated or removed since.
+func (self *Handler) verifyActiveUser(resp *response.ResponseWriter, username string) bool {
+	userInfo, err := self.stores.Users.GetUserInfo(username)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+	if userInfo == nil || !userInfo.Active() {
+		resp.WriteError(&response.InvalidGrantError, "")
+		return false
+	}
+	return true
+}
+
+// newRefreshToken starts a new family and session, nil when the policy
+// issues no refresh tokens.
+func newRefreshToken(scopes string, policy *tokenlifetime.Policy) *refreshtoken.TokenInfo {
+	if !policy.RefreshTokens {
+		return nil
+	}
+	return &refreshtoken.TokenInfo{
+		Family:            stringgenerator.RandomString(32),
+		Scopes:            scopes,
+		SessionExpireTime: policy.SessionExpireTime(time.Now()),
+	}
+}
+
+// issueAccessToken stores and writes a new access token that lives as long
+// as policy allows. When refreshTokenInfo is not nil a refresh token of its
+// family, scope and session is issued along with it.
+func (self *Handler) issueAccessToken(resp *response.ResponseWriter, clientUsername string, username string, scopes string, refreshTokenInfo *refreshtoken.TokenInfo, policy *tokenlifetime.Policy) {
+	// scopes stored before they were space delimited come out in the same
+	// form as new ones
+	scopes = verify.NormalizeScopes(scopes)
 	tokenInfo := &accesstoken.TokenInfo{}
-	tokenInfo.Token = token
 	tokenInfo.Client = clientUsername
 	tokenInfo.User = username
 	tokenInfo.Scopes = scopes
-	expireTime := time.Now().Add(time.Duration(expiresIn) * time.Second)
+	var sessionExpireTime *time.Time
+	if refreshTokenInfo != nil {
+		tokenInfo.RefreshFamily = refreshTokenInfo.Family
+		refreshTokenInfo.Scopes = verify.NormalizeScopes(refreshTokenInfo.Scopes)
+		sessionExpireTime = refreshTokenInfo.SessionExpireTime
+	}
+	issueTime := time.Now()
+	tokenInfo.IssueTime = &issueTime
+	expireTime := policy.AccessTokenExpireTime(issueTime, sessionExpireTime)
 	tokenInfo.ExpireTime = &expireTime
-	for err := accesstoken.PutTokenInfo(tokenInfo); err != nil && err.Error() == "duplicate token"; {
-		tokenInfo.Token = stringgenerator.RandomString(8)
-		err = accesstoken.PutTokenInfo(tokenInfo)
+	expiresIn := int(expireTime.Sub(issueTime) / time.Second)
+	err := self.newAccessToken(tokenInfo)
+	if err == nil {
+		err = self.stores.Tokens.PutTokenInfo(tokenInfo)
+	}
+	for err != nil && err.Error() == "duplicate token" {
+		err = self.newAccessToken(tokenInfo)
+		if err == nil {
+			err = self.stores.Tokens.PutTokenInfo(tokenInfo)
+		}
 	}
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	resp.WriteSuccess(tokenInfo.Token, expiresIn, "", scopes)
+
+	if refreshTokenInfo == nil {
+		resp.WriteSuccess(tokenInfo.Token, expiresIn, "", scopes)
+		return
+	}
+
+	refreshTokenInfo.Token = stringgenerator.RefreshToken.Generate()
+	refreshTokenInfo.Client = clientUsername
+	refreshTokenInfo.User = username
+	refreshTokenInfo.AccessToken = tokenInfo.Token
+	refreshExpireTime := policy.RefreshTokenExpireTime(issueTime, sessionExpireTime)
+	refreshTokenInfo.ExpireTime = &refreshExpireTime
+	err = self.stores.RefreshTokens.PutTokenInfo(refreshTokenInfo)
+	for err != nil && err.Error() == "duplicate token" {
+		refreshTokenInfo.Token = stringgenerator.RefreshToken.Generate()
+		err = self.stores.RefreshTokens.PutTokenInfo(refreshTokenInfo)
+	}
+	if err != nil {
+		self.stores.Tokens.DeleteTokenInfo(tokenInfo.Token, tokenInfo.Client)
+		resp.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	resp.WriteSuccess(tokenInfo.Token, expiresIn, refreshTokenInfo.Token, scopes)
+}
+
+// newAccessToken sets a fresh token string on tokenInfo, either an opaque
+// random string or a signed jwt depending on the access-token config.
+func (self *Handler) newAccessToken(tokenInfo *accesstoken.TokenInfo) error {
+	signingKey := jwt.Keys.Active()
+	if signingKey == nil {
+		tokenInfo.Token = stringgenerator.AccessToken.Generate()
+		return nil
+	}
+
+	// client credentials tokens have no resource owner, the client is the
+	// subject
+	subject := tokenInfo.User
+	if subject == "" {
+		subject = tokenInfo.Client
+	}
+	token, err := signingKey.SignAccessToken(&jwt.AccessTokenClaims{
+		Issuer:    config.Default.AccessToken.Issuer,
+		Subject:   subject,
+		Audience:  config.Default.AccessToken.Audience,
+		ClientID:  tokenInfo.Client,
+		Scope:     tokenInfo.Scopes,
+		ExpiresAt: tokenInfo.ExpireTime.Unix(),
+		IssuedAt:  tokenInfo.IssueTime.Unix(),
+		ID:        stringgenerator.RandomString(32),
+	})
+	if err != nil {
+		return err
+	}
+	tokenInfo.Token = token
+	return nil
 }
@@ -0,0 +1,360 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/authorization-code"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/refresh-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+)
+
+const (
+	testRedirectURI  = "https://app.example/callback"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ErrorTag     string `json:"error"`
+}
+
+// newTestHandler serves tokens from memory stores holding the public client
+// spa and the active user alice.
+func newTestHandler(t *testing.T) (*Handler, *store.Stores) {
+	stores := store.OpenMemory()
+	err := stores.Clients.PutClientInfo(&client.ClientInfo{
+		ClientUsername:         "spa",
+		PublicClient:           true,
+		GrantAuthorizationCode: map[string]bool{"read": true},
+		RedirectURIAuthorCode:  testRedirectURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Users.PutUserInfo(&user.UserInfo{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(stores), stores
+}
+
+func postToken(handler *Handler, form url.Values) (int, *tokenResponse) {
+	req := httptest.NewRequest("POST", PrefixPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	body := &tokenResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), body)
+	return recorder.Code, body
+}
+
+// putCode stores a code of spa for username, bound to the S256 challenge of
+// testCodeVerifier.
+func putCode(t *testing.T, stores *store.Stores, code string, username string) {
+	sum := sha256.Sum256([]byte(testCodeVerifier))
+	expireTime := time.Now().Add(time.Minute)
+	err := stores.Codes.PutCodeInfo(&authorizationcode.CodeInfo{
+		Code:                code,
+		Client:              "spa",
+		User:                username,
+		RedirectURI:         testRedirectURI,
+		Scopes:              "read",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: oauth2.S256CodeChallengeMethod,
+		ExpireTime:          &expireTime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func redeemCode(handler *Handler, code string) (int, *tokenResponse) {
+	return postToken(handler, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	})
+}
+
+func setUserState(t *testing.T, stores *store.Stores, username string, state string) {
+	userInfo, err := stores.Users.GetUserInfo(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userInfo.State = state
+	err = stores.Users.UpdateUserInfo(userInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizationCodeInactiveUser(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		state      string
+		deleted    bool
+		wantStatus int
+	}{
+		{"active user", user.ActiveState, false, http.StatusOK},
+		{"disabled user", user.DisabledState, false, http.StatusBadRequest},
+		{"pending user", user.PendingState, false, http.StatusBadRequest},
+		{"deleted user", user.ActiveState, true, http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler, stores := newTestHandler(t)
+			putCode(t, stores, "code", "alice")
+			setUserState(t, stores, "alice", test.state)
+			if test.deleted {
+				_, err := stores.DeleteUser("alice", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			status, body := redeemCode(handler, "code")
+			if status != test.wantStatus {
+				t.Fatalf("got status %v, want %v", status, test.wantStatus)
+			}
+			if status != http.StatusOK && body.ErrorTag != "invalid_grant" {
+				t.Errorf("got error %q, want invalid_grant", body.ErrorTag)
+			}
+			if status == http.StatusOK && (body.AccessToken == "" || body.RefreshToken == "") {
+				t.Errorf("got %+v, want an access and a refresh token", body)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenInactiveUser(t *testing.T) {
+	handler, stores := newTestHandler(t)
+	expireTime := time.Now().Add(time.Hour)
+	err := stores.RefreshTokens.PutTokenInfo(&refreshtoken.TokenInfo{Token: "refresh", Client: "spa", User: "alice", Scopes: "read", Family: "family", ExpireTime: &expireTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUserState(t, stores, "alice", user.DisabledState)
+
+	status, body := postToken(handler, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"spa"},
+		"refresh_token": {"refresh"},
+	})
+	if status != http.StatusBadRequest || body.ErrorTag != "invalid_grant" {
+		t.Errorf("got status %v and error %q, want invalid_grant", status, body.ErrorTag)
+	}
+}
+
+func TestAuthorizationCodePublicClientVerifier(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		codeVerifier string
+		wantStatus   int
+		wantError    string
+	}{
+		{"no code_verifier", "", http.StatusUnauthorized, "invalid_client"},
+		{"wrong code_verifier", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXK", http.StatusBadRequest, "invalid_grant"},
+		{"right code_verifier", testCodeVerifier, http.StatusOK, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler, stores := newTestHandler(t)
+			putCode(t, stores, "code", "alice")
+			form := url.Values{
+				"grant_type":   {"authorization_code"},
+				"client_id":    {"spa"},
+				"code":         {"code"},
+				"redirect_uri": {testRedirectURI},
+			}
+			if test.codeVerifier != "" {
+				form.Set("code_verifier", test.codeVerifier)
+			}
+			status, body := postToken(handler, form)
+			if status != test.wantStatus || body.ErrorTag != test.wantError {
+				t.Errorf("got status %v and error %q, want %v and %q", status, body.ErrorTag, test.wantStatus, test.wantError)
+			}
+		})
+	}
+}
+
+func refresh(handler *Handler, clientID string, refreshToken string) (int, *tokenResponse) {
+	return postToken(handler, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	handler, stores := newTestHandler(t)
+	putCode(t, stores, "code", "alice")
+	status, first := redeemCode(handler, "code")
+	if status != http.StatusOK {
+		t.Fatalf("got status %v redeeming the code", status)
+	}
+	status, second := refresh(handler, "spa", first.RefreshToken)
+	if status != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("got status %v and %+v, want a new refresh token", status, second)
+	}
+
+	// the rotated token is replayed, every token of the grant goes
+	status, body := refresh(handler, "spa", first.RefreshToken)
+	if status != http.StatusBadRequest || body.ErrorTag != "invalid_grant" {
+		t.Fatalf("got status %v and error %q replaying, want invalid_grant", status, body.ErrorTag)
+	}
+	for _, token := range []string{first.RefreshToken, second.RefreshToken} {
+		tokenInfo, err := stores.RefreshTokens.GetTokenInfo(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenInfo != nil {
+			t.Errorf("refresh token %v survived the replay", token)
+		}
+	}
+	for _, token := range []string{first.AccessToken, second.AccessToken} {
+		tokenInfo, err := stores.Tokens.FindTokenInfo(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenInfo != nil {
+			t.Errorf("access token %v survived the replay", token)
+		}
+	}
+	status, _ = refresh(handler, "spa", second.RefreshToken)
+	if status != http.StatusBadRequest {
+		t.Errorf("got status %v refreshing with the revoked token, want 400", status)
+	}
+}
+
+func TestRefreshTokenOfAnotherClient(t *testing.T) {
+	handler, stores := newTestHandler(t)
+	err := stores.Clients.PutClientInfo(&client.ClientInfo{
+		ClientUsername:         "other",
+		PublicClient:           true,
+		GrantAuthorizationCode: map[string]bool{"read": true},
+		RedirectURIAuthorCode:  testRedirectURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putCode(t, stores, "code", "alice")
+	status, first := redeemCode(handler, "code")
+	if status != http.StatusOK {
+		t.Fatalf("got status %v redeeming the code", status)
+	}
+
+	status, body := refresh(handler, "other", first.RefreshToken)
+	if status != http.StatusBadRequest || body.ErrorTag != "invalid_grant" {
+		t.Fatalf("got status %v and error %q, want invalid_grant", status, body.ErrorTag)
+	}
+	tokenInfo, err := stores.RefreshTokens.GetTokenInfo(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenInfo == nil || tokenInfo.Used {
+		t.Fatalf("got %+v, want the token unused", tokenInfo)
+	}
+
+	// the owner still gets to use it, the attempt was no replay
+	status, _ = refresh(handler, "spa", first.RefreshToken)
+	if status != http.StatusOK {
+		t.Errorf("got status %v refreshing as the owner, want 200", status)
+	}
+}
+
+func TestResourceOwnerInactiveUser(t *testing.T) {
+	handler, stores := newTestHandler(t)
+	policy, err := lockout.New(&config.Lockout{Threshold: 5, IPThreshold: 50, Delay: "1m", MaxDelay: "1h", Window: "24h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultPolicy := lockout.Default
+	lockout.Default = policy
+	t.Cleanup(func() {
+		lockout.Default = defaultPolicy
+	})
+	clientPassword, err := encrypt.HashPassword([]byte("client secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Clients.PutClientInfo(&client.ClientInfo{
+		ClientUsername:     "backend",
+		EncryptedPassword:  clientPassword,
+		GrantResourceOwner: map[string]bool{"read": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPassword, err := encrypt.HashPassword([]byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Users.UpdatePassword("alice", userPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUserState(t, stores, "alice", user.DisabledState)
+
+	signIn := func(password string) (int, *tokenResponse) {
+		req := httptest.NewRequest("POST", PrefixPath, strings.NewReader(url.Values{
+			"grant_type": {"password"},
+			"username":   {"alice"},
+			"password":   {password},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("backend", "client secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		body := &tokenResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), body)
+		return recorder.Code, body
+	}
+	failures := func() int64 {
+		attemptInfo, err := stores.Attempts.GetAttemptInfo(lockout.UserKey("alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attemptInfo == nil {
+			return 0
+		}
+		return attemptInfo.Failures
+	}
+
+	// the right password of a disabled account is refused but no failure
+	for i := 0; i < 10; i++ {
+		status, body := signIn("right")
+		if status != http.StatusBadRequest || body.ErrorTag != "invalid_grant" {
+			t.Fatalf("got status %v and error %q, want invalid_grant", status, body.ErrorTag)
+		}
+	}
+	if got := failures(); got != 0 {
+		t.Fatalf("got %v failures for the right password, want none", got)
+	}
+	status, _ := signIn("wrong")
+	if status != http.StatusBadRequest {
+		t.Fatalf("got status %v for a wrong password, want 400", status)
+	}
+	if got := failures(); got != 1 {
+		t.Errorf("got %v failures for a wrong password, want 1", got)
+	}
+
+	setUserState(t, stores, "alice", user.ActiveState)
+	status, body := signIn("right")
+	if status != http.StatusOK || body.AccessToken == "" {
+		t.Errorf("got status %v and %+v once active, want a token", status, body)
+	}
+}
@@ -2,8 +2,10 @@ package response
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 type ResponseWriter struct {
@@ -37,6 +39,14 @@ func (self *ResponseWriter) WriteSuccess(accessToken string, expiresIn int, refr
 		RefreshToken: refreshToken,
 		Scope:        scopes,
 	}
+	self.WriteObject(resp)
+}
+
+func (self *ResponseWriter) WriteObject(resp interface{}) {
+	self.WriteObjectStatus(http.StatusOK, resp)
+}
+
+func (self *ResponseWriter) WriteObjectStatus(status int, resp interface{}) {
 	data, err := json.Marshal(resp)
 	if err != nil {
 		self.WriteHeader(http.StatusInternalServerError)
@@ -45,7 +55,7 @@ func (self *ResponseWriter) WriteSuccess(accessToken string, expiresIn int, refr
 		self.Header().Set("Content-Type", "application/json")
 		self.Header().Set("Cache-Control", "no-store")
 		self.Header().Set("Pragma", "no-cache")
-		self.WriteHeader(http.StatusOK)
+		self.WriteHeader(status)
 		self.Write(data)
 	}
 }
@@ -75,6 +85,17 @@ func (self *ResponseWriter) WriteError(resp *errorResponse, description string)
 	}
 }
 
+// WriteLocked refuses a request whose credentials are locked out after too
+// many failures, with the error tag the failed check itself would have.
+func (self *ResponseWriter) WriteLocked(resp *errorResponse, retryAfter int64) {
+	self.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	self.WriteError(&errorResponse{
+		ErrorTag:   resp.ErrorTag,
+		ErrorURI:   resp.ErrorURI,
+		HttpStatus: http.StatusTooManyRequests,
+	}, fmt.Sprintf("too many failed attempts, retry after %v seconds", retryAfter))
+}
+
 var InvalidRequestError errorResponse = errorResponse{
 	ErrorTag:   "invalid_request",
 	HttpStatus: http.StatusBadRequest,
@@ -109,3 +130,43 @@ var InvalidScopeError errorResponse = errorResponse{
 	ErrorDescription: "the request scope is invalid",
 	HttpStatus:       http.StatusBadRequest,
 }
+
+var UnsupportedTokenTypeError errorResponse = errorResponse{
+	ErrorTag:         "unsupported_token_type",
+	ErrorDescription: "the authorization server does not support the revocation of the presented token type",
+	HttpStatus:       http.StatusBadRequest,
+}
+
+var InvalidTokenError errorResponse = errorResponse{
+	ErrorTag:         "invalid_token",
+	ErrorDescription: "the access token provided is expired, revoked, malformed, or invalid",
+	HttpStatus:       http.StatusUnauthorized,
+}
+
+var InvalidRedirectURIError errorResponse = errorResponse{
+	ErrorTag:         "invalid_redirect_uri",
+	ErrorDescription: "the value of one or more redirection URIs is invalid",
+	HttpStatus:       http.StatusBadRequest,
+}
+
+var InvalidClientMetadataError errorResponse = errorResponse{
+	ErrorTag:         "invalid_client_metadata",
+	ErrorDescription: "the value of one of the client metadata fields is invalid",
+	HttpStatus:       http.StatusBadRequest,
+}
+
+// ConflictError answers a write that lost the race against another change of
+// the same record.
+var ConflictError errorResponse = errorResponse{
+	ErrorTag:         "invalid_request",
+	ErrorDescription: "the record was changed by another request, read it again and retry",
+	HttpStatus:       http.StatusConflict,
+}
+
+// MFARequiredError answers a password grant of a user with MFA enabled that
+// did not carry an otp parameter.
+var MFARequiredError errorResponse = errorResponse{
+	ErrorTag:         "mfa_required",
+	ErrorDescription: "the user requires a second factor, repeat the request with an otp parameter",
+	HttpStatus:       http.StatusBadRequest,
+}
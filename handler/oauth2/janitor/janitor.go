@@ -0,0 +1,143 @@
+package janitor
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+)
+
+const (
+	defaultInterval  = 10 * time.Minute
+	defaultBatchSize = 1000
+)
+
+// Janitor periodically deletes expired access tokens, refresh tokens,
+// authorization codes and login attempt counts, and compacts the stores
+// that need it afterwards.
+type Janitor struct {
+	stores    *store.Stores
+	interval  time.Duration
+	batchSize int
+	compact   bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func New(stores *store.Stores, janitorConfig *config.Janitor) (*Janitor, error) {
+	self := &Janitor{
+		stores:    stores,
+		interval:  defaultInterval,
+		batchSize: defaultBatchSize,
+		compact:   janitorConfig.Compact,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if janitorConfig.Interval != "" {
+		interval, err := time.ParseDuration(janitorConfig.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid janitor config: bad interval %v", janitorConfig.Interval)
+		}
+		self.interval = interval
+	}
+	if janitorConfig.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid janitor config: bad batch-size %v", janitorConfig.BatchSize)
+	}
+	if janitorConfig.BatchSize > 0 {
+		self.batchSize = janitorConfig.BatchSize
+	}
+	return self, nil
+}
+
+func (self *Janitor) Start() {
+	go func() {
+		defer close(self.done)
+		ticker := time.NewTicker(self.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-self.stop:
+				return
+			case <-ticker.C:
+				self.Sweep()
+			}
+		}
+	}()
+}
+
+// Stop waits for a running sweep to finish its current batch.
+func (self *Janitor) Stop() {
+	close(self.stop)
+	<-self.done
+}
+
+func (self *Janitor) Sweep() {
+	now := time.Now()
+	sweeps := []struct {
+		name   string
+		delete func(now time.Time, limit int) (int, error)
+	}{
+		{"access tokens", self.stores.Tokens.DeleteExpired},
+		{"refresh tokens", self.stores.RefreshTokens.DeleteExpired},
+		{"authorization codes", self.stores.Codes.DeleteExpired},
+		{"login attempts", self.stores.Attempts.DeleteExpired},
+	}
+	total := 0
+	for _, sweep := range sweeps {
+		deleted, err := self.deleteExpired(now, sweep.delete)
+		if err != nil {
+			log.Printf("janitor failed to delete expired %v: %v\n", sweep.name, err)
+		}
+		if deleted > 0 {
+			log.Printf("janitor deleted %v expired %v\n", deleted, sweep.name)
+		}
+		total += deleted
+	}
+	if self.compact && total > 0 {
+		self.compactStores()
+	}
+}
+
+// deleteExpired works in batches so no single transaction holds the
+// database for long, and gives up early when the janitor is stopped.
+func (self *Janitor) deleteExpired(now time.Time, delete func(now time.Time, limit int) (int, error)) (int, error) {
+	total := 0
+	for {
+		deleted, err := delete(now, self.batchSize)
+		total += deleted
+		if err != nil || deleted < self.batchSize {
+			return total, err
+		}
+		select {
+		case <-self.stop:
+			return total, nil
+		default:
+		}
+	}
+}
+
+func (self *Janitor) compactStores() {
+	candidates := []struct {
+		name  string
+		store interface{}
+	}{
+		{"access tokens", self.stores.Tokens},
+		{"refresh tokens", self.stores.RefreshTokens},
+		{"authorization codes", self.stores.Codes},
+		{"login attempts", self.stores.Attempts},
+	}
+	for _, candidate := range candidates {
+		compactor, ok := candidate.store.(store.Compactor)
+		if !ok {
+			continue
+		}
+		before, after, err := compactor.Compact()
+		if err != nil {
+			log.Printf("janitor failed to compact %v: %v\n", candidate.name, err)
+			continue
+		}
+		log.Printf("janitor compacted %v from %v to %v bytes\n", candidate.name, before, after)
+	}
+}
@@ -0,0 +1,154 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+
+	AccessTokenType = "at+jwt"
+)
+
+type Key struct {
+	Kid        string
+	Algorithm  string
+	State      string
+	RetireTime time.Time
+	Signer     crypto.Signer
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	Kid       string `json:"kid,omitempty"`
+}
+
+// AccessTokenClaims is the RFC 9068 access token profile.
+type AccessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	ID        string `json:"jti"`
+}
+
+func LoadKey(keyConfig *config.SigningKey) (*Key, error) {
+	data, err := os.ReadFile(keyConfig.File)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data in %v", keyConfig.File)
+	}
+
+	var privateKey interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", keyConfig.File, err)
+	}
+
+	key := &Key{
+		Kid:       keyConfig.Kid,
+		Algorithm: keyConfig.Algorithm,
+		State:     keyConfig.State,
+	}
+	if key.State == "" {
+		key.State = ActiveKey
+	}
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm != RS256 {
+			return nil, fmt.Errorf("rsa key %v cannot sign %v", key.Kid, key.Algorithm)
+		}
+		key.Signer = privateKey
+	case *ecdsa.PrivateKey:
+		if key.Algorithm != ES256 || privateKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ecdsa key %v cannot sign %v", key.Kid, key.Algorithm)
+		}
+		key.Signer = privateKey
+	case ed25519.PrivateKey:
+		if key.Algorithm != EdDSA {
+			return nil, fmt.Errorf("ed25519 key %v cannot sign %v", key.Kid, key.Algorithm)
+		}
+		key.Signer = privateKey
+	default:
+		return nil, fmt.Errorf("unsupported key type in %v", keyConfig.File)
+	}
+	return key, nil
+}
+
+func (self *Key) SignAccessToken(claims *AccessTokenClaims) (string, error) {
+	return self.sign(AccessTokenType, claims)
+}
+
+func (self *Key) sign(tokenType string, claims interface{}) (string, error) {
+	headerJSON, err := json.Marshal(&header{
+		Algorithm: self.Algorithm,
+		Type:      tokenType,
+		Kid:       self.Kid,
+	})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	var signature []byte
+	switch self.Algorithm {
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = self.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ES256:
+		// jws wants the raw r || s pair, not the asn.1 encoding
+		digest := sha256.Sum256([]byte(signingInput))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, self.Signer.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case EdDSA:
+		signature, err = self.Signer.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	default:
+		err = errors.New("unsupported signing algorithm")
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,200 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+// writeKey writes a new private key for algorithm in the pem form LoadKey
+// reads, pkcs1 for rsa, sec1 for ecdsa and pkcs8 for ed25519.
+func writeKey(t *testing.T, algorithm string) string {
+	var block *pem.Block
+	switch algorithm {
+	case RS256:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	case ES256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}
+	case EdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: data}
+	}
+	fileName := filepath.Join(t.TempDir(), algorithm+".pem")
+	err := os.WriteFile(fileName, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func decodeSegment(t *testing.T, segment string) []byte {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// verifySignature checks a jws signature with nothing but the published jwk.
+func verifySignature(t *testing.T, jwk *JWK, signingInput string, signature []byte) bool {
+	t.Helper()
+	digest := sha256.Sum256([]byte(signingInput))
+	switch jwk.KeyType {
+	case "RSA":
+		publicKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decodeSegment(t, jwk.N)),
+			E: int(new(big.Int).SetBytes(decodeSegment(t, jwk.E)).Int64()),
+		}
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			t.Fatalf("got curve %v, want P-256", jwk.Curve)
+		}
+		// the raw r || s pair of RFC 7518, 32 bytes each
+		if len(signature) != 64 {
+			t.Fatalf("got a %v byte signature, want 64", len(signature))
+		}
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decodeSegment(t, jwk.X)),
+			Y:     new(big.Int).SetBytes(decodeSegment(t, jwk.Y)),
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			t.Fatalf("got curve %v, want Ed25519", jwk.Curve)
+		}
+		return ed25519.Verify(ed25519.PublicKey(decodeSegment(t, jwk.X)), []byte(signingInput), signature)
+	}
+	t.Fatalf("unknown key type %v", jwk.KeyType)
+	return false
+}
+
+func TestSignAccessToken(t *testing.T) {
+	for _, algorithm := range []string{RS256, ES256, EdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			keySet := &KeySet{}
+			err := keySet.Load([]config.SigningKey{
+				{Kid: "next", Algorithm: algorithm, State: UpcomingKey, File: writeKey(t, algorithm)},
+				{Kid: "current", Algorithm: algorithm, State: ActiveKey, File: writeKey(t, algorithm)},
+			}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jwks, err := keySet.PublicKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			published := make(map[string]*JWK)
+			for _, jwk := range jwks {
+				published[jwk.Kid] = jwk
+			}
+
+			claims := &AccessTokenClaims{
+				Issuer:    "https://issuer.example",
+				Subject:   "alice",
+				Audience:  "https://api.example",
+				ClientID:  "app",
+				Scope:     "read write",
+				ExpiresAt: 1700003600,
+				IssuedAt:  1700000000,
+				ID:        "id",
+			}
+			// an ecdsa r or s with a leading zero byte turns up about once in
+			// 128 signatures, keep signing until one was checked
+			shortSigned := algorithm != ES256
+			for i := 0; i < 3 || !shortSigned; i++ {
+				if i == 5000 {
+					t.Fatal("no signature with a short r or s")
+				}
+				token, err := keySet.Active().SignAccessToken(claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				segments := strings.Split(token, ".")
+				if len(segments) != 3 {
+					t.Fatalf("got %v segments, want 3", len(segments))
+				}
+				tokenHeader := &header{}
+				err = json.Unmarshal(decodeSegment(t, segments[0]), tokenHeader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tokenHeader.Algorithm != algorithm || tokenHeader.Type != AccessTokenType || tokenHeader.Kid != "current" {
+					t.Fatalf("got header %+v, want %v %v signed by current", tokenHeader, algorithm, AccessTokenType)
+				}
+				jwk := published[tokenHeader.Kid]
+				if jwk == nil || jwk.Algorithm != algorithm {
+					t.Fatalf("kid %v is not published for %v in %+v", tokenHeader.Kid, algorithm, jwks)
+				}
+				signature := decodeSegment(t, segments[2])
+				if !verifySignature(t, jwk, segments[0]+"."+segments[1], signature) {
+					t.Fatal("signature does not verify with the published key")
+				}
+				if algorithm == ES256 && (signature[0] == 0 || signature[32] == 0) {
+					shortSigned = true
+				}
+				if verifySignature(t, published["next"], segments[0]+"."+segments[1], signature) {
+					t.Fatal("signature verifies with another key")
+				}
+				decoded := &AccessTokenClaims{}
+				err = json.Unmarshal(decodeSegment(t, segments[1]), decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *decoded != *claims {
+					t.Fatalf("got claims %+v, want %+v", decoded, claims)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadKeyAlgorithmMismatch(t *testing.T) {
+	_, err := LoadKey(&config.SigningKey{Kid: "key", Algorithm: ES256, File: writeKey(t, RS256)})
+	if err == nil {
+		t.Error("loaded an rsa key for ES256")
+	}
+	_, err = LoadKey(&config.SigningKey{Kid: "key", Algorithm: RS256, File: writeKey(t, EdDSA)})
+	if err == nil {
+		t.Error("loaded an ed25519 key for RS256")
+	}
+}
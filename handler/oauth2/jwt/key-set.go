@@ -0,0 +1,180 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+const (
+	UpcomingKey = "upcoming"
+	ActiveKey   = "active"
+	RetiredKey  = "retired"
+)
+
+var (
+	Keys = &KeySet{}
+)
+
+// KeySet holds the signing keys. Only the active key signs, upcoming keys are
+// published ahead of their activation so verifiers already know them, and
+// retired keys stay published until every token they signed has expired.
+type KeySet struct {
+	lock      sync.RWMutex
+	active    *Key
+	keys      map[string]*Key
+	retention time.Duration
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Kid       string `json:"kid"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// Load replaces the keys with keyConfigs. A key that was active before and
+// is now retired or no longer configured is kept for retention, the longest
+// lifetime of a token it may have signed.
+func (self *KeySet) Load(keyConfigs []config.SigningKey, retention time.Duration) error {
+	now := time.Now()
+	keys := make(map[string]*Key)
+	var active *Key
+	for i := range keyConfigs {
+		keyConfig := &keyConfigs[i]
+		if keyConfig.Kid == "" {
+			return errors.New("signing key without kid")
+		}
+		if keys[keyConfig.Kid] != nil {
+			return fmt.Errorf("duplicate signing key %v", keyConfig.Kid)
+		}
+		key, err := LoadKey(keyConfig)
+		if err != nil {
+			return err
+		}
+		switch key.State {
+		case ActiveKey:
+			if active != nil {
+				return fmt.Errorf("signing keys %v and %v are both active", active.Kid, key.Kid)
+			}
+			active = key
+		case UpcomingKey, RetiredKey:
+		default:
+			return fmt.Errorf("signing key %v has invalid state %v", key.Kid, key.State)
+		}
+		keys[key.Kid] = key
+	}
+	if active == nil {
+		return errors.New("no active signing key")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for kid, oldKey := range self.keys {
+		if oldKey.State == UpcomingKey {
+			continue
+		}
+		retireTime := oldKey.RetireTime
+		if oldKey.State == ActiveKey {
+			retireTime = now
+		}
+		key := keys[kid]
+		if key == nil {
+			if now.Before(retireTime.Add(retention)) {
+				keys[kid] = &Key{
+					Kid:        oldKey.Kid,
+					Algorithm:  oldKey.Algorithm,
+					State:      RetiredKey,
+					RetireTime: retireTime,
+					Signer:     oldKey.Signer,
+				}
+			}
+		} else if key.State == RetiredKey {
+			key.RetireTime = retireTime
+		}
+	}
+	for _, key := range keys {
+		if key.State == RetiredKey && key.RetireTime.IsZero() {
+			key.RetireTime = now
+		}
+	}
+
+	self.active = active
+	self.keys = keys
+	self.retention = retention
+	return nil
+}
+
+func (self *KeySet) Active() *Key {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.active
+}
+
+// PublicKeys returns every key a verifier may still meet, sorted by kid.
+func (self *KeySet) PublicKeys() ([]*JWK, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	now := time.Now()
+	jwks := make([]*JWK, 0, len(self.keys))
+	for _, key := range self.keys {
+		if key.State == RetiredKey && !now.Before(key.RetireTime.Add(self.retention)) {
+			continue
+		}
+		jwk, err := key.PublicJWK()
+		if err != nil {
+			return nil, err
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool {
+		return jwks[i].Kid < jwks[j].Kid
+	})
+	return jwks, nil
+}
+
+func (self *Key) PublicJWK() (*JWK, error) {
+	jwk := &JWK{
+		Use:       "sig",
+		Kid:       self.Kid,
+		Algorithm: self.Algorithm,
+	}
+	switch publicKey := self.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		publicKey.X.FillBytes(x)
+		publicKey.Y.FillBytes(y)
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(x)
+		jwk.Y = base64.RawURLEncoding.EncodeToString(y)
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	default:
+		return nil, fmt.Errorf("unsupported key type for %v", self.Kid)
+	}
+	return jwk, nil
+}
@@ -0,0 +1,255 @@
+package lockout
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+)
+
+const (
+	userPrefix   = "user:"
+	clientPrefix = "client:"
+	ipPrefix     = "ip:"
+)
+
+var (
+	// Default is the policy set by Configure, nil when lockout is off
+	Default *Policy
+)
+
+// Configure replaces Default with the policy of lockoutConfig, nil turns
+// lockout off.
+func Configure(lockoutConfig *config.Lockout) error {
+	if lockoutConfig == nil {
+		Default = nil
+		return nil
+	}
+	policy, err := New(lockoutConfig)
+	if err != nil {
+		return fmt.Errorf("invalid lockout config: %v", err)
+	}
+	Default = policy
+	return nil
+}
+
+// LockedError refuses a credential check while its username, client or
+// address is locked out.
+type LockedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (self *LockedError) Error() string {
+	return fmt.Sprintf("%v is locked out for %v", self.Key, self.RetryAfter)
+}
+
+// RetryAfterSeconds rounds up, a client retrying on time is not locked again.
+func (self *LockedError) RetryAfterSeconds() int64 {
+	return int64((self.RetryAfter + time.Second - 1) / time.Second)
+}
+
+type Policy struct {
+	threshold   int64
+	ipThreshold int64
+	delay       time.Duration
+	maxDelay    time.Duration
+	window      time.Duration
+}
+
+func New(lockoutConfig *config.Lockout) (*Policy, error) {
+	self := &Policy{
+		threshold:   int64(lockoutConfig.Threshold),
+		ipThreshold: int64(lockoutConfig.IPThreshold),
+	}
+	if self.threshold <= 0 {
+		return nil, fmt.Errorf("bad threshold %v", lockoutConfig.Threshold)
+	}
+	if self.ipThreshold <= 0 {
+		return nil, fmt.Errorf("bad ip-threshold %v", lockoutConfig.IPThreshold)
+	}
+	var err error
+	for _, duration := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"delay", lockoutConfig.Delay, &self.delay},
+		{"max-delay", lockoutConfig.MaxDelay, &self.maxDelay},
+		{"window", lockoutConfig.Window, &self.window},
+	} {
+		*duration.to, err = time.ParseDuration(duration.value)
+		if err != nil || *duration.to <= 0 {
+			return nil, fmt.Errorf("bad %v %v", duration.name, duration.value)
+		}
+	}
+	if self.maxDelay < self.delay {
+		self.maxDelay = self.delay
+	}
+	// a count must outlive the longest lock it causes
+	if self.window < self.maxDelay {
+		self.window = self.maxDelay
+	}
+	return self, nil
+}
+
+func UserKey(username string) string {
+	return userPrefix + username
+}
+
+func ClientKey(username string) string {
+	return clientPrefix + username
+}
+
+func ipKey(req *http.Request) string {
+	return ipPrefix + oauth2.RemoteIP(req)
+}
+
+// Attempt is a credential check let through by Check. Its failure is counted
+// before the check runs, so checks made in parallel cannot all pass the
+// lockout before the first of them failed. Fail keeps the count, Succeed and
+// Release take it back. A nil Attempt, from a nil Policy, does nothing.
+type Attempt struct {
+	policy       *Policy
+	attempts     store.AttemptStore
+	reservations []reservation
+	done         bool
+}
+
+type reservation struct {
+	key         string
+	failures    int64
+	reserved    time.Time
+	lastFailure time.Time
+}
+
+// Check returns a *LockedError when any of keys or the address of req is
+// locked out, the credentials must not be checked then. Otherwise the caller
+// must end the returned attempt with Fail or Succeed, and Release it when the
+// check was given up.
+func (self *Policy) Check(attempts store.AttemptStore, req *http.Request, keys ...string) (*Attempt, error) {
+	if self == nil {
+		return nil, nil
+	}
+	attempt := &Attempt{policy: self, attempts: attempts}
+	now := time.Now()
+	for _, key := range append(append([]string(nil), keys...), ipKey(req)) {
+		err := attempt.reserve(key, now)
+		if err != nil {
+			attempt.Release()
+			return nil, err
+		}
+	}
+	return attempt, nil
+}
+
+// reserve counts a failure of key unless key is locked out or the checks
+// racing this one already took what was left before the threshold.
+func (self *Attempt) reserve(key string, now time.Time) error {
+	attemptInfo, err := self.attempts.GetAttemptInfo(key)
+	if err != nil {
+		return err
+	}
+	failures := int64(0)
+	lastFailure := now
+	if attemptInfo != nil && attemptInfo.ExpireTime.After(now) {
+		failures = attemptInfo.Failures
+		lastFailure = *attemptInfo.LastFailure
+		// a racing check may have counted a failure a moment after now
+		lockTime := self.policy.lockTime(key, failures)
+		if lockedUntil := lastFailure.Add(lockTime); lockTime > 0 && lockedUntil.After(now) {
+			return &LockedError{Key: key, RetryAfter: lockedUntil.Sub(now)}
+		}
+	}
+	attemptInfo, err = self.attempts.AddFailure(key, now, now.Add(self.policy.window))
+	if err != nil {
+		return err
+	}
+	self.reservations = append(self.reservations, reservation{
+		key:         key,
+		failures:    attemptInfo.Failures,
+		reserved:    now,
+		lastFailure: lastFailure,
+	})
+	if attemptInfo.Failures != failures+1 {
+		if lockTime := self.policy.lockTime(key, attemptInfo.Failures-1); lockTime > 0 {
+			return &LockedError{Key: key, RetryAfter: lockTime}
+		}
+	}
+	return nil
+}
+
+// Fail leaves the failure counted.
+func (self *Attempt) Fail() {
+	if self == nil || self.done {
+		return
+	}
+	self.done = true
+	for _, reservation := range self.reservations {
+		if lockTime := self.policy.lockTime(reservation.key, reservation.failures); lockTime > 0 {
+			log.Printf("locked out %v for %v after %v failed attempts\n", reservation.key, lockTime, reservation.failures)
+		}
+	}
+}
+
+// Succeed forgets the failures of the keys after a successful sign in. The
+// address only gets its count back, one known account must not unlock
+// guessing at others.
+func (self *Attempt) Succeed() {
+	if self == nil || self.done {
+		return
+	}
+	self.done = true
+	for _, reservation := range self.reservations {
+		var err error
+		if strings.HasPrefix(reservation.key, ipPrefix) {
+			err = self.attempts.RemoveFailure(reservation.key, reservation.reserved, reservation.lastFailure)
+		} else {
+			err = self.attempts.DeleteAttemptInfo(reservation.key)
+		}
+		if err != nil {
+			log.Printf("failed to clear failed attempts of %v: %v\n", reservation.key, err)
+		}
+	}
+}
+
+// Release takes the count back from a check that neither failed nor
+// succeeded, such as one still waiting for a second factor. After Fail or
+// Succeed it does nothing, so it can be deferred.
+func (self *Attempt) Release() {
+	if self == nil || self.done {
+		return
+	}
+	self.done = true
+	for _, reservation := range self.reservations {
+		err := self.attempts.RemoveFailure(reservation.key, reservation.reserved, reservation.lastFailure)
+		if err != nil {
+			log.Printf("failed to release attempt of %v: %v\n", reservation.key, err)
+		}
+	}
+}
+
+// lockTime is how long failures locks key after its last failure, delay at
+// the threshold and doubling from there.
+func (self *Policy) lockTime(key string, failures int64) time.Duration {
+	threshold := self.threshold
+	if strings.HasPrefix(key, ipPrefix) {
+		threshold = self.ipThreshold
+	}
+	if failures < threshold {
+		return 0
+	}
+	lockTime := self.delay
+	for i := threshold; i < failures && lockTime < self.maxDelay; i++ {
+		lockTime *= 2
+	}
+	if lockTime > self.maxDelay {
+		return self.maxDelay
+	}
+	return lockTime
+}
@@ -0,0 +1,140 @@
+package lockout
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/login-attempt"
+)
+
+func newTestPolicy(t *testing.T) *Policy {
+	policy, err := New(&config.Lockout{Threshold: 5, IPThreshold: 50, Delay: "1m", MaxDelay: "1h", Window: "24h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func newTestRequest() *http.Request {
+	return &http.Request{RemoteAddr: "198.51.100.7:5000", Header: http.Header{}}
+}
+
+func failures(t *testing.T, attempts *loginattempt.MemoryStore, key string) int64 {
+	attemptInfo, err := attempts.GetAttemptInfo(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attemptInfo == nil {
+		return 0
+	}
+	return attemptInfo.Failures
+}
+
+// barrierStore holds every check after its read of key until all checks have
+// read it, the worst case of checks racing each other.
+type barrierStore struct {
+	*loginattempt.MemoryStore
+	key     string
+	barrier sync.WaitGroup
+}
+
+func (self *barrierStore) GetAttemptInfo(key string) (*loginattempt.AttemptInfo, error) {
+	attemptInfo, err := self.MemoryStore.GetAttemptInfo(key)
+	if key == self.key {
+		self.barrier.Done()
+		self.barrier.Wait()
+	}
+	return attemptInfo, err
+}
+
+// Checks made in parallel must not all pass before the first one fails.
+func TestCheckInParallel(t *testing.T) {
+	const checks = 40
+	policy := newTestPolicy(t)
+	attempts := &barrierStore{MemoryStore: loginattempt.NewMemoryStore(), key: UserKey("alice")}
+	attempts.barrier.Add(checks)
+	var mutex sync.Mutex
+	var admitted []*Attempt
+	var wait sync.WaitGroup
+	for i := 0; i < checks; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			attempt, err := policy.Check(attempts, newTestRequest(), UserKey("alice"))
+			if _, ok := err.(*LockedError); ok {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			admitted = append(admitted, attempt)
+			mutex.Unlock()
+		}()
+	}
+	wait.Wait()
+	if len(admitted) != 5 {
+		t.Fatalf("admitted %v checks, want 5", len(admitted))
+	}
+	for _, attempt := range admitted {
+		attempt.Fail()
+	}
+	if got := failures(t, attempts.MemoryStore, UserKey("alice")); got != 5 {
+		t.Errorf("counted %v failures, want 5", got)
+	}
+	attempts.key = ""
+	if _, err := policy.Check(attempts, newTestRequest(), UserKey("alice")); err == nil {
+		t.Errorf("not locked out after the threshold")
+	}
+}
+
+func TestAttemptOutcomes(t *testing.T) {
+	policy := newTestPolicy(t)
+	attempts := loginattempt.NewMemoryStore()
+	ipKey := ipKey(newTestRequest())
+	check := func() *Attempt {
+		t.Helper()
+		attempt, err := policy.Check(attempts, newTestRequest(), UserKey("alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attempt
+	}
+
+	check().Fail()
+	check().Fail()
+	if got := failures(t, attempts, UserKey("alice")); got != 2 {
+		t.Errorf("counted %v failures, want 2", got)
+	}
+
+	// a check given up, waiting for a second factor, counts for nothing
+	attempt := check()
+	attempt.Release()
+	attempt.Fail()
+	if got := failures(t, attempts, UserKey("alice")); got != 2 {
+		t.Errorf("counted %v failures after a release, want 2", got)
+	}
+
+	// success forgets the user, the address only gets its own count back
+	check().Succeed()
+	if got := failures(t, attempts, UserKey("alice")); got != 0 {
+		t.Errorf("counted %v failures after success, want none", got)
+	}
+	if got := failures(t, attempts, ipKey); got != 2 {
+		t.Errorf("address counted %v failures after success, want 2", got)
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var policy *Policy
+	attempt, err := policy.Check(loginattempt.NewMemoryStore(), newTestRequest(), UserKey("alice"))
+	if attempt != nil || err != nil {
+		t.Fatalf("got %v, %v", attempt, err)
+	}
+	attempt.Fail()
+	attempt.Succeed()
+	attempt.Release()
+}
@@ -2,6 +2,20 @@ package oauth2
 
 const (
 	PrefixPath                    = "/oauth2"
+	AuthorizationCodeGrant        = "authorization_code"
 	ClientCredentialsGrant        = "client_credentials"
 	ResourceOwnerCredentialsGrant = "password"
+	RefreshTokenGrant             = "refresh_token"
+)
+
+const (
+	PlainCodeChallengeMethod = "plain"
+	S256CodeChallengeMethod  = "S256"
+)
+
+const (
+	// AdminScope on an access token grants the admin API
+	AdminScope = "admin"
+	// AccountScope lets a token manage the account of its user
+	AccountScope = "account"
 )
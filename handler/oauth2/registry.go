@@ -0,0 +1,58 @@
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+var (
+	endpointsLock sync.RWMutex
+	endpoints     []*Endpoint
+)
+
+// Endpoint is a registered request handler. MetadataName is the
+// authorization server metadata (RFC 8414) field the endpoint url is
+// published as, empty for endpoints that are not advertised.
+type Endpoint struct {
+	Path         string
+	MetadataName string
+	Handler      http.Handler
+}
+
+// MetadataProvider is implemented by handlers that add their capabilities,
+// such as supported grant types, to the server metadata.
+type MetadataProvider interface {
+	Metadata() map[string]interface{}
+}
+
+func Register(path string, metadataName string, handler http.Handler) {
+	endpointsLock.Lock()
+	defer endpointsLock.Unlock()
+	endpoints = append(endpoints, &Endpoint{
+		Path:         path,
+		MetadataName: metadataName,
+		Handler:      handler,
+	})
+}
+
+func Endpoints() []*Endpoint {
+	endpointsLock.RLock()
+	defer endpointsLock.RUnlock()
+	return append([]*Endpoint(nil), endpoints...)
+}
+
+// Issuer returns the configured issuer, or the url the request was made to
+// when none is configured. Endpoint urls are built on it.
+func Issuer(req *http.Request) string {
+	if config.Default.AccessToken.Issuer != "" {
+		return strings.TrimSuffix(config.Default.AccessToken.Issuer, "/")
+	}
+	scheme := "https"
+	if req.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + req.Host
+}
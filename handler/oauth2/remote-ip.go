@@ -0,0 +1,97 @@
+package oauth2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/MochiKung/account-interface/config"
+)
+
+var (
+	trustedProxies []*net.IPNet
+)
+
+// ConfigureTrustedProxies sets the proxies whose X-Forwarded-For RemoteIP
+// believes, from the server config.
+func ConfigureTrustedProxies(serverConfig *config.Server) error {
+	if serverConfig == nil {
+		trustedProxies = nil
+		return nil
+	}
+	proxies, err := parseTrustedProxies(serverConfig.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted-proxies config: %v", err)
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+// parseTrustedProxies reads space separated addresses and CIDR ranges.
+func parseTrustedProxies(proxies string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range strings.Fields(proxies) {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %v", proxy)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad range %v", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// RemoteIP returns the address the request came from, without the port. A
+// request from a trusted proxy comes from the last address in its
+// X-Forwarded-For that is not a trusted proxy itself, earlier ones are up to
+// the client to make up.
+func RemoteIP(req *http.Request) string {
+	return remoteIP(req, trustedProxies)
+}
+
+func remoteIP(req *http.Request, proxies []*net.IPNet) string {
+	address, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		address = req.RemoteAddr
+	}
+	if !trusted(address, proxies) {
+		return address
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		address = hop
+		if !trusted(address, proxies) {
+			break
+		}
+	}
+	return address
+}
+
+func trusted(address string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package oauth2
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8 192.0.2.1 ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "198.51.100.7:5000", nil, "198.51.100.7"},
+		{"untrusted peer cannot forward", "198.51.100.7:5000", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"trusted proxy", "192.0.2.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"chain of proxies", "10.1.1.1:5000", []string{"203.0.113.9, 10.2.2.2"}, "203.0.113.9"},
+		{"header lines", "[::1]:5000", []string{"203.0.113.9", "10.2.2.2"}, "203.0.113.9"},
+		{"forged hops before the client", "192.0.2.1:5000", []string{"10.9.9.9, 203.0.113.9"}, "203.0.113.9"},
+		{"garbage hop", "192.0.2.1:5000", []string{"203.0.113.9, bogus"}, "192.0.2.1"},
+		{"proxy without header", "192.0.2.1:5000", nil, "192.0.2.1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, forwarded := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := remoteIP(req, proxies); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"nope", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
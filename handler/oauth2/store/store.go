@@ -0,0 +1,368 @@
+package store
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/authorization-code"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/login-attempt"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/redis"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/refresh-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+)
+
+type ClientStore interface {
+	GetClientInfo(username string) (*client.ClientInfo, error)
+	ListClientInfo() ([]*client.ClientInfo, error)
+	PutClientInfo(clientInfo *client.ClientInfo) error
+	UpdateClientInfo(clientInfo *client.ClientInfo) error
+	DeleteClientInfo(username string, version int64) error
+	UpdatePassword(username string, encryptedPassword []byte, salt []byte) error
+	Close() error
+}
+
+type UserStore interface {
+	GetUserInfo(username string) (*user.UserInfo, error)
+	ListUserInfo() ([]*user.UserInfo, error)
+	PutUserInfo(userInfo *user.UserInfo) error
+	UpdateUserInfo(userInfo *user.UserInfo) error
+	DeleteUserInfo(username string, version int64) error
+	UpdatePassword(username string, encryptedPassword []byte, salt []byte) error
+	Close() error
+}
+
+// TokenStore keeps access tokens. GetTokenInfo is the cheap lookup when the
+// client is known, FindTokenInfo works from the token alone. RevokeClient and
+// RevokeUser delete every token of a client or user without listing the
+// others, and return the deleted tokens.
+type TokenStore interface {
+	GetTokenInfo(token string, client string) (*accesstoken.TokenInfo, error)
+	FindTokenInfo(token string) (*accesstoken.TokenInfo, error)
+	ListTokenInfo() ([]*accesstoken.TokenInfo, error)
+	PutTokenInfo(tokenInfo *accesstoken.TokenInfo) error
+	DeleteTokenInfo(token string, client string) error
+	RevokeClient(client string) ([]*accesstoken.TokenInfo, error)
+	RevokeUser(user string) ([]*accesstoken.TokenInfo, error)
+	DeleteExpired(now time.Time, limit int) (int, error)
+	Close() error
+}
+
+type RefreshTokenStore interface {
+	GetTokenInfo(token string) (*refreshtoken.TokenInfo, error)
+	ListTokenInfo() ([]*refreshtoken.TokenInfo, error)
+	PutTokenInfo(tokenInfo *refreshtoken.TokenInfo) error
+	UseTokenInfo(token string) (*refreshtoken.TokenInfo, error)
+	DeleteFamily(family string) ([]*refreshtoken.TokenInfo, error)
+	DeleteExpired(now time.Time, limit int) (int, error)
+	Close() error
+}
+
+type CodeStore interface {
+	GetCodeInfo(code string) (*authorizationcode.CodeInfo, error)
+	PutCodeInfo(codeInfo *authorizationcode.CodeInfo) error
+	TakeCodeInfo(code string) (*authorizationcode.CodeInfo, error)
+	DeleteExpired(now time.Time, limit int) (int, error)
+	Close() error
+}
+
+// AttemptStore counts failed credential checks for the lockout. AddFailure
+// must count atomically, concurrent failures all add up. RemoveFailure takes
+// back a failure added at reserved, just as atomically.
+type AttemptStore interface {
+	GetAttemptInfo(key string) (*loginattempt.AttemptInfo, error)
+	AddFailure(key string, now time.Time, expireTime time.Time) (*loginattempt.AttemptInfo, error)
+	RemoveFailure(key string, reserved time.Time, lastFailure time.Time) error
+	DeleteAttemptInfo(key string) error
+	DeleteExpired(now time.Time, limit int) (int, error)
+	Close() error
+}
+
+// Compactor is implemented by stores whose files do not shrink by
+// themselves, the bolt token stores.
+type Compactor interface {
+	Compact() (before int64, after int64, err error)
+}
+
+type Stores struct {
+	Clients       ClientStore
+	Users         UserStore
+	Tokens        TokenStore
+	RefreshTokens RefreshTokenStore
+	Codes         CodeStore
+	Attempts      AttemptStore
+
+	// resources shared between stores, closed after them
+	closers []io.Closer
+}
+
+func Open(databaseConfig *config.Database) (*Stores, error) {
+	var stores *Stores
+	var err error
+	switch {
+	case databaseConfig.Memory != nil:
+		stores = OpenMemory()
+	case databaseConfig.SQL != nil:
+		stores, err = OpenSQL(databaseConfig.SQL)
+	default:
+		stores, err = OpenBolt(&databaseConfig.BoltDB)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if databaseConfig.Redis != nil {
+		err = stores.useRedisTokens(databaseConfig.Redis)
+		if err != nil {
+			stores.Close()
+			return nil, err
+		}
+	}
+	return stores, nil
+}
+
+// OpenMemory returns empty stores that live only as long as the process.
+func OpenMemory() *Stores {
+	return &Stores{
+		Clients:       client.NewMemoryStore(),
+		Users:         user.NewMemoryStore(),
+		Tokens:        accesstoken.NewMemoryStore(),
+		RefreshTokens: refreshtoken.NewMemoryStore(),
+		Codes:         authorizationcode.NewMemoryStore(),
+		Attempts:      loginattempt.NewMemoryStore(),
+	}
+}
+
+// OpenSQL brings the schema up to date before returning, every store shares
+// the one connection pool.
+func OpenSQL(sqlConfig *config.SQL) (*Stores, error) {
+	db, err := database.OpenSQL(sqlConfig.Driver, sqlConfig.DataSource)
+	if err != nil {
+		return nil, err
+	}
+	if sqlConfig.MaxOpenConnections > 0 && db.Driver != database.SQLiteDriver {
+		db.SetMaxOpenConns(sqlConfig.MaxOpenConnections)
+	}
+	err = db.Migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Stores{
+		Clients:       client.NewSQLStore(db),
+		Users:         user.NewSQLStore(db),
+		Tokens:        accesstoken.NewSQLStore(db),
+		RefreshTokens: refreshtoken.NewSQLStore(db),
+		Codes:         authorizationcode.NewSQLStore(db),
+		Attempts:      loginattempt.NewSQLStore(db),
+		closers:       []io.Closer{db},
+	}, nil
+}
+
+// useRedisTokens replaces the access token store with one on redis.
+func (self *Stores) useRedisTokens(redisConfig *config.Redis) error {
+	redisClient, err := redis.Dial(redisConfig.Address, redisConfig.Password, redisConfig.DB, redisConfig.PoolSize)
+	if err != nil {
+		return err
+	}
+	err = self.Tokens.Close()
+	self.Tokens = accesstoken.NewRedisStore(redisClient, redisConfig.KeyPrefix)
+	return err
+}
+
+func OpenBolt(boltConfig *config.BoltDB) (*Stores, error) {
+	stores := &Stores{}
+	clientStore, err := client.OpenBoltStore(boltConfig.ClientDB)
+	if err != nil {
+		return nil, err
+	}
+	stores.Clients = clientStore
+	userStore, err := user.OpenBoltStore(boltConfig.UserDB)
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
+	stores.Users = userStore
+	tokenStore, err := accesstoken.OpenBoltStore(boltConfig.AccessTokenDB)
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
+	stores.Tokens = tokenStore
+	refreshTokenStore, err := refreshtoken.OpenBoltStore(boltConfig.RefreshTokenDB)
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
+	stores.RefreshTokens = refreshTokenStore
+	codeStore, err := authorizationcode.OpenBoltStore(boltConfig.AuthorizationCodeDB)
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
+	stores.Codes = codeStore
+	attemptDB := boltConfig.LoginAttemptDB
+	if attemptDB == "" {
+		// configs from before the lockout keep the counts next to the users
+		attemptDB = filepath.Join(filepath.Dir(boltConfig.UserDB), "login-attempt.db")
+	}
+	attemptStore, err := loginattempt.OpenBoltStore(attemptDB)
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
+	stores.Attempts = attemptStore
+	return stores, nil
+}
+
+func (self *Stores) Close() error {
+	var firstErr error
+	for _, closer := range []interface {
+		Close() error
+	}{self.Clients, self.Users, self.Tokens, self.RefreshTokens, self.Codes, self.Attempts} {
+		if closer == nil {
+			continue
+		}
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, closer := range self.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RevokeRefreshTokenFamily deletes every refresh token of the family together
+// with the access tokens issued from them.
+func (self *Stores) RevokeRefreshTokenFamily(family string) error {
+	_, err := self.revokeRefreshTokenFamily(family)
+	return err
+}
+
+func (self *Stores) revokeRefreshTokenFamily(family string) (int, error) {
+	tokenInfos, err := self.RefreshTokens.DeleteFamily(family)
+	if err != nil {
+		return 0, err
+	}
+	for _, tokenInfo := range tokenInfos {
+		if tokenInfo.AccessToken == "" {
+			continue
+		}
+		err = self.Tokens.DeleteTokenInfo(tokenInfo.AccessToken, tokenInfo.Client)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(tokenInfos), nil
+}
+
+// RevokeTokens deletes every access token and refresh token whose client and
+// user match accepts, taking down whole refresh token families. It returns
+// how many tokens it deleted. It lists every access token, RevokeClientTokens
+// and RevokeUserTokens are the cheap way to revoke a whole client or user.
+func (self *Stores) RevokeTokens(match func(client string, user string) bool) (int, error) {
+	revoked := 0
+	families := make(map[string]bool)
+	tokenInfos, err := self.Tokens.ListTokenInfo()
+	if err != nil {
+		return 0, err
+	}
+	for _, tokenInfo := range tokenInfos {
+		if !match(tokenInfo.Client, tokenInfo.User) {
+			continue
+		}
+		if tokenInfo.RefreshFamily != "" {
+			families[tokenInfo.RefreshFamily] = true
+		}
+		err = self.Tokens.DeleteTokenInfo(tokenInfo.Token, tokenInfo.Client)
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return self.revokeRefreshTokens(revoked, families, match)
+}
+
+// RevokeClientTokens revokes every token issued to the client like
+// RevokeTokens, finding the access tokens through the store index.
+func (self *Stores) RevokeClientTokens(username string) (int, error) {
+	tokenInfos, err := self.Tokens.RevokeClient(username)
+	if err != nil {
+		return 0, err
+	}
+	return self.revokeRefreshTokens(len(tokenInfos), accessTokenFamilies(tokenInfos), func(client string, _ string) bool {
+		return client == username
+	})
+}
+
+// RevokeUserTokens revokes every token issued for the user, whatever the
+// client.
+func (self *Stores) RevokeUserTokens(username string) (int, error) {
+	tokenInfos, err := self.Tokens.RevokeUser(username)
+	if err != nil {
+		return 0, err
+	}
+	return self.revokeRefreshTokens(len(tokenInfos), accessTokenFamilies(tokenInfos), func(_ string, user string) bool {
+		return user == username
+	})
+}
+
+func accessTokenFamilies(tokenInfos []*accesstoken.TokenInfo) map[string]bool {
+	families := make(map[string]bool)
+	for _, tokenInfo := range tokenInfos {
+		if tokenInfo.RefreshFamily != "" {
+			families[tokenInfo.RefreshFamily] = true
+		}
+	}
+	return families
+}
+
+// revokeRefreshTokens deletes the families and those of the refresh tokens
+// match accepts, adding the deleted tokens to revoked.
+func (self *Stores) revokeRefreshTokens(revoked int, families map[string]bool, match func(client string, user string) bool) (int, error) {
+	// refresh tokens can outlive every access token issued from them
+	refreshTokenInfos, err := self.RefreshTokens.ListTokenInfo()
+	if err != nil {
+		return revoked, err
+	}
+	for _, tokenInfo := range refreshTokenInfos {
+		if match(tokenInfo.Client, tokenInfo.User) {
+			families[tokenInfo.Family] = true
+		}
+	}
+	for family := range families {
+		deleted, err := self.revokeRefreshTokenFamily(family)
+		if err != nil {
+			return revoked, err
+		}
+		revoked += deleted
+	}
+	return revoked, nil
+}
+
+// DeleteClient deletes the client if it is still at version, 0 for any
+// version, then revokes every token issued to it. The client goes first so
+// no new token can be issued to it in between.
+func (self *Stores) DeleteClient(username string, version int64) (int, error) {
+	err := self.Clients.DeleteClientInfo(username, version)
+	if err != nil {
+		return 0, err
+	}
+	return self.RevokeClientTokens(username)
+}
+
+// DeleteUser deletes the user like DeleteClient deletes a client and revokes
+// every token issued for the user.
+func (self *Stores) DeleteUser(username string, version int64) (int, error) {
+	err := self.Users.DeleteUserInfo(username, version)
+	if err != nil {
+		return 0, err
+	}
+	return self.RevokeUserTokens(username)
+}
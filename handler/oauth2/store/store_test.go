@@ -0,0 +1,442 @@
+package store
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/authorization-code"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/refresh-token"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+)
+
+// backends opens every store implementation on fresh storage, the contract
+// tests run against each of them.
+var backends = []struct {
+	name string
+	open func(t *testing.T) (*Stores, error)
+}{
+	{"memory", func(t *testing.T) (*Stores, error) {
+		return OpenMemory(), nil
+	}},
+	{"bolt", func(t *testing.T) (*Stores, error) {
+		dir := t.TempDir()
+		return OpenBolt(&config.BoltDB{
+			ClientDB:            filepath.Join(dir, "client.db"),
+			UserDB:              filepath.Join(dir, "user.db"),
+			AccessTokenDB:       filepath.Join(dir, "access-token.db"),
+			RefreshTokenDB:      filepath.Join(dir, "refresh-token.db"),
+			AuthorizationCodeDB: filepath.Join(dir, "authorization-code.db"),
+			LoginAttemptDB:      filepath.Join(dir, "login-attempt.db"),
+		})
+	}},
+	{"sqlite", func(t *testing.T) (*Stores, error) {
+		return OpenSQL(&config.SQL{Driver: "sqlite", DataSource: filepath.Join(t.TempDir(), "oauth2.db")})
+	}},
+}
+
+var contracts = []struct {
+	name string
+	test func(t *testing.T, stores *Stores)
+}{
+	{"client versions", testClientVersions},
+	{"user versions", testUserVersions},
+	{"access tokens", testAccessTokens},
+	{"refresh token use", testRefreshTokenUse},
+	{"refresh token family", testRefreshTokenFamily},
+	{"authorization code", testAuthorizationCode},
+	{"login attempts", testLoginAttempts},
+	{"delete user", testDeleteUser},
+}
+
+func TestStores(t *testing.T) {
+	for _, backend := range backends {
+		for _, contract := range contracts {
+			t.Run(backend.name+"/"+contract.name, func(t *testing.T) {
+				stores, err := backend.open(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stores.Close()
+				contract.test(t, stores)
+			})
+		}
+	}
+}
+
+func wantError(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func testClientVersions(t *testing.T, stores *Stores) {
+	clientInfo := &client.ClientInfo{ClientUsername: "app", ClientName: "App"}
+	err := stores.Clients.PutClientInfo(clientInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.Clients.PutClientInfo(&client.ClientInfo{ClientUsername: "app"}), "duplicate client username")
+
+	stale, err := stores.Clients.GetClientInfo("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale == nil || stale.Version != 1 || stale.ClientName != "App" {
+		t.Fatalf("got %+v, want App at version 1", stale)
+	}
+	current, err := stores.Clients.GetClientInfo("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.ClientName = "Renamed"
+	err = stores.Clients.UpdateClientInfo(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != 2 {
+		t.Errorf("got version %v after update, want 2", current.Version)
+	}
+	stale.ClientName = "Lost"
+	wantError(t, stores.Clients.UpdateClientInfo(stale), "client version conflict")
+	wantError(t, stores.Clients.DeleteClientInfo("app", 1), "client version conflict")
+
+	stored, err := stores.Clients.GetClientInfo("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != 2 || stored.ClientName != "Renamed" {
+		t.Errorf("got %v at version %v, want Renamed at version 2", stored.ClientName, stored.Version)
+	}
+
+	err = stores.Clients.UpdatePassword("app", []byte("password"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.Clients.DeleteClientInfo("app", 2), "client version conflict")
+	err = stores.Clients.DeleteClientInfo("app", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = stores.Clients.GetClientInfo("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Errorf("got %+v after delete, want none", stored)
+	}
+	wantError(t, stores.Clients.UpdateClientInfo(current), "client not exist")
+	wantError(t, stores.Clients.DeleteClientInfo("app", 0), "client not exist")
+	wantError(t, stores.Clients.UpdatePassword("app", []byte("password"), nil), "client not exist")
+}
+
+func testUserVersions(t *testing.T, stores *Stores) {
+	err := stores.Users.PutUserInfo(&user.UserInfo{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.Users.PutUserInfo(&user.UserInfo{Username: "alice"}), "duplicate user")
+
+	stale, err := stores.Users.GetUserInfo("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale == nil || stale.Version != 1 {
+		t.Fatalf("got %+v, want version 1", stale)
+	}
+	current, err := stores.Users.GetUserInfo("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Users.UpdateUserInfo(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != 2 {
+		t.Errorf("got version %v after update, want 2", current.Version)
+	}
+	wantError(t, stores.Users.UpdateUserInfo(stale), "user version conflict")
+	wantError(t, stores.Users.DeleteUserInfo("alice", 1), "user version conflict")
+
+	err = stores.Users.UpdatePassword("alice", []byte("password"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := stores.Users.GetUserInfo("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != 3 || string(stored.EncryptedPassword) != "password" {
+		t.Errorf("got password %q at version %v, want the new one at version 3", stored.EncryptedPassword, stored.Version)
+	}
+	err = stores.Users.DeleteUserInfo("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.Users.UpdateUserInfo(stored), "user not exist")
+	wantError(t, stores.Users.DeleteUserInfo("alice", 3), "user not exist")
+	wantError(t, stores.Users.UpdatePassword("alice", []byte("password"), nil), "user not exist")
+}
+
+func testAccessTokens(t *testing.T, stores *Stores) {
+	expireTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, tokenInfo := range []*accesstoken.TokenInfo{
+		{Token: "a1", Client: "app", User: "alice", ExpireTime: &expireTime},
+		{Token: "a2", Client: "app", User: "bob", ExpireTime: &expireTime},
+		{Token: "a3", Client: "other", User: "alice", ExpireTime: &expireTime},
+		{Token: "a4", Client: "other", User: "bob", ExpireTime: &expireTime},
+	} {
+		err := stores.Tokens.PutTokenInfo(tokenInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantError(t, stores.Tokens.PutTokenInfo(&accesstoken.TokenInfo{Token: "a1", Client: "app", ExpireTime: &expireTime}), "duplicate token")
+
+	tokenInfo, err := stores.Tokens.GetTokenInfo("a1", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenInfo != nil {
+		t.Errorf("got %+v for another client, want none", tokenInfo)
+	}
+	tokenInfo, err = stores.Tokens.FindTokenInfo("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenInfo == nil || tokenInfo.Client != "app" || !tokenInfo.ExpireTime.Equal(expireTime) {
+		t.Errorf("got %+v, want a1 of app expiring at %v", tokenInfo, expireTime)
+	}
+
+	revoked, err := stores.Tokens.RevokeClient("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTokens(t, revoked, "a1", "a2")
+	revoked, err = stores.Tokens.RevokeUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTokens(t, revoked, "a3")
+	tokenInfos, err := stores.Tokens.ListTokenInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTokens(t, tokenInfos, "a4")
+}
+
+func wantTokens(t *testing.T, tokenInfos []*accesstoken.TokenInfo, want ...string) {
+	t.Helper()
+	var tokens []string
+	for _, tokenInfo := range tokenInfos {
+		tokens = append(tokens, tokenInfo.Token)
+	}
+	sort.Strings(tokens)
+	if len(tokens) != len(want) {
+		t.Errorf("got tokens %v, want %v", tokens, want)
+		return
+	}
+	for i := range tokens {
+		if tokens[i] != want[i] {
+			t.Errorf("got tokens %v, want %v", tokens, want)
+			return
+		}
+	}
+}
+
+func testRefreshTokenUse(t *testing.T, stores *Stores) {
+	expireTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	err := stores.RefreshTokens.PutTokenInfo(&refreshtoken.TokenInfo{Token: "r1", Client: "app", User: "alice", Family: "f1", ExpireTime: &expireTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.RefreshTokens.PutTokenInfo(&refreshtoken.TokenInfo{Token: "r1", Client: "app", Family: "f1", ExpireTime: &expireTime}), "duplicate token")
+
+	// a use returns the token as it was, only the first one sees it unused
+	for _, wantUsed := range []bool{false, true} {
+		tokenInfo, err := stores.RefreshTokens.UseTokenInfo("r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenInfo == nil || tokenInfo.Client != "app" || tokenInfo.Used != wantUsed {
+			t.Fatalf("got %+v, want r1 of app with used %v", tokenInfo, wantUsed)
+		}
+	}
+	tokenInfo, err := stores.RefreshTokens.GetTokenInfo("r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenInfo == nil || !tokenInfo.Used {
+		t.Errorf("got %+v, want r1 used", tokenInfo)
+	}
+	tokenInfo, err = stores.RefreshTokens.UseTokenInfo("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenInfo != nil {
+		t.Errorf("got %+v for an unknown token, want none", tokenInfo)
+	}
+}
+
+func testRefreshTokenFamily(t *testing.T, stores *Stores) {
+	expireTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, tokenInfo := range []*refreshtoken.TokenInfo{
+		{Token: "r1", Client: "app", User: "alice", Family: "f1", AccessToken: "a1", ExpireTime: &expireTime},
+		{Token: "r2", Client: "app", User: "alice", Family: "f1", AccessToken: "a2", ExpireTime: &expireTime},
+		{Token: "r3", Client: "app", User: "alice", Family: "f2", AccessToken: "a3", ExpireTime: &expireTime},
+	} {
+		err := stores.RefreshTokens.PutTokenInfo(tokenInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stores.Tokens.PutTokenInfo(&accesstoken.TokenInfo{Token: tokenInfo.AccessToken, Client: "app", User: "alice", RefreshFamily: tokenInfo.Family, ExpireTime: &expireTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := stores.RevokeRefreshTokenFamily("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"r1", "r2", "r3"} {
+		tokenInfo, err := stores.RefreshTokens.GetTokenInfo(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (tokenInfo != nil) != (token == "r3") {
+			t.Errorf("got %+v for %v, want only r3 left", tokenInfo, token)
+		}
+	}
+	tokenInfos, err := stores.Tokens.ListTokenInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTokens(t, tokenInfos, "a3")
+}
+
+func testAuthorizationCode(t *testing.T, stores *Stores) {
+	expireTime := time.Now().Add(time.Minute).Truncate(time.Second)
+	codeInfo := &authorizationcode.CodeInfo{Code: "c1", Client: "app", User: "alice", RedirectURI: "https://app.example/callback", ExpireTime: &expireTime}
+	err := stores.Codes.PutCodeInfo(codeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, stores.Codes.PutCodeInfo(codeInfo), "duplicate code")
+
+	taken, err := stores.Codes.TakeCodeInfo("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken == nil || taken.Client != "app" || taken.RedirectURI != codeInfo.RedirectURI {
+		t.Fatalf("got %+v, want c1 of app", taken)
+	}
+	taken, err = stores.Codes.TakeCodeInfo("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken != nil {
+		t.Errorf("took %+v twice, want none the second time", taken)
+	}
+}
+
+func testLoginAttempts(t *testing.T, stores *Stores) {
+	now := time.Now().Truncate(time.Second)
+	expireTime := now.Add(time.Hour)
+	first, err := stores.Attempts.AddFailure("user:alice", now, expireTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := stores.Attempts.AddFailure("user:alice", now.Add(time.Second), expireTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Failures != 1 || second.Failures != 2 {
+		t.Fatalf("got %v then %v failures, want 1 then 2", first.Failures, second.Failures)
+	}
+
+	// taking back the last failure restores the one before
+	err = stores.Attempts.RemoveFailure("user:alice", *second.LastFailure, *first.LastFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attemptInfo, err := stores.Attempts.GetAttemptInfo("user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attemptInfo == nil || attemptInfo.Failures != 1 || !attemptInfo.LastFailure.Equal(now) {
+		t.Fatalf("got %+v, want 1 failure at %v", attemptInfo, now)
+	}
+	err = stores.Attempts.RemoveFailure("user:alice", now, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attemptInfo, err = stores.Attempts.GetAttemptInfo("user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attemptInfo != nil {
+		t.Errorf("got %+v, want none after the last failure is taken back", attemptInfo)
+	}
+
+	// an expired count starts over
+	_, err = stores.Attempts.AddFailure("ip:192.0.2.1", now, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attemptInfo, err = stores.Attempts.AddFailure("ip:192.0.2.1", now.Add(time.Minute), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attemptInfo.Failures != 1 {
+		t.Errorf("got %v failures after expiry, want 1", attemptInfo.Failures)
+	}
+}
+
+func testDeleteUser(t *testing.T, stores *Stores) {
+	expireTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	err := stores.Users.PutUserInfo(&user.UserInfo{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.RefreshTokens.PutTokenInfo(&refreshtoken.TokenInfo{Token: "r1", Client: "app", User: "alice", Family: "f1", ExpireTime: &expireTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tokenInfo := range []*accesstoken.TokenInfo{
+		{Token: "a1", Client: "app", User: "alice", RefreshFamily: "f1", ExpireTime: &expireTime},
+		{Token: "a2", Client: "app", User: "bob", ExpireTime: &expireTime},
+	} {
+		err = stores.Tokens.PutTokenInfo(tokenInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = stores.DeleteUser("alice", 2)
+	wantError(t, err, "user version conflict")
+	revoked, err := stores.DeleteUser("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 2 {
+		t.Errorf("revoked %v tokens, want 2", revoked)
+	}
+	tokenInfos, err := stores.Tokens.ListTokenInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTokens(t, tokenInfos, "a2")
+	refreshTokenInfos, err := stores.RefreshTokens.ListTokenInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refreshTokenInfos) != 0 {
+		t.Errorf("got %v refresh tokens, want none", len(refreshTokenInfos))
+	}
+}
@@ -1,38 +1,131 @@
 package stringgenerator
 
-//http://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang
-
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/MochiKung/account-interface/config"
 )
 
 const (
-	letterBytes   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # ofletter indices fitting in 63 bits
+	letterBytes = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	minEntropy  = 256
 )
 
 var (
-	src = rand.NewSource(time.Now().UnixNano())
+	AccessToken       *Generator
+	RefreshToken      *Generator
+	AuthorizationCode *Generator
+	DeviceCode        *Generator
+	RegistrationToken *Generator
 )
 
 func init() {
+	err := Configure(&config.TokenGeneration{})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Configure replaces the generators with the ones of tokenConfig, none of
+// them when any format is invalid.
+func Configure(tokenConfig *config.TokenGeneration) error {
+	var accessToken, refreshToken, authorizationCode, deviceCode, registrationToken *Generator
+	for _, format := range []struct {
+		name   string
+		format *config.TokenFormat
+		to     **Generator
+	}{
+		{"access-token", &tokenConfig.AccessToken, &accessToken},
+		{"refresh-token", &tokenConfig.RefreshToken, &refreshToken},
+		{"authorization-code", &tokenConfig.AuthorizationCode, &authorizationCode},
+		{"device-code", &tokenConfig.DeviceCode, &deviceCode},
+		{"registration-token", &tokenConfig.RegistrationToken, &registrationToken},
+	} {
+		generator, err := NewGenerator(format.format)
+		if err != nil {
+			return fmt.Errorf("invalid %v generation config: %v", format.name, err)
+		}
+		*format.to = generator
+	}
+	AccessToken = accessToken
+	RefreshToken = refreshToken
+	AuthorizationCode = authorizationCode
+	DeviceCode = deviceCode
+	RegistrationToken = registrationToken
+	return nil
+}
+
+// Generator makes secret strings of one kind. The random part always carries
+// at least 256 bits of entropy, the prefix lets secret scanners recognize the
+// kind of a leaked string.
+type Generator struct {
+	Prefix   string
+	Alphabet string
+	Length   int
+}
+
+func NewGenerator(format *config.TokenFormat) (*Generator, error) {
+	generator := &Generator{
+		Prefix:   format.Prefix,
+		Alphabet: format.Alphabet,
+		Length:   format.Length,
+	}
+	if generator.Alphabet == "" {
+		generator.Alphabet = letterBytes
+	}
+	if len(generator.Alphabet) < 2 || len(generator.Alphabet) > 256 {
+		return nil, fmt.Errorf("alphabet must have between 2 and 256 characters")
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < len(generator.Alphabet); i++ {
+		char := generator.Alphabet[i]
+		if char <= ' ' || char > '~' || seen[char] {
+			return nil, fmt.Errorf("alphabet must be unique printable ascii characters")
+		}
+		seen[char] = true
+	}
+	bitsPerChar := math.Log2(float64(len(generator.Alphabet)))
+	minLength := int(math.Ceil(minEntropy / bitsPerChar))
+	if generator.Length == 0 {
+		generator.Length = minLength
+	}
+	if generator.Length < minLength {
+		return nil, fmt.Errorf("length %v gives less than %v bits of entropy, need at least %v", generator.Length, minEntropy, minLength)
+	}
+	return generator, nil
+}
+
+func (self *Generator) Generate() string {
+	return self.Prefix + randomString(self.Alphabet, self.Length)
 }
 
 func RandomString(length int) string {
-	outString := make([]byte, length)
-	for i, cache, remain := length-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	return randomString(letterBytes, length)
+}
+
+// randomString draws from crypto/rand, discarding bytes that would bias the
+// result toward the start of the alphabet.
+func randomString(alphabet string, length int) string {
+	limit := 256 - 256%len(alphabet)
+	outString := make([]byte, 0, length)
+	buffer := make([]byte, length)
+	for len(outString) < length {
+		_, err := rand.Read(buffer)
+		if err != nil {
+			panic(err)
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			outString[i] = letterBytes[idx]
-			i--
+		for _, value := range buffer {
+			if int(value) >= limit {
+				continue
+			}
+			outString = append(outString, alphabet[int(value)%len(alphabet)])
+			if len(outString) == length {
+				break
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
 	return string(outString)
 }
@@ -0,0 +1,176 @@
+package tokenlifetime
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+)
+
+const (
+	defaultAccessToken  = time.Hour
+	defaultRefreshToken = 14 * 24 * time.Hour
+)
+
+var (
+	// Default is the policy set by Configure, the built-in lifetimes before
+	Default *Policy
+)
+
+func init() {
+	var err error
+	Default, err = New(nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Configure replaces Default with the policy of lifetimeConfig.
+func Configure(lifetimeConfig *config.TokenLifetime) error {
+	policy, err := New(lifetimeConfig)
+	if err != nil {
+		return fmt.Errorf("invalid token-lifetime config: %v", err)
+	}
+	Default = policy
+	return nil
+}
+
+// Policy is how long the tokens of a client live. Session and IdleTimeout
+// are 0 when there is no limit.
+type Policy struct {
+	AccessToken    time.Duration
+	MaxAccessToken time.Duration
+	RefreshToken   time.Duration
+	Session        time.Duration
+	IdleTimeout    time.Duration
+	RefreshTokens  bool
+}
+
+// New reads the server defaults, without a config access tokens live an hour
+// and refresh tokens two weeks.
+func New(lifetimeConfig *config.TokenLifetime) (*Policy, error) {
+	self := &Policy{
+		AccessToken:   defaultAccessToken,
+		RefreshToken:  defaultRefreshToken,
+		RefreshTokens: true,
+	}
+	if lifetimeConfig != nil {
+		for _, duration := range []struct {
+			name  string
+			value string
+			to    *time.Duration
+		}{
+			{"access-token", lifetimeConfig.AccessToken, &self.AccessToken},
+			{"max-access-token", lifetimeConfig.MaxAccessToken, &self.MaxAccessToken},
+			{"refresh-token", lifetimeConfig.RefreshToken, &self.RefreshToken},
+			{"session", lifetimeConfig.Session, &self.Session},
+			{"idle-timeout", lifetimeConfig.IdleTimeout, &self.IdleTimeout},
+		} {
+			if duration.value == "" {
+				continue
+			}
+			value, err := time.ParseDuration(duration.value)
+			if err != nil || value <= 0 {
+				return nil, fmt.Errorf("bad %v %v", duration.name, duration.value)
+			}
+			*duration.to = value
+		}
+		if lifetimeConfig.RefreshTokens != nil {
+			self.RefreshTokens = *lifetimeConfig.RefreshTokens
+		}
+	}
+	if self.MaxAccessToken < self.AccessToken {
+		self.MaxAccessToken = self.AccessToken
+	}
+	return self, nil
+}
+
+// ForClient returns the policy of clientInfo, its own settings over the ones
+// of self. An access token lifetime above the maximum is cut down to it.
+func (self *Policy) ForClient(clientInfo *client.ClientInfo) *Policy {
+	policy := *self
+	if clientInfo.AccessTokenTTL > 0 {
+		policy.AccessToken = seconds(clientInfo.AccessTokenTTL)
+	}
+	if policy.AccessToken > policy.MaxAccessToken {
+		policy.AccessToken = policy.MaxAccessToken
+	}
+	if clientInfo.RefreshTokenTTL > 0 {
+		policy.RefreshToken = seconds(clientInfo.RefreshTokenTTL)
+	}
+	if clientInfo.SessionLifetime > 0 {
+		policy.Session = seconds(clientInfo.SessionLifetime)
+	}
+	if clientInfo.IdleTimeout > 0 {
+		policy.IdleTimeout = seconds(clientInfo.IdleTimeout)
+	}
+	if clientInfo.IssueRefreshTokens != nil {
+		policy.RefreshTokens = *clientInfo.IssueRefreshTokens
+	}
+	return &policy
+}
+
+// CheckClient refuses client settings that ForClient would not honour.
+func (self *Policy) CheckClient(clientInfo *client.ClientInfo) error {
+	for _, value := range []struct {
+		name  string
+		value int64
+	}{
+		{"access token lifetime", clientInfo.AccessTokenTTL},
+		{"refresh token lifetime", clientInfo.RefreshTokenTTL},
+		{"session lifetime", clientInfo.SessionLifetime},
+		{"idle timeout", clientInfo.IdleTimeout},
+	} {
+		if value.value < 0 {
+			return fmt.Errorf("%v must not be negative", value.name)
+		}
+	}
+	if seconds(clientInfo.AccessTokenTTL) > self.MaxAccessToken {
+		return fmt.Errorf("access token lifetime must not exceed %v", self.MaxAccessToken)
+	}
+	return nil
+}
+
+// SessionExpireTime is the end of a session granted at now, nil when
+// sessions are not limited.
+func (self *Policy) SessionExpireTime(now time.Time) *time.Time {
+	if self.Session <= 0 {
+		return nil
+	}
+	sessionExpireTime := now.Add(self.Session)
+	return &sessionExpireTime
+}
+
+// AccessTokenExpireTime is when an access token issued at now expires, never
+// after sessionExpireTime.
+func (self *Policy) AccessTokenExpireTime(now time.Time, sessionExpireTime *time.Time) time.Time {
+	return capTime(now.Add(self.AccessToken), sessionExpireTime)
+}
+
+// RefreshTokenExpireTime is when a refresh token issued at now expires, the
+// idle timeout counts from the last use, which issued this token.
+func (self *Policy) RefreshTokenExpireTime(now time.Time, sessionExpireTime *time.Time) time.Time {
+	lifetime := self.RefreshToken
+	if self.IdleTimeout > 0 && self.IdleTimeout < lifetime {
+		lifetime = self.IdleTimeout
+	}
+	return capTime(now.Add(lifetime), sessionExpireTime)
+}
+
+func capTime(expireTime time.Time, sessionExpireTime *time.Time) time.Time {
+	if sessionExpireTime != nil && sessionExpireTime.Before(expireTime) {
+		return *sessionExpireTime
+	}
+	return expireTime
+}
+
+// seconds converts a client setting, saturating instead of overflowing.
+func seconds(value int64) time.Duration {
+	if value > int64(math.MaxInt64/time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(value) * time.Second
+}
@@ -0,0 +1,138 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	SecretLength = 20
+	Digits       = 6
+	Period       = 30
+
+	RecoveryCodeCount = 10
+	// 40 random bits, eight base32 characters
+	recoveryCodeBytes = 5
+
+	// codes of the steps next to the current one are accepted as well, for
+	// clocks that drift a little
+	skew = 1
+)
+
+var (
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// GenerateSecret returns a new random shared secret.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, SecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the unpadded base32 form authenticator apps expect.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// ProvisioningURI returns the otpauth uri authenticator apps read from a QR
+// code.
+func ProvisioningURI(issuer string, account string, secret []byte) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{
+		"secret":    {EncodeSecret(secret)},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(Period)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func Step(now time.Time) int64 {
+	return now.Unix() / Period
+}
+
+// Code returns the code of the time step, RFC 4226 with the step as counter.
+func Code(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%modulo)
+}
+
+// Verify checks code against the steps around now. Steps up to lastStep
+// were used before and are refused, so a code works only once. It returns
+// the step the code matched.
+func Verify(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for step := current - skew; step <= current+skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateRecoveryCodes returns count single use codes to show the user once,
+// and their hashes to store.
+func GenerateRecoveryCodes(count int) ([]string, map[string]bool, error) {
+	codes := make([]string, 0, count)
+	hashes := make(map[string]bool)
+	for len(codes) < count {
+		random := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(random))
+		code = code[:len(code)/2] + "-" + code[len(code)/2:]
+		if hashes[HashRecoveryCode(code)] {
+			continue
+		}
+		codes = append(codes, code)
+		hashes[HashRecoveryCode(code)] = true
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode ignores case, spaces and dashes, which people get wrong
+// when typing a code off paper.
+func HashRecoveryCode(code string) string {
+	normalized := strings.Map(func(char rune) rune {
+		if char == '-' || char == ' ' {
+			return -1
+		}
+		return unicode.ToLower(char)
+	}, code)
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the sha1 secret of RFC 6238 appendix B
+var testSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// the eight digit codes of RFC 6238 appendix B cut to the last six
+	for _, test := range []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got := Code(testSecret, Step(time.Unix(test.time, 0)))
+		if got != test.want {
+			t.Errorf("got %v at %v, want %v", got, test.time, test.want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+	for _, test := range []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", Code(testSecret, current), 0, current, true},
+		{"previous step", Code(testSecret, current-1), 0, current - 1, true},
+		{"next step", Code(testSecret, current+1), 0, current + 1, true},
+		{"two steps behind", Code(testSecret, current-2), 0, 0, false},
+		{"two steps ahead", Code(testSecret, current+2), 0, 0, false},
+		{"replayed step", Code(testSecret, current), current, 0, false},
+		{"step before the last", Code(testSecret, current-1), current, 0, false},
+		{"step after the last", Code(testSecret, current+1), current, current + 1, true},
+		{"wrong code", "000000", 0, 0, false},
+		{"short code", Code(testSecret, current)[1:], 0, 0, false},
+		{"long code", Code(testSecret, current) + "0", 0, 0, false},
+		{"no code", "", 0, 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := Verify(testSecret, test.code, now, test.lastStep)
+			if ok != test.wantOK || step != test.wantStep {
+				t.Errorf("got step %v and %v, want %v and %v", step, ok, test.wantStep, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("got %v codes and %v hashes, want %v", len(codes), len(hashes), RecoveryCodeCount)
+	}
+	for _, code := range codes {
+		if !hashes[HashRecoveryCode(code)] {
+			t.Errorf("code %v has no hash", code)
+		}
+		// typed off paper in capitals and without the dash
+		typed := strings.ToUpper(strings.Replace(code, "-", " ", 1))
+		if HashRecoveryCode(typed) != HashRecoveryCode(code) {
+			t.Errorf("%q hashes apart from %q", typed, code)
+		}
+	}
+}
@@ -1,48 +1,244 @@
 package verify
 
 import (
-	"reflect"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/MochiKung/account-interface/encrypt"
 	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/access-token"
 	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
 	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/totp"
 )
 
 func Init() {
 }
 
-func VerifyClientPassword(clientInfo *client.ClientInfo, password string) bool {
-	enteredEncryptPassword := encrypt.EncryptText1Way([]byte(password), clientInfo.Salt)
-	if !reflect.DeepEqual(clientInfo.EncryptedPassword, enteredEncryptPassword) {
+// AuthenticateClient returns the client of the request's basic credentials,
+// or nil when they are missing or do not match. While the client or address
+// is locked out the error is a *lockout.LockedError.
+func AuthenticateClient(stores *store.Stores, req *http.Request) (*client.ClientInfo, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	attempt, err := lockout.Default.Check(stores.Attempts, req, lockout.ClientKey(username))
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.Release()
+	clientInfo, err := stores.Clients.GetClientInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	if !VerifyClientPassword(stores.Clients, clientInfo, password) {
+		attempt.Fail()
+		return nil, nil
+	}
+	attempt.Succeed()
+	return clientInfo, nil
+}
+
+// BearerToken returns the token of the request's bearer authorization, empty
+// when there is none.
+func BearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[7:])
+}
+
+// AuthenticateBearer returns the access token of the request's bearer
+// authorization, or nil when it is missing, unknown or expired.
+func AuthenticateBearer(tokenStore store.TokenStore, req *http.Request) (*accesstoken.TokenInfo, error) {
+	token := BearerToken(req)
+	if token == "" {
+		return nil, nil
+	}
+	tokenInfo, err := tokenStore.FindTokenInfo(token)
+	if err != nil || tokenInfo == nil {
+		return nil, err
+	}
+	if tokenInfo.ExpireTime.Before(time.Now()) {
+		return nil, nil
+	}
+	return tokenInfo, nil
+}
+
+// VerifyClientPassword checks the password of a client. A nil clientInfo,
+// for a client that does not exist, fails after as much work as a wrong
+// password, so the two cannot be told apart by timing.
+func VerifyClientPassword(clientStore store.ClientStore, clientInfo *client.ClientInfo, password string) bool {
+	if clientInfo == nil {
+		encrypt.VerifyDummy([]byte(password))
 		return false
 	}
-	return true
+	ok, rehash, err := encrypt.VerifyPassword([]byte(password), clientInfo.EncryptedPassword, clientInfo.Salt)
+	if err != nil {
+		log.Printf("failed to verify password of client %v: %v\n", clientInfo.ClientUsername, err)
+		return false
+	}
+	if rehash {
+		encryptedPassword, err := encrypt.HashPassword([]byte(password))
+		if err == nil {
+			err = clientStore.UpdatePassword(clientInfo.ClientUsername, encryptedPassword, nil)
+		}
+		if err != nil {
+			log.Printf("failed to rehash password of client %v: %v\n", clientInfo.ClientUsername, err)
+		}
+	}
+	return ok
+}
+
+// VerifyUserPassword checks the password of a user. Like
+// VerifyClientPassword it takes a nil userInfo for an unknown user. Whether
+// the user may sign in is left to the caller, a right password for an account
+// that is not active is no failed attempt.
+func VerifyUserPassword(userStore store.UserStore, userInfo *user.UserInfo, password string) bool {
+	if userInfo == nil {
+		encrypt.VerifyDummy([]byte(password))
+		return false
+	}
+	ok, rehash, err := encrypt.VerifyPassword([]byte(password), userInfo.EncryptedPassword, userInfo.Salt)
+	if err != nil {
+		log.Printf("failed to verify password of user %v: %v\n", userInfo.Username, err)
+		return false
+	}
+	if rehash {
+		encryptedPassword, err := encrypt.HashPassword([]byte(password))
+		if err == nil {
+			err = userStore.UpdatePassword(userInfo.Username, encryptedPassword, nil)
+		}
+		if err != nil {
+			log.Printf("failed to rehash password of user %v: %v\n", userInfo.Username, err)
+		} else {
+			// keep userInfo at the stored version for the caller's own updates
+			userInfo.EncryptedPassword = encryptedPassword
+			userInfo.Salt = nil
+			userInfo.Version++
+		}
+	}
+	return ok
 }
 
-func VerifyUserPassword(userInfo *user.UserInfo, password string) bool {
-	enteredEncryptPassword := encrypt.EncryptText1Way([]byte(password), userInfo.Salt)
-	if !reflect.DeepEqual(userInfo.EncryptedPassword, enteredEncryptPassword) {
+// VerifySecondFactor accepts a current TOTP code or an unused recovery code
+// of a user with MFA enabled. The accepted code is spent in the store, so a
+// concurrent use of the same code loses on the version check.
+func VerifySecondFactor(userStore store.UserStore, userInfo *user.UserInfo, otp string) bool {
+	if !userInfo.MFAEnabled() || otp == "" {
+		return false
+	}
+	if step, ok := totp.Verify(userInfo.TOTPSecret, otp, time.Now(), userInfo.TOTPLastStep); ok {
+		userInfo.TOTPLastStep = step
+	} else if hash := totp.HashRecoveryCode(otp); userInfo.RecoveryCodes[hash] {
+		delete(userInfo.RecoveryCodes, hash)
+		log.Printf("user %v used a recovery code, %v left\n", userInfo.Username, len(userInfo.RecoveryCodes))
+	} else {
+		return false
+	}
+	err := userStore.UpdateUserInfo(userInfo)
+	if err != nil {
+		log.Printf("failed to spend second factor of user %v: %v\n", userInfo.Username, err)
 		return false
 	}
 	return true
 }
 
-func VerifyGrantScopes(clientInfo *client.ClientInfo, grantType string, scopes string) bool {
+// VerifyGrantScopes returns the scope granted to clientInfo for a grantType
+// request of scopes, deduplicated and sorted. A request without scope gets
+// the default scopes of the client that the grant allows. It fails when a
+// requested scope is not allowed for the grant.
+func VerifyGrantScopes(clientInfo *client.ClientInfo, grantType string, scopes string) (string, bool) {
 	var clientScope map[string]bool
 	switch grantType {
+	case oauth2.AuthorizationCodeGrant:
+		clientScope = clientInfo.GrantAuthorizationCode
 	case oauth2.ResourceOwnerCredentialsGrant:
 		clientScope = clientInfo.GrantResourceOwner
 	case oauth2.ClientCredentialsGrant:
 		clientScope = clientInfo.GrantClientCredentials
 	}
 
-	scopeSlice := strings.Split(scopes, ",")
-	for _, scope := range scopeSlice {
+	requestedScope := database.StringToSet(scopes)
+	if len(requestedScope) == 0 {
+		grantedScope := make(map[string]bool)
+		for scope, isDefault := range clientInfo.DefaultScopes {
+			if isDefault && clientScope[scope] {
+				grantedScope[scope] = true
+			}
+		}
+		return database.SetToString(grantedScope), true
+	}
+	for scope := range requestedScope {
 		if !clientScope[scope] {
+			return "", false
+		}
+	}
+	return database.SetToString(requestedScope), true
+}
+
+func HasScope(scopes string, scope string) bool {
+	return database.StringToSet(scopes)[scope]
+}
+
+func VerifyScopeSubset(grantedScopes string, scopes string) bool {
+	grantedScope := database.StringToSet(grantedScopes)
+	for scope := range database.StringToSet(scopes) {
+		if !grantedScope[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeScopes deduplicates and sorts scopes and delimits them with
+// spaces, whatever form they were sent or stored in.
+func NormalizeScopes(scopes string) string {
+	return database.SetToString(database.StringToSet(scopes))
+}
+
+// VerifyCodeChallengeFormat checks a code_challenge or code_verifier against
+// the syntax of RFC 7636 section 4.1.
+func VerifyCodeChallengeFormat(value string) bool {
+	if len(value) < 43 || len(value) > 128 {
+		return false
+	}
+	for _, char := range value {
+		switch {
+		case 'A' <= char && char <= 'Z':
+		case 'a' <= char && char <= 'z':
+		case '0' <= char && char <= '9':
+		case char == '-' || char == '.' || char == '_' || char == '~':
+		default:
 			return false
 		}
 	}
 	return true
 }
+
+func VerifyCodeVerifier(challenge string, method string, verifier string) bool {
+	if !VerifyCodeChallengeFormat(verifier) {
+		return false
+	}
+	var expected string
+	switch method {
+	case oauth2.PlainCodeChallengeMethod:
+		expected = verifier
+	case oauth2.S256CodeChallengeMethod:
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(expected)) == 1
+}
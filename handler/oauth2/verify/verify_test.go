@@ -0,0 +1,275 @@
+package verify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/client"
+	"github.com/MochiKung/account-interface/handler/oauth2/database/user"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/totp"
+)
+
+// countingHasher is a cheap argon2id hasher that counts verifications.
+type countingHasher struct {
+	encrypt.Argon2idHasher
+	verified int
+}
+
+func (self *countingHasher) Verify(password []byte, encoded string) (bool, error) {
+	self.verified++
+	return self.Argon2idHasher.Verify(password, encoded)
+}
+
+func useCountingHasher(t *testing.T) *countingHasher {
+	hasher := &countingHasher{Argon2idHasher: encrypt.Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}}
+	defaultHasher := encrypt.DefaultHasher
+	encrypt.DefaultHasher = hasher
+	t.Cleanup(func() {
+		encrypt.DefaultHasher = defaultHasher
+	})
+	return hasher
+}
+
+// recordingUserStore counts the writes that go through it.
+type recordingUserStore struct {
+	store.UserStore
+	writes int
+}
+
+func (self *recordingUserStore) UpdateUserInfo(userInfo *user.UserInfo) error {
+	self.writes++
+	return self.UserStore.UpdateUserInfo(userInfo)
+}
+
+func (self *recordingUserStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	self.writes++
+	return self.UserStore.UpdatePassword(username, encryptedPassword, salt)
+}
+
+type recordingClientStore struct {
+	store.ClientStore
+	writes int
+}
+
+func (self *recordingClientStore) UpdateClientInfo(clientInfo *client.ClientInfo) error {
+	self.writes++
+	return self.ClientStore.UpdateClientInfo(clientInfo)
+}
+
+func (self *recordingClientStore) UpdatePassword(username string, encryptedPassword []byte, salt []byte) error {
+	self.writes++
+	return self.ClientStore.UpdatePassword(username, encryptedPassword, salt)
+}
+
+func TestVerifyUserPassword(t *testing.T) {
+	hasher := useCountingHasher(t)
+	userStore := &recordingUserStore{UserStore: user.NewMemoryStore()}
+	encryptedPassword, err := encrypt.HashPassword([]byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("salt")
+	for _, userInfo := range []*user.UserInfo{
+		{Username: "current", EncryptedPassword: encryptedPassword},
+		{Username: "disabled", EncryptedPassword: encryptedPassword, State: user.DisabledState},
+		{Username: "legacy", EncryptedPassword: encrypt.EncryptText1Way([]byte("right"), salt), Salt: salt},
+		{Username: "migrated", EncryptedPassword: encrypt.EncryptText1Way([]byte("right"), salt), Salt: salt},
+	} {
+		err = userStore.PutUserInfo(userInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name       string
+		username   string
+		password   string
+		wantOK     bool
+		wantWrites int
+	}{
+		{"unknown user", "nobody", "right", false, 0},
+		{"wrong password", "current", "wrong", false, 0},
+		{"wrong password of legacy hash", "legacy", "wrong", false, 0},
+		{"right password", "current", "right", true, 0},
+		{"right password of disabled user", "disabled", "right", true, 0},
+		{"right password of legacy hash", "migrated", "right", true, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hasher.verified = 0
+			userStore.writes = 0
+			userInfo, err := userStore.GetUserInfo(test.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok := VerifyUserPassword(userStore, userInfo, test.password)
+			if ok != test.wantOK {
+				t.Errorf("got %v, want %v", ok, test.wantOK)
+			}
+			if hasher.verified != 1 {
+				t.Errorf("default hasher verified %v times, want 1", hasher.verified)
+			}
+			if userStore.writes != test.wantWrites {
+				t.Errorf("got %v writes, want %v", userStore.writes, test.wantWrites)
+			}
+		})
+	}
+}
+
+func TestVerifyClientPassword(t *testing.T) {
+	hasher := useCountingHasher(t)
+	clientStore := &recordingClientStore{ClientStore: client.NewMemoryStore()}
+	encryptedPassword, err := encrypt.HashPassword([]byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("salt")
+	for _, clientInfo := range []*client.ClientInfo{
+		{ClientUsername: "current", EncryptedPassword: encryptedPassword},
+		{ClientUsername: "legacy", EncryptedPassword: encrypt.EncryptText1Way([]byte("right"), salt), Salt: salt},
+	} {
+		err = clientStore.PutClientInfo(clientInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		username string
+		password string
+		wantOK   bool
+	}{
+		{"unknown client", "nobody", "right", false},
+		{"wrong password", "current", "wrong", false},
+		{"wrong password of legacy hash", "legacy", "wrong", false},
+		{"right password", "current", "right", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hasher.verified = 0
+			clientStore.writes = 0
+			clientInfo, err := clientStore.GetClientInfo(test.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok := VerifyClientPassword(clientStore, clientInfo, test.password)
+			if ok != test.wantOK {
+				t.Errorf("got %v, want %v", ok, test.wantOK)
+			}
+			if hasher.verified != 1 {
+				t.Errorf("default hasher verified %v times, want 1", hasher.verified)
+			}
+			if clientStore.writes != 0 {
+				t.Errorf("got %v writes, want none", clientStore.writes)
+			}
+		})
+	}
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	for _, test := range []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		want      bool
+	}{
+		{"S256", challenge, oauth2.S256CodeChallengeMethod, verifier, true},
+		{"S256 wrong verifier", challenge, oauth2.S256CodeChallengeMethod, "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXK", false},
+		{"S256 verifier sent as challenge", challenge, oauth2.S256CodeChallengeMethod, challenge, false},
+		{"plain", verifier, oauth2.PlainCodeChallengeMethod, verifier, true},
+		{"plain wrong verifier", verifier, oauth2.PlainCodeChallengeMethod, challenge, false},
+		{"unknown method", verifier, "S512", verifier, false},
+		{"no method", verifier, "", verifier, false},
+		{"short verifier", "short", oauth2.PlainCodeChallengeMethod, "short", false},
+		{"no verifier", challenge, oauth2.S256CodeChallengeMethod, "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := VerifyCodeVerifier(test.challenge, test.method, test.verifier)
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	userStore := &recordingUserStore{UserStore: user.NewMemoryStore()}
+	secret := []byte("12345678901234567890")
+	codes, hashes, err := totp.GenerateRecoveryCodes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = userStore.PutUserInfo(&user.UserInfo{Username: "alice", TOTPEnabled: true, TOTPSecret: secret, RecoveryCodes: hashes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp := totp.Code(secret, totp.Step(time.Now()))
+
+	for _, test := range []struct {
+		name   string
+		otp    string
+		wantOK bool
+	}{
+		{"totp code", otp, true},
+		{"replayed totp code", otp, false},
+		{"recovery code", codes[0], true},
+		{"spent recovery code", codes[0], false},
+		{"other recovery code", codes[1], true},
+		{"wrong code", "000000", false},
+		{"no code", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			userStore.writes = 0
+			userInfo, err := userStore.GetUserInfo("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok := VerifySecondFactor(userStore, userInfo, test.otp)
+			if ok != test.wantOK {
+				t.Errorf("got %v, want %v", ok, test.wantOK)
+			}
+			if ok && userStore.writes != 1 {
+				t.Errorf("got %v writes, want the code spent in the store", userStore.writes)
+			}
+		})
+	}
+}
+
+func TestVerifyGrantScopes(t *testing.T) {
+	clientInfo := &client.ClientInfo{
+		ClientUsername:         "app",
+		GrantAuthorizationCode: map[string]bool{"read": true, "write": true, "profile": true},
+		GrantClientCredentials: map[string]bool{"admin": true},
+		DefaultScopes:          map[string]bool{"read": true, "profile": true, "admin": true, "email": true, "write": false},
+	}
+	for _, test := range []struct {
+		name      string
+		grantType string
+		scopes    string
+		want      string
+		wantOK    bool
+	}{
+		{"default scopes the grant allows", oauth2.AuthorizationCodeGrant, "", "profile read", true},
+		{"default scopes of another grant", oauth2.ClientCredentialsGrant, "", "admin", true},
+		{"no default scope the grant allows", oauth2.ResourceOwnerCredentialsGrant, "", "", true},
+		{"requested scopes", oauth2.AuthorizationCodeGrant, "write read write", "read write", true},
+		{"comma delimited scopes", oauth2.AuthorizationCodeGrant, "write,read", "read write", true},
+		{"scope of another grant", oauth2.AuthorizationCodeGrant, "read admin", "", false},
+		{"default scope the grant does not allow", oauth2.AuthorizationCodeGrant, "email", "", false},
+		{"unknown grant", "implicit", "read", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := VerifyGrantScopes(clientInfo, test.grantType, test.scopes)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("got %q and %v, want %q and %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
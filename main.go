@@ -10,9 +10,27 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/MochiKung/account-interface/admin"
 	"github.com/MochiKung/account-interface/config"
+	"github.com/MochiKung/account-interface/encrypt"
+	"github.com/MochiKung/account-interface/handler/account"
+	"github.com/MochiKung/account-interface/handler/admin/clients"
+	"github.com/MochiKung/account-interface/handler/oauth2"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/authorize"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/introspect"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/jwks"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/metadata"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/register"
+	"github.com/MochiKung/account-interface/handler/oauth2/handler/revoke"
 	"github.com/MochiKung/account-interface/handler/oauth2/handler/token"
+	"github.com/MochiKung/account-interface/handler/oauth2/janitor"
+	"github.com/MochiKung/account-interface/handler/oauth2/jwt"
+	"github.com/MochiKung/account-interface/handler/oauth2/lockout"
+	"github.com/MochiKung/account-interface/handler/oauth2/store"
+	"github.com/MochiKung/account-interface/handler/oauth2/string-generator"
+	"github.com/MochiKung/account-interface/handler/oauth2/token-lifetime"
 )
 
 func main() {
@@ -22,15 +40,70 @@ func main() {
 	terminatedFlag := false
 
 	// parse configs
+	err = configure()
+	if err != nil {
+		log.Fatalln(err)
+	}
 	conf := config.Default
 
+	// administration commands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(admin.Main(os.Args[2:]))
+	}
+
+	// open databases
+	stores, err := store.Open(&conf.Database)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	// setup request handlers
-	http.Handle(token.PrefixPath, token.New())
+	oauth2.Register(authorize.PrefixPath, "authorization_endpoint", authorize.New(stores))
+	oauth2.Register(token.PrefixPath, "token_endpoint", token.New(stores))
+	oauth2.Register(introspect.PrefixPath, "introspection_endpoint", introspect.New(stores))
+	oauth2.Register(revoke.PrefixPath, "revocation_endpoint", revoke.New(stores))
+	// opaque access tokens have no keys to publish
+	if jwt.Keys.Active() != nil {
+		oauth2.Register(jwks.PrefixPath, "jwks_uri", jwks.New())
+		oauth2.Register(jwks.WellKnownPath, "", jwks.New())
+	}
+	oauth2.Register(metadata.AuthorizationServerPath, "", metadata.New(stores, conf.Metadata))
+	oauth2.Register(metadata.OpenIDConfigurationPath, "", metadata.NewOpenID(stores, conf.Metadata))
+	if conf.Registration != nil {
+		oauth2.Register(register.PrefixPath, "registration_endpoint", register.New(stores, conf.Registration))
+		oauth2.Register(register.PrefixPath+"/", "", register.New(stores, conf.Registration))
+	}
+	if conf.Accounts != nil {
+		oauth2.Register(account.PrefixPath, "", account.New(stores, conf.Accounts))
+		oauth2.Register(account.RegisterPath, "", account.New(stores, conf.Accounts))
+		oauth2.Register(account.TOTPPath, "", account.New(stores, conf.Accounts))
+		oauth2.Register(account.TOTPConfirmPath, "", account.New(stores, conf.Accounts))
+		oauth2.Register(account.RecoveryCodesPath, "", account.New(stores, conf.Accounts))
+	}
+	oauth2.Register(clients.PrefixPath, "", clients.New(stores))
+	oauth2.Register(clients.PrefixPath+"/", "", clients.New(stores))
+	for _, endpoint := range oauth2.Endpoints() {
+		http.Handle(endpoint.Path, endpoint.Handler)
+	}
+
+	// start removing expired tokens
+	var sweeper *janitor.Janitor
+	if conf.Janitor != nil {
+		sweeper, err = janitor.New(stores, conf.Janitor)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sweeper.Start()
+	}
 
 	// listen for termination signals
 	termsig := make(chan os.Signal, 1)
 	signal.Notify(termsig, os.Interrupt)
 
+	// listen for reload signals
+	reloadsig := make(chan os.Signal, 1)
+	signal.Notify(reloadsig, syscall.SIGHUP)
+
 	// listen requests
 	if conf.Server == nil {
 		log.Println("no server config")
@@ -65,6 +138,11 @@ func main() {
 				}
 				listener = nil
 			}
+		case <-reloadsig:
+			log.Println("received reload request. reloading signing keys")
+			if err := reloadSigningKeys(); err != nil {
+				log.Printf("failed to reload signing keys: %v\n", err)
+			}
 		case terminate := <-terminateChannel:
 			log.Printf("requests listener stopped with status %v\n", terminate)
 			status |= terminate
@@ -81,12 +159,59 @@ func main() {
 	}
 
 	// clean up
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+	if err := stores.Close(); err != nil {
+		log.Printf("failed to close databases: %v\n", err)
+		status |= int(2)
+	}
+	signal.Stop(reloadsig)
+	close(reloadsig)
 	close(terminateChannel)
 	close(termsig)
 
 	os.Exit(status)
 }
 
+// configure loads the config file and hands every package its part.
+func configure() error {
+	err := config.LoadDefault()
+	if err != nil {
+		return err
+	}
+	conf := config.Default
+	err = encrypt.Configure(&conf.PasswordHash)
+	if err != nil {
+		return err
+	}
+	err = stringgenerator.Configure(&conf.TokenGeneration)
+	if err != nil {
+		return err
+	}
+	err = tokenlifetime.Configure(conf.TokenLifetime)
+	if err != nil {
+		return err
+	}
+	err = lockout.Configure(conf.Lockout)
+	if err != nil {
+		return err
+	}
+	err = oauth2.ConfigureTrustedProxies(conf.Server)
+	if err != nil {
+		return err
+	}
+	return token.LoadSigningKeys(conf)
+}
+
+func reloadSigningKeys() error {
+	conf, err := config.Load(config.DefaultFile)
+	if err != nil {
+		return err
+	}
+	return token.LoadSigningKeys(conf)
+}
+
 func startServer(serverConfig *config.Server) (net.Listener, chan int, error) {
 	// create server
 	terminate := make(chan int, 1)